@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Takes over playlist directories on the device which have no meta.json,
+// like music copied by hand or a lost meta.json. Files are matched to the
+// tracks of the playlist by name, size, duration and optionally contents,
+// and a meta.json is written, so the next sync renames and updates them
+// instead of copying everything again.
+//
+//	iwalk adopt                    # directories without meta.json
+//	iwalk -rebuild adopt           # also replace existing meta.json
+//	iwalk -adopt_hash adopt        # compare contents with the library files
+//	iwalk -unmatched=delete adopt  # keep(default), delete or ignore the rest
+//
+// Ignored files are recorded in meta.json and not listed again.
+
+// Durations read from transcoded files differ a bit
+const ADOPT_DURATION_TOLERANCE = 2000 // msec
+
+// "01 ", "0001 ", "3. ", "12 - " before names
+var numberPrefixPattern = regexp.MustCompile(`^\d+\s*[-_.]?\s*`)
+
+type AdoptOptions struct {
+	// Replace meta.json of directories having one
+	Rebuild bool
+	// Compare checksums of files with the library files
+	Hash bool
+	// What to do with files not matched: keep, delete or ignore
+	Unmatched string
+}
+
+// A file found in the directory
+type adoptFile struct {
+	path     string
+	relPath  string
+	size     int64
+	duration int // msec, 0 if unknown
+	nameKeys []string
+	checksum string
+}
+
+// A track of the playlist
+type adoptTrack struct {
+	track Track
+	// what sync makes of it
+	profile  *TranscodeProfile
+	syncs    bool
+	size     int64
+	nameKeys []string
+	checksum string
+}
+
+type adoptMatch struct {
+	file  *adoptFile
+	track *adoptTrack
+	score int
+	// the file is what sync would have written
+	current bool
+}
+
+func startAdopt(source LibrarySource, targetDir string, options *SyncOptions, adoptOptions *AdoptOptions) error {
+	ctx, err := newSyncContext(source, targetDir, options)
+	if err != nil {
+		return err
+	}
+	return ctx.Adopt(adoptOptions)
+}
+
+func (c *SyncContext) Adopt(adoptOptions *AdoptOptions) error {
+	if c.options.Layout == "pool" {
+		return fmt.Errorf("adopt works with the playlist layout only")
+	}
+	if err := RecoverJournal(c.sink.Path); err != nil {
+		return err
+	}
+	engine := NewIOEngine()
+	unmatchedCount := 0
+	for _, playlistRef := range c.syncPlaylists {
+		playlist, ok := resolvePlaylist(c.lib, playlistRef)
+		if !ok {
+			return fmt.Errorf("Playlist '%s' not found in library", playlistRef)
+		}
+		sink, err := c.sinkFor(playlist)
+		if err != nil {
+			return err
+		}
+		folders := playlistFolderPath(c.lib, playlist)
+		relDir := playlistRelDir(c.options.Filesystem, folders, playlist.Name)
+		dirPath := path.Join(sink.Path, relDir)
+		if !isFileExists(dirPath) {
+			logrus.Debugf("Nothing to adopt for %s: %s does not exist", playlist.Name, dirPath)
+			continue
+		}
+		var prev *SinkDir
+		if isFileExists(path.Join(dirPath, META_JSON_FILENAME)) {
+			prev, err = sink.openSinkDirContents(dirPath)
+			if err == nil && !adoptOptions.Rebuild {
+				logrus.Infof("%s has meta.json, skipping (-rebuild to replace it)", relDir)
+				continue
+			} else if err != nil {
+				logrus.Warnf("Broken meta.json in %s, rebuilding: %s", relDir, err)
+				prev = nil
+			}
+		}
+		sinkDir, unmatched, err := c.adoptDir(playlist, folders, dirPath, prev, adoptOptions)
+		if err != nil {
+			return err
+		}
+		unmatchedCount += len(unmatched)
+		if len(unmatched) > 0 {
+			fmt.Printf("%s: %d files not matched to tracks of %s:\n", relDir, len(unmatched), playlist.Name)
+			for _, relPath := range unmatched {
+				fmt.Printf("  %s\n", relPath)
+			}
+		}
+		switch adoptOptions.Unmatched {
+		case "delete":
+			for _, relPath := range unmatched {
+				if act := NewDelete(path.Join(dirPath, relPath)); act != nil {
+					engine.Push(act)
+				}
+			}
+			if len(unmatched) > 0 {
+				engine.Push(NewPruneEmptyDirs(dirPath))
+			}
+		case "ignore":
+			sinkDir.IgnoredFiles = append(sinkDir.IgnoredFiles, unmatched...)
+			sort.Strings(sinkDir.IgnoredFiles)
+		}
+		data, err := json.Marshal(sinkDir)
+		if err != nil {
+			return err
+		}
+		engine.Push(NewWriteFileAction(path.Join(dirPath, META_JSON_FILENAME), path.Join(dirPath, META_JSON_TEMP_FILENAME), data))
+	}
+	if unmatchedCount > 0 && adoptOptions.Unmatched == "keep" {
+		fmt.Println("Unmatched files are kept. -unmatched=delete removes them, -unmatched=ignore stops listing them.")
+	}
+	engine.Confine(c.sink.Path)
+	for _, sink := range c.kindSinks {
+		engine.Confine(sink.Path)
+	}
+	engine.JournalAt(c.sink.Path)
+	engine.SetFilesystem(c.options.Filesystem)
+	proceed, err := engine.Check(c.sink.Path, 0)
+	if err != nil || !proceed {
+		return err
+	}
+	return engine.Run()
+}
+
+// Reconstructed sink dir and files not matched, relative to dirPath
+func (c *SyncContext) adoptDir(playlist *Playlist, folders []string, dirPath string, prev *SinkDir, adoptOptions *AdoptOptions) (*SinkDir, []string, error) {
+	logrus.Infof("Adopting %s for %s", dirPath, playlist.Name)
+	ignored := make(map[string]bool)
+	if prev != nil {
+		for _, relPath := range prev.IgnoredFiles {
+			ignored[relPath] = true
+		}
+	}
+	files, err := scanAdoptFiles(dirPath, ignored)
+	if err != nil {
+		return nil, nil, err
+	}
+	tracks, err := c.lib.PlaylistTracks(playlist)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates := make([]*adoptTrack, 0, len(tracks))
+	for _, track := range tracks {
+		if len(track.Location) == 0 {
+			continue
+		}
+		candidate := &adoptTrack{track: track, size: int64(track.Size)}
+		candidate.profile, candidate.syncs = c.options.trackProfile(&track)
+		if st, err := os.Stat(track.LocalPath()); err == nil {
+			candidate.size = st.Size()
+		}
+		sourceName := strings.TrimSuffix(path.Base(track.LocalPath()), filepath.Ext(track.LocalPath()))
+		names := []string{track.Name, sourceName}
+		if track.Artist != "" {
+			names = append(names, track.Artist+" - "+track.Name)
+		}
+		candidate.nameKeys = adoptNameKeys(c.options.Filesystem, names...)
+		candidates = append(candidates, candidate)
+	}
+	matches := make([]*adoptMatch, 0)
+	for _, file := range files {
+		for _, candidate := range candidates {
+			if match := c.matchAdoptFile(file, candidate, adoptOptions.Hash); match != nil {
+				matches = append(matches, match)
+			}
+		}
+	}
+	// best matches first, each file and track is taken once
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+	sinkDir := &SinkDir{
+		Path:               dirPath,
+		CheckedTracks:      make(map[string]bool),
+		Tracks:             make(map[string]*TrackMeta),
+		OriginPlaylistID:   playlist.PlaylistPersistentId,
+		OriginPlaylistName: playlist.Name,
+		OriginFolderPath:   folders,
+	}
+	if prev != nil {
+		sinkDir.IgnoredFiles = prev.IgnoredFiles
+	}
+	adopted := make(map[string]bool)
+	for _, match := range matches {
+		track := &match.track.track
+		if adopted[match.file.relPath] || sinkDir.Tracks[track.PersistentId] != nil {
+			continue
+		}
+		adopted[match.file.relPath] = true
+		meta := &TrackMeta{
+			OriginID:           strconv.Itoa(track.TrackId),
+			OriginPersistentID: track.PersistentId,
+			FileName:           match.file.relPath,
+			ModifiedTime:       track.DateModified,
+			Size:               match.file.size,
+			Checksum:           match.file.checksum,
+		}
+		if match.track.profile != nil && match.current {
+			meta.TranscodeProfile = match.track.profile.Name
+		}
+		if !match.current {
+			// not what sync writes, replaced by the next sync
+			meta.ModifiedTime = time.Time{}
+			logrus.Infof("-- ADOPT*: %s (%s, will be replaced)", track.Name, match.file.relPath)
+		} else {
+			logrus.Infof("-- ADOPT : %s (%s)", track.Name, match.file.relPath)
+		}
+		sinkDir.Tracks[track.PersistentId] = meta
+	}
+	unmatched := make([]string, 0)
+	for _, file := range files {
+		if !adopted[file.relPath] {
+			unmatched = append(unmatched, file.relPath)
+		}
+	}
+	fmt.Printf("%s: adopted %d of %d tracks\n", playlist.Name, len(sinkDir.Tracks), len(candidates))
+	return sinkDir, unmatched, nil
+}
+
+// Audio and other files in dirPath, except the ones iwalk keeps there
+func scanAdoptFiles(dirPath string, ignored map[string]bool) ([]*adoptFile, error) {
+	ret := make([]*adoptFile, 0)
+	err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			// .DS_Store, ._ files of macOS and .iwalk-rename temp files
+			if info.IsDir() && filePath != dirPath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return err
+		}
+		if ignored[relPath] || isIwalkFile(info.Name()) {
+			return nil
+		}
+		ret = append(ret, &adoptFile{
+			path:    filePath,
+			relPath: relPath,
+			size:    info.Size(),
+		})
+		return nil
+	})
+	return ret, err
+}
+
+// meta.json, playlist files, the journal and temp files
+func isIwalkFile(name string) bool {
+	switch name {
+	case META_JSON_FILENAME, META_JSON_TEMP_FILENAME, PLAYLIST_FILE_TEMP_FILENAME, JOURNAL_FILENAME:
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tmp", ".m3u", ".m3u8":
+		return true
+	}
+	return false
+}
+
+// Keys to compare names of files and tracks with: without extension
+// and number prefix, case and normalization folded
+func adoptNameKeys(filesystem *FilesystemProfile, names ...string) []string {
+	ret := make([]string, 0, len(names)*2)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		name = filesystem.Sanitize(name)
+		ret = append(ret, conservativePathKey(name))
+		if stripped := numberPrefixPattern.ReplaceAllString(name, ""); stripped != "" && stripped != name {
+			ret = append(ret, conservativePathKey(stripped))
+		}
+	}
+	return ret
+}
+
+// nil if the file is not the track. Two of name, size and duration must
+// agree, or the contents.
+func (c *SyncContext) matchAdoptFile(file *adoptFile, candidate *adoptTrack, hash bool) *adoptMatch {
+	track := &candidate.track
+	fileName := path.Base(file.relPath)
+	if file.nameKeys == nil {
+		file.nameKeys = adoptNameKeys(c.options.Filesystem, strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+	}
+	sameName := false
+	for _, key := range file.nameKeys {
+		for _, trackKey := range candidate.nameKeys {
+			if key == trackKey {
+				sameName = true
+			}
+		}
+	}
+	sameSize := candidate.size > 0 && file.size == candidate.size
+	if sameSize && hash {
+		if file.checksum == "" {
+			file.checksum, _, _ = hashFile(file.path, false)
+		}
+		if candidate.checksum == "" && track.Fetch() == nil {
+			candidate.checksum, _, _ = hashFile(track.LocalPath(), false)
+		}
+		if file.checksum != "" && file.checksum == candidate.checksum {
+			return &adoptMatch{file: file, track: candidate, score: 100, current: c.isAdoptCurrent(file, candidate, true)}
+		}
+		// same size by chance, or edited
+		sameSize = false
+	}
+	if !sameName && !sameSize {
+		return nil // durations alone are not enough, don't read tags
+	}
+	sameDuration := false
+	if track.TotalTime > 0 {
+		if file.duration == 0 {
+			file.duration = -1
+			if tags, err := ReadAudioTags(file.path); err == nil && tags.Duration > 0 {
+				file.duration = tags.Duration
+			}
+		}
+		diff := file.duration - track.TotalTime
+		sameDuration = file.duration > 0 && diff <= ADOPT_DURATION_TOLERANCE && diff >= -ADOPT_DURATION_TOLERANCE
+	}
+	score, evidences := 0, 0
+	for _, e := range []struct {
+		ok    bool
+		score int
+	}{{sameName, 4}, {sameSize, 2}, {sameDuration, 1}} {
+		if e.ok {
+			score += e.score
+			evidences += 1
+		}
+	}
+	if evidences < 2 {
+		return nil
+	}
+	return &adoptMatch{file: file, track: candidate, score: score, current: c.isAdoptCurrent(file, candidate, sameSize)}
+}
+
+// Whether sync would write the same: the source copied as is, or a file
+// converted with the profile it would use
+func (c *SyncContext) isAdoptCurrent(file *adoptFile, candidate *adoptTrack, sameSize bool) bool {
+	profile := candidate.profile
+	if !candidate.syncs {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(file.relPath))
+	if profile == nil {
+		return sameSize && ext == strings.ToLower(filepath.Ext(candidate.track.Location))
+	}
+	return !sameSize && ext == strings.ToLower(profile.Extension())
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	_ "modernc.org/sqlite"
+)
+
+// beets library.db as a source. beets has no playlists, so they are defined
+// in config as beets queries:
+//
+//	source:
+//	  type: beets
+//	  queries:
+//	    Jazz 60s: "genre:jazz year:1960..1969 year+"
+//
+// A playlist name which is not defined in queries is evaluated as a query itself.
+type BeetsSource struct {
+	*Library
+	items   []beetsItem
+	queries map[string]string
+}
+
+// Row of items table with flexible attributes merged, values as text
+type beetsItem map[string]string
+
+// Fields matched by a bare term (same as beets' item defaults)
+var beetsDefaultFields = []string{"artist", "title", "album", "albumartist", "genre", "comments"}
+
+// Default order of beets' `ls`
+var beetsDefaultSort = []beetsSort{{"artist", true}, {"album", true}, {"disc", true}, {"track", true}}
+
+var beetsDateFields = map[string]bool{"added": true, "mtime": true}
+
+func defaultBeetsLibraryPath() string {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		configDir = path.Join(os.Getenv("HOME"), ".config")
+	}
+	return path.Join(configDir, "beets/library.db")
+}
+
+func beetsValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func loadBeetsItems(db *sql.DB) ([]beetsItem, error) {
+	rows, err := db.Query("SELECT * FROM items")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]beetsItem, 0)
+	itemMap := make(map[string]beetsItem)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		item := make(beetsItem, len(columns))
+		for i, column := range columns {
+			item[column] = beetsValueString(values[i])
+		}
+		items = append(items, item)
+		itemMap[item["id"]] = item
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// flexible attributes (play_count, rating, ... set by plugins)
+	attrRows, err := db.Query("SELECT entity_id, key, value FROM item_attributes")
+	if err != nil {
+		logrus.Debugf("beets: no flexible attributes: %s", err)
+		return items, nil
+	}
+	defer attrRows.Close()
+	for attrRows.Next() {
+		var entityId, key, value interface{}
+		if err := attrRows.Scan(&entityId, &key, &value); err != nil {
+			return nil, err
+		}
+		if item, ok := itemMap[beetsValueString(entityId)]; ok {
+			item[beetsValueString(key)] = beetsValueString(value)
+		}
+	}
+	return items, attrRows.Err()
+}
+
+func LoadBeetsSource(dbPath string, queries map[string]string) (*BeetsSource, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	// escaped, "?" and "#" in the path must not end up in the query
+	dsn := url.URL{Scheme: "file", Path: absPath, RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	items, err := loadBeetsItems(db)
+	if err != nil {
+		return nil, err
+	}
+	source := &BeetsSource{
+		Library: &Library{
+			Tracks: make(map[string]Track),
+		},
+		items:   items,
+		queries: queries,
+	}
+	names := make([]string, 0, len(queries))
+	for name := range queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		playlist, err := source.evaluatePlaylist(name, queries[name])
+		if err != nil {
+			return nil, fmt.Errorf("beets query '%s': %s", name, err)
+		}
+		source.Playlists = append(source.Playlists, *playlist)
+	}
+	source.buildIndex()
+	return source, nil
+}
+
+// Evaluates unknown playlist names as beets query
+func (s *BeetsSource) FindPlaylist(name string) (*Playlist, bool) {
+	if playlist, ok := s.Library.FindPlaylist(name); ok {
+		return playlist, true
+	}
+	playlist, err := s.evaluatePlaylist(name, name)
+	if err != nil {
+		logrus.Warnf("Invalid beets query '%s': %s", name, err)
+		return nil, false
+	}
+	s.PlaylistMap[name] = *playlist
+	return playlist, true
+}
+
+// Every item of the library, not only those matched by queries
+func (s *BeetsSource) AllTracks() ([]Track, error) {
+	playlist, err := s.evaluatePlaylist("", "")
+	if err != nil {
+		return nil, err
+	}
+	return playlist.Tracks(s.Library), nil
+}
+
+func (s *BeetsSource) evaluatePlaylist(name, queryString string) (*Playlist, error) {
+	query, err := parseBeetsQuery(queryString)
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]beetsItem, 0)
+	for _, item := range s.items {
+		if query.match(item) {
+			matched = append(matched, item)
+		}
+	}
+	query.sortItems(matched)
+	playlist := &Playlist{
+		Name:                 name,
+		PlaylistPersistentId: derivePersistentId("beets:" + queryString),
+		Visible:              true,
+	}
+	for _, item := range matched {
+		trackId, err := strconv.Atoi(item["id"])
+		if err != nil {
+			continue
+		}
+		key := strconv.Itoa(trackId)
+		if _, ok := s.Tracks[key]; !ok {
+			track := item.toTrack(trackId)
+			s.Tracks[key] = track
+			if s.persistentMap != nil {
+				s.persistentMap[track.PersistentId] = &track
+			}
+		}
+		playlist.PlaylistItems = append(playlist.PlaylistItems, PlaylistItem{TrackId: trackId})
+	}
+	return playlist, nil
+}
+
+func (item beetsItem) Float(field string) float64 {
+	value, err := strconv.ParseFloat(item[field], 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+func unixFloatToTime(value float64) time.Time {
+	sec, frac := math.Modf(value)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+func (item beetsItem) toTrack(trackId int) Track {
+	filePath := item["path"]
+	track := Track{
+		TrackId:      trackId,
+		Name:         item["title"],
+		Artist:       item["artist"],
+		AlbumArtist:  item["albumartist"],
+		Composer:     item["composer"],
+		Album:        item["album"],
+		Genre:        item["genre"],
+		Kind:         strings.TrimSpace(item["format"] + " audio file"),
+		TotalTime:    int(item.Float("length") * 1000),
+		TrackNumber:  int(item.Float("track")),
+		DiscNumber:   int(item.Float("disc")),
+		Year:         int(item.Float("year")),
+		DateModified: unixFloatToTime(item.Float("mtime")),
+		DateAdded:    unixFloatToTime(item.Float("added")),
+		BitRate:      int(item.Float("bitrate") / 1000),
+		SampleRate:   int(item.Float("samplerate")),
+		PlayCount:    int(item.Float("play_count")),
+		SkipCount:    int(item.Float("skip_count")),
+		Rating:       int(item.Float("rating") * 100), // mpdstats rating is 0.0-1.0
+		PersistentId: derivePersistentId("beets:" + item["id"]),
+		TrackType:    "File",
+		Location:     fileLocation(filePath),
+	}
+	if lastPlayed := item.Float("last_played"); lastPlayed > 0 {
+		track.PlayDateUTC = unixFloatToTime(lastPlayed)
+	}
+	if stat, err := os.Stat(filePath); err == nil {
+		track.Size = int(stat.Size())
+	}
+	return track
+}
+
+// ---------------- beets query ----------------
+
+type beetsTerm struct {
+	field   string // empty: any of beetsDefaultFields
+	negate  bool
+	matcher func(value string) bool
+}
+
+type beetsSort struct {
+	field     string
+	ascending bool
+}
+
+// Terms are AND-ed, and "," separates OR-ed groups
+type beetsQuery struct {
+	groups [][]beetsTerm
+	sorts  []beetsSort
+}
+
+// Splits query string like a shell does (quotes are honoured)
+func splitBeetsQuery(query string) ([]string, error) {
+	tokens := make([]string, 0)
+	var current []rune
+	var quote rune
+	inToken := false
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current = append(current, r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inToken = true
+		case unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, string(current))
+				current = current[:0]
+				inToken = false
+			}
+		default:
+			current = append(current, r)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote in %s", query)
+	}
+	if inToken {
+		tokens = append(tokens, string(current))
+	}
+	return tokens, nil
+}
+
+var beetsSortPattern = regexp.MustCompile(`^([a-z_]+)([+-])$`)
+
+func parseBeetsQuery(query string) (*beetsQuery, error) {
+	tokens, err := splitBeetsQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	ret := &beetsQuery{groups: [][]beetsTerm{{}}}
+	for _, token := range tokens {
+		if token == "," {
+			ret.groups = append(ret.groups, []beetsTerm{})
+			continue
+		}
+		if m := beetsSortPattern.FindStringSubmatch(token); m != nil {
+			ret.sorts = append(ret.sorts, beetsSort{field: m[1], ascending: m[2] == "+"})
+			continue
+		}
+		term, err := parseBeetsTerm(token)
+		if err != nil {
+			return nil, err
+		}
+		last := len(ret.groups) - 1
+		ret.groups[last] = append(ret.groups[last], term)
+	}
+	if len(ret.sorts) == 0 {
+		ret.sorts = beetsDefaultSort
+	}
+	return ret, nil
+}
+
+func parseBeetsTerm(token string) (beetsTerm, error) {
+	term := beetsTerm{}
+	if strings.HasPrefix(token, "^") || (strings.HasPrefix(token, "-") && len(token) > 1) {
+		term.negate = true
+		token = token[1:]
+	}
+	pattern := token
+	if kv := strings.SplitN(token, ":", 2); len(kv) == 2 && isBeetsFieldName(kv[0]) {
+		term.field, pattern = kv[0], kv[1]
+	}
+	switch {
+	case strings.HasPrefix(pattern, ":"):
+		re, err := regexp.Compile(pattern[1:])
+		if err != nil {
+			return term, err
+		}
+		term.matcher = re.MatchString
+	case strings.HasPrefix(pattern, "="):
+		exact := pattern[1:]
+		term.matcher = func(value string) bool { return value == exact }
+	case strings.HasPrefix(pattern, "~"):
+		exact := strings.ToLower(pattern[1:])
+		term.matcher = func(value string) bool { return strings.ToLower(value) == exact }
+	case strings.Contains(pattern, "..") && term.field != "":
+		matcher, err := beetsRangeMatcher(term.field, pattern)
+		if err != nil {
+			return term, err
+		}
+		term.matcher = matcher
+	default:
+		lower := strings.ToLower(pattern)
+		numeric, numErr := strconv.ParseFloat(pattern, 64)
+		term.matcher = func(value string) bool {
+			if numErr == nil {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					return v == numeric
+				}
+			}
+			return strings.Contains(strings.ToLower(value), lower)
+		}
+	}
+	return term, nil
+}
+
+func isBeetsFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || unicode.IsLower(r) || unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// "1960..1969", "..2000", "2016-01..", "-1w.."
+func beetsRangeMatcher(field, pattern string) (func(string) bool, error) {
+	bounds := strings.SplitN(pattern, "..", 2)
+	if beetsDateFields[field] {
+		var start, end time.Time
+		var err error
+		if bounds[0] != "" {
+			if start, _, err = parseBeetsDate(bounds[0]); err != nil {
+				return nil, err
+			}
+		}
+		if bounds[1] != "" {
+			var precision time.Duration
+			if end, precision, err = parseBeetsDate(bounds[1]); err != nil {
+				return nil, err
+			}
+			end = end.Add(precision)
+		}
+		return func(value string) bool {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return false
+			}
+			t := unixFloatToTime(v)
+			return (start.IsZero() || !t.Before(start)) && (end.IsZero() || t.Before(end))
+		}, nil
+	}
+	low, high := math.Inf(-1), math.Inf(1)
+	var err error
+	if bounds[0] != "" {
+		if low, err = strconv.ParseFloat(bounds[0], 64); err != nil {
+			return nil, err
+		}
+	}
+	if bounds[1] != "" {
+		if high, err = strconv.ParseFloat(bounds[1], 64); err != nil {
+			return nil, err
+		}
+	}
+	return func(value string) bool {
+		v, err := strconv.ParseFloat(value, 64)
+		return err == nil && low <= v && v <= high
+	}, nil
+}
+
+var beetsRelativeDatePattern = regexp.MustCompile(`^([+-]?)(\d+)([dwmy])$`)
+
+// Returns time and the length of the period it denotes, e.g. "2016-01" is a month
+func parseBeetsDate(value string) (time.Time, time.Duration, error) {
+	if m := beetsRelativeDatePattern.FindStringSubmatch(value); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		if m[1] != "+" {
+			n = -n
+		}
+		now := time.Now()
+		switch m[3] {
+		case "d":
+			return now.AddDate(0, 0, n), 0, nil
+		case "w":
+			return now.AddDate(0, 0, 7*n), 0, nil
+		case "m":
+			return now.AddDate(0, n, 0), 0, nil
+		default:
+			return now.AddDate(n, 0, 0), 0, nil
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", "2006-01", "2006"} {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		switch layout {
+		case "2006":
+			return t, t.AddDate(1, 0, 0).Sub(t), nil
+		case "2006-01":
+			return t, t.AddDate(0, 1, 0).Sub(t), nil
+		case "2006-01-02":
+			return t, t.AddDate(0, 0, 1).Sub(t), nil
+		default:
+			return t, time.Minute, nil
+		}
+	}
+	return time.Time{}, 0, fmt.Errorf("Invalid date: %s", value)
+}
+
+func (t *beetsTerm) match(item beetsItem) bool {
+	var matched bool
+	if t.field == "" {
+		for _, field := range beetsDefaultFields {
+			if t.matcher(item[field]) {
+				matched = true
+				break
+			}
+		}
+	} else {
+		matched = t.matcher(item[t.field])
+	}
+	return matched != t.negate
+}
+
+func (q *beetsQuery) match(item beetsItem) bool {
+	for _, group := range q.groups {
+		matched := true
+		for i := range group {
+			if !group[i].match(item) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *beetsQuery) sortItems(items []beetsItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, s := range q.sorts {
+			a, b := items[i][s.field], items[j][s.field]
+			if !s.ascending {
+				a, b = b, a
+			}
+			numA, errA := strconv.ParseFloat(a, 64)
+			numB, errB := strconv.ParseFloat(b, 64)
+			if errA == nil && errB == nil {
+				if numA != numB {
+					return numA < numB
+				}
+				continue
+			}
+			if lowerA, lowerB := strings.ToLower(a), strings.ToLower(b); lowerA != lowerB {
+				return lowerA < lowerB
+			}
+		}
+		return false
+	})
+}
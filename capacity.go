@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"sort"
+)
+
+// When the plan doesn't fit on the device, tracks are left off until it
+// does, instead of aborting the sync:
+//
+//	capacity:
+//	  reserve: 1GB          # keep free on the device
+//	  priorities:           # higher is kept longer (default 0)
+//	    Favorites: 10
+//	  drop: priority        # or "rating": lowest rated tracks first
+//
+// With "priority", tracks at the end of the lowest priority playlist go
+// first, and among playlists of the same priority the ones listed later.
+// Left off tracks are deleted from the device if they were synced before.
+// New files are all written before deletes free space, so only tracks
+// still to be written are left off to fit; tracks removed from playlists
+// make room for the next sync.
+
+// Re-planning stops after this, estimates of transcoded sizes may be off
+const MAX_FIT_ATTEMPTS = 5
+
+type CapacityConfig struct {
+	Reserve string `yaml:"reserve"`
+	// Playlist names, paths or persistent IDs -> priority
+	Priorities map[string]int `yaml:"priorities"`
+	// priority(default) or rating
+	Drop string `yaml:"drop"`
+}
+
+// A track which may be left off, in its most important playlist
+type fitCandidate struct {
+	track         Track
+	playlist      *Playlist
+	priority      int
+	playlistIndex int
+	position      int
+}
+
+// Re-plans without low priority tracks while the plan doesn't fit
+func (c *SyncContext) fitCapacity(plan *syncPlan, playlists []*Playlist, folderPaths [][]string, claimed map[string]bool) (*syncPlan, error) {
+	stat, err := DiskUsage(c.sink.Path)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*fitCandidate
+	for attempt := 0; attempt < MAX_FIT_ATTEMPTS; attempt++ {
+		over := plan.engine.PeakUsage() + c.options.Reserve - int64(stat.Free)
+		if over <= 0 {
+			break
+		}
+		if candidates == nil {
+			candidates, err = c.fitCandidates(playlists)
+			if err != nil {
+				return nil, err
+			}
+		}
+		writes := plan.trackWrites()
+		if c.options.leftOff == nil {
+			c.options.leftOff = make(map[string]bool)
+		}
+		added := 0
+		var freed int64
+		for _, candidate := range candidates {
+			if freed >= over {
+				break
+			}
+			id := candidate.track.PersistentId
+			if c.options.leftOff[id] || writes[id] == 0 {
+				continue
+			}
+			c.options.leftOff[id] = true
+			freed += writes[id]
+			added += 1
+		}
+		if added == 0 {
+			break
+		}
+		logrus.Infof("%dMB over capacity, re-planning without %d more tracks", over/MiB, added)
+		plan, err = c.plan(playlists, folderPaths, claimed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.reportLeftOff(candidates)
+	return plan, nil
+}
+
+// Tracks of all playlists, in the order they are left off
+func (c *SyncContext) fitCandidates(playlists []*Playlist) ([]*fitCandidate, error) {
+	priorities := make(map[string]int)
+	for ref, priority := range c.options.Priorities {
+		playlist, ok := resolvePlaylist(c.lib, ref)
+		if !ok {
+			return nil, fmt.Errorf("Playlist '%s' in capacity priorities not found in library", ref)
+		}
+		priorities[playlist.PlaylistPersistentId] = priority
+	}
+	byTrack := make(map[string]*fitCandidate)
+	for i, playlist := range playlists {
+		tracks, err := c.lib.PlaylistTracks(playlist)
+		if err != nil {
+			return nil, err
+		}
+		priority := priorities[playlist.PlaylistPersistentId]
+		for position, track := range tracks {
+			candidate := &fitCandidate{
+				track:         track,
+				playlist:      playlist,
+				priority:      priority,
+				playlistIndex: i,
+				position:      position,
+			}
+			// a track shared by playlists stays as long as the most important one wants it
+			if prev, ok := byTrack[track.PersistentId]; ok && !prev.leavesBefore(candidate) {
+				continue
+			}
+			byTrack[track.PersistentId] = candidate
+		}
+	}
+	ret := make([]*fitCandidate, 0, len(byTrack))
+	for _, candidate := range byTrack {
+		ret = append(ret, candidate)
+	}
+	byRating := c.options.DropOrder == "rating"
+	sort.SliceStable(ret, func(i, j int) bool {
+		if byRating && ret[i].track.Rating != ret[j].track.Rating {
+			return ret[i].track.Rating < ret[j].track.Rating
+		}
+		return ret[i].leavesBefore(ret[j])
+	})
+	return ret, nil
+}
+
+// Bytes the actions write for a track, 0 if the file stays as is
+func trackWriteSize(acts []IOAction) int64 {
+	var size int64
+	for _, act := range acts {
+		if act == nil {
+			continue
+		}
+		if delta := act.SizeDelta(); delta > 0 {
+			size += delta
+		}
+	}
+	return size
+}
+
+// Lower priority, later listed playlist, later in the playlist
+func (f *fitCandidate) leavesBefore(other *fitCandidate) bool {
+	if f.priority != other.priority {
+		return f.priority < other.priority
+	}
+	if f.playlistIndex != other.playlistIndex {
+		return f.playlistIndex > other.playlistIndex
+	}
+	return f.position > other.position
+}
+
+func (c *SyncContext) reportLeftOff(candidates []*fitCandidate) {
+	if len(c.options.leftOff) == 0 {
+		return
+	}
+	leftOff := make([]*fitCandidate, 0, len(c.options.leftOff))
+	for _, candidate := range candidates {
+		if c.options.leftOff[candidate.track.PersistentId] {
+			leftOff = append(leftOff, candidate)
+		}
+	}
+	sort.SliceStable(leftOff, func(i, j int) bool {
+		if leftOff[i].playlistIndex != leftOff[j].playlistIndex {
+			return leftOff[i].playlistIndex < leftOff[j].playlistIndex
+		}
+		return leftOff[i].position < leftOff[j].position
+	})
+	fmt.Printf("Not enough space, left off %d tracks:\n", len(leftOff))
+	for _, candidate := range leftOff {
+		title := candidate.track.Name
+		if candidate.track.Artist != "" {
+			title = candidate.track.Artist + " - " + title
+		}
+		fmt.Printf("  %s: %s\n", candidate.playlist.Name, title)
+	}
+}
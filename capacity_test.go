@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Deletes free space only after every copy is written
+func TestCheckPeakUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-capacity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := make([]byte, MiB)
+	engine := NewIOEngine()
+	for _, name := range []string{"a", "b"} {
+		ioutil.WriteFile(path.Join(dir, "old-"+name), data, 0644)
+		ioutil.WriteFile(path.Join(dir, "src-"+name), data, 0644)
+		engine.Push(NewDelete(path.Join(dir, "old-"+name)))
+		track := &Track{Name: name, PersistentId: name, Location: fileLocation(path.Join(dir, "src-"+name))}
+		engine.Push(NewCopy(track.LocalPath(), path.Join(dir, "new-"+name), track))
+	}
+	if engine.WillConsume() != 0 || engine.PeakUsage() != 2*MiB {
+		t.Fatalf("consume %d, peak %d", engine.WillConsume(), engine.PeakUsage())
+	}
+	stat, err := DiskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for one copy only
+	if ok, err := engine.Check(dir, int64(stat.Free)-MiB-MiB/2); ok || err == nil {
+		t.Fatal("fits with half the room")
+	}
+	if ok, err := engine.Check(dir, int64(stat.Free)-4*MiB); !ok || err != nil {
+		t.Fatalf("does not fit: %v", err)
+	}
+}
+
+// A playlist replaced by new tracks needs room for them before the old ones go
+func TestFitCapacityDeleteHeavy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-capacity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sinkPath := path.Join(dir, "sink")
+	os.MkdirAll(sinkPath, 0755)
+	library := &Library{
+		Tracks:    make(map[string]Track),
+		Playlists: []Playlist{{Name: "Mix", PlaylistPersistentId: "P1", PlaylistItems: []PlaylistItem{{TrackId: 1}, {TrackId: 2}}}},
+	}
+	for i, name := range []string{"A", "B", "C", "D"} {
+		src := path.Join(dir, name+".mp3")
+		ioutil.WriteFile(src, make([]byte, MiB), 0644)
+		library.Tracks[string('1'+rune(i))] = Track{TrackId: i + 1, Name: name, PersistentId: "T" + name, Location: fileLocation(src), DateModified: time.Unix(100, 0)}
+	}
+	library.buildIndex()
+	if err := startSync(library, sinkPath, &SyncOptions{Playlists: []string{"Mix"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	library.Playlists[0].PlaylistItems = []PlaylistItem{{TrackId: 3}, {TrackId: 4}}
+	library.buildIndex()
+	stat, err := DiskUsage(sinkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deleting A and B would make room for both, but only after C and D are written
+	options := &SyncOptions{Playlists: []string{"Mix"}, Reserve: int64(stat.Free) - MiB - MiB/2}
+	if err := startSync(library, sinkPath, options); err != nil {
+		t.Fatal(err)
+	}
+	if !isFileExists(path.Join(sinkPath, "Mix/1 C.mp3")) || isFileExists(path.Join(sinkPath, "Mix/2 D.mp3")) {
+		t.Fatal("D not left off")
+	}
+	if isFileExists(path.Join(sinkPath, "Mix/1 A.mp3")) || isFileExists(path.Join(sinkPath, "Mix/2 B.mp3")) {
+		t.Fatal("removed tracks not deleted")
+	}
+}
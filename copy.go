@@ -0,0 +1,120 @@
+package main
+
+import (
+	"hash"
+	"io"
+	"os"
+)
+
+// Copies files with the source read ahead of the device: a reader fills
+// chunks while the writer is busy with earlier ones. On Linux the kernel
+// copies (copy_file_range or sendfile) if the filesystems allow.
+
+const COPY_CHUNK_SIZE = 1 * MiB
+
+// Chunks read ahead of the writer
+const COPY_READ_AHEAD = 8
+
+// Copies src to dst (created or truncated) and syncs it, reporting copied
+// bytes to progress. Written data is fed to hasher if given.
+func copyFileWithProgress(src, dst string, progress func(int64), hasher hash.Hash) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	copied, err := kernelCopy(out, in, progress)
+	if err != nil {
+		return
+	}
+	if copied && hasher != nil {
+		// read back what the kernel wrote, from the page cache
+		if _, err = out.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.Copy(hasher, out); err != nil {
+			return
+		}
+	} else if !copied {
+		var w io.Writer = out
+		if hasher != nil {
+			w = io.MultiWriter(out, hasher)
+		}
+		if _, err = pipelinedCopy(w, in, progress); err != nil {
+			return
+		}
+	}
+	err = out.Sync()
+	return
+}
+
+// io.Copy with reads running ahead of writes
+func pipelinedCopy(dst io.Writer, src io.Reader, progress func(int64)) (int64, error) {
+	chunks := make(chan []byte, COPY_READ_AHEAD)
+	// buffers given back by the writer
+	free := make(chan []byte, COPY_READ_AHEAD+2)
+	done := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			default:
+				buf = make([]byte, COPY_CHUNK_SIZE)
+			}
+			n, err := io.ReadFull(src, buf)
+			if n > 0 {
+				select {
+				case chunks <- buf[:n]:
+				case <-done:
+					readErr <- nil
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				readErr <- nil
+				return
+			} else if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	var written int64
+	var writeErr error
+	for chunk := range chunks {
+		if writeErr != nil {
+			continue // draining until the reader stops
+		}
+		n, err := dst.Write(chunk)
+		written += int64(n)
+		if progress != nil {
+			progress(int64(n))
+		}
+		if err != nil {
+			writeErr = err
+			close(done)
+			continue
+		}
+		select {
+		case free <- chunk[:cap(chunk)]:
+		default:
+		}
+	}
+	if err := <-readErr; err != nil {
+		return written, err
+	}
+	return written, writeErr
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// No copy_file_range on darwin, copies in user space
+func kernelCopy(dst, src *os.File, progress func(int64)) (bool, error) {
+	return false, nil
+}
+
+// Makes reads of f come from the device, not from the buffer cache
+func dropFileCache(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_NOCACHE, 1)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
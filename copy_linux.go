@@ -0,0 +1,55 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Copies in the kernel with copy_file_range, or sendfile. false if neither
+// works between these files (older kernels, copies across filesystems),
+// and nothing was copied.
+func kernelCopy(dst, src *os.File, progress func(int64)) (bool, error) {
+	for _, copyChunk := range []func() (int, error){
+		func() (int, error) {
+			return unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, COPY_CHUNK_SIZE, 0)
+		},
+		func() (int, error) {
+			return unix.Sendfile(int(dst.Fd()), int(src.Fd()), nil, COPY_CHUNK_SIZE)
+		},
+	} {
+		var copied int64
+		for {
+			n, err := copyChunk()
+			if err != nil {
+				if copied == 0 && isKernelCopyUnsupported(err) {
+					break // try next
+				}
+				return true, err
+			}
+			if n == 0 {
+				return true, nil
+			}
+			copied += int64(n)
+			if progress != nil {
+				progress(int64(n))
+			}
+		}
+	}
+	return false, nil
+}
+
+func isKernelCopyUnsupported(err error) bool {
+	switch err {
+	case unix.EXDEV, unix.ENOSYS, unix.EINVAL, unix.EOPNOTSUPP, unix.EPERM, unix.EBADF:
+		return true
+	}
+	return false
+}
+
+// Makes reads of f come from the device, not from the page cache
+func dropFileCache(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Builds Library by walking a music directory and reading tags of each file.
+// Each top-level folder (group_by: folder) or each album (group_by: album)
+// becomes a playlist.
+
+const SCAN_CACHE_VERSION = 1
+
+var audioFileKinds = map[string]string{
+	".mp3":  "MPEG audio file",
+	".m4a":  "AAC audio file",
+	".mp4":  "AAC audio file",
+	".aac":  "AAC audio file",
+	".flac": "FLAC audio file",
+	".ogg":  "Ogg Vorbis audio file",
+	".oga":  "Ogg Vorbis audio file",
+	".opus": "Opus audio file",
+	".wav":  "WAV audio file",
+	".aif":  "AIFF audio file",
+	".aiff": "AIFF audio file",
+}
+
+// Kinds decided by tags rather than extension
+var audioFormatKinds = map[string]string{
+	"alac": "Apple Lossless audio file",
+	"opus": "Opus audio file",
+}
+
+type scanCache struct {
+	Version int                        `json:"version"`
+	Root    string                     `json:"root"`
+	Entries map[string]*scanCacheEntry `json:"entries"`
+}
+
+// Cached scan result, valid while Size and ModTime stay the same
+type scanCacheEntry struct {
+	Size    int64      `json:"size"`
+	ModTime time.Time  `json:"mtime"`
+	Added   time.Time  `json:"added"`
+	Tags    *AudioTags `json:"tags,omitempty"`
+}
+
+type scannedFile struct {
+	relPath string
+	entry   *scanCacheEntry
+}
+
+func defaultCacheDir() string {
+	cacheDir := os.Getenv("XDG_CACHE_HOME")
+	if cacheDir == "" {
+		cacheDir = path.Join(os.Getenv("HOME"), ".cache")
+	}
+	return path.Join(cacheDir, "iwalk")
+}
+
+func loadScanCache(cachePath, root string) *scanCache {
+	cache := &scanCache{
+		Version: SCAN_CACHE_VERSION,
+		Root:    root,
+		Entries: make(map[string]*scanCacheEntry),
+	}
+	data, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return cache
+	}
+	var loaded scanCache
+	if err := json.Unmarshal(data, &loaded); err != nil || loaded.Version != SCAN_CACHE_VERSION || loaded.Root != root {
+		logrus.Infof("Discarding scan cache: %s", cachePath)
+		return cache
+	}
+	if loaded.Entries != nil {
+		cache.Entries = loaded.Entries
+	}
+	return cache
+}
+
+func (c *scanCache) save(cachePath string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+	tempPath := cachePath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, cachePath)
+}
+
+func ScanDirectoryLibrary(root, groupBy, cacheDir string) (*Library, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if groupBy == "" {
+		groupBy = "folder"
+	}
+	if groupBy != "folder" && groupBy != "album" {
+		return nil, fmt.Errorf("Unknown group_by: %s (folder or album)", groupBy)
+	}
+	if cacheDir == "" {
+		cacheDir = defaultCacheDir()
+	}
+	cachePath := path.Join(cacheDir, fmt.Sprintf("scan-%s.json", derivePersistentId(root)))
+	cache := loadScanCache(cachePath, root)
+	seen := make(map[string]bool)
+	files := make([]scannedFile, 0)
+	readCount := 0
+	err = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			logrus.Warnf("Cannot access %s: %s", filePath, err)
+			return nil
+		}
+		if info.IsDir() {
+			if filePath != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := audioFileKinds[strings.ToLower(filepath.Ext(filePath))]; !ok {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		seen[relPath] = true
+		entry, ok := cache.Entries[relPath]
+		if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+			added := time.Now()
+			if ok {
+				added = entry.Added
+			}
+			entry = &scanCacheEntry{
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				Added:   added,
+			}
+			tags, err := ReadAudioTags(filePath)
+			if err != nil {
+				logrus.Debugf("No tags: %s (%s)", relPath, err)
+			} else {
+				entry.Tags = tags
+			}
+			cache.Entries[relPath] = entry
+			readCount += 1
+		}
+		files = append(files, scannedFile{relPath: relPath, entry: entry})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	removed := 0
+	for relPath := range cache.Entries {
+		if !seen[relPath] {
+			delete(cache.Entries, relPath)
+			removed += 1
+		}
+	}
+	logrus.Infof("Scanned %s: %d files (%d read, %d from cache)", root, len(files), readCount, len(files)-readCount)
+	if readCount > 0 || removed > 0 {
+		if err := cache.save(cachePath); err != nil {
+			logrus.Warnf("Failed to save scan cache %s: %s", cachePath, err)
+		}
+	}
+	return buildDirectoryLibrary(root, groupBy, files), nil
+}
+
+func (f *scannedFile) toTrack(root string, trackId int) Track {
+	absPath := filepath.Join(root, f.relPath)
+	ext := strings.ToLower(filepath.Ext(f.relPath))
+	track := Track{
+		TrackId:      trackId,
+		Name:         strings.TrimSuffix(filepath.Base(f.relPath), filepath.Ext(f.relPath)),
+		Kind:         audioFileKinds[ext],
+		Size:         int(f.entry.Size),
+		DateModified: f.entry.ModTime,
+		DateAdded:    f.entry.Added,
+		PersistentId: derivePersistentId(absPath),
+		TrackType:    "File",
+		Location:     fileLocation(absPath),
+	}
+	if tags := f.entry.Tags; tags != nil {
+		if tags.Title != "" {
+			track.Name = tags.Title
+		}
+		if kind, ok := audioFormatKinds[tags.Format]; ok {
+			track.Kind = kind
+		}
+		track.Artist = tags.Artist
+		track.AlbumArtist = tags.AlbumArtist
+		track.Album = tags.Album
+		track.Composer = tags.Composer
+		track.Genre = tags.Genre
+		track.TrackNumber = tags.TrackNumber
+		track.DiscNumber = tags.DiscNumber
+		track.Year = tags.Year
+		track.TotalTime = tags.Duration
+		track.SampleRate = tags.SampleRate
+		if tags.Duration > 0 {
+			track.BitRate = int(f.entry.Size * 8 / int64(tags.Duration)) // kbps
+		}
+	}
+	return track
+}
+
+func buildDirectoryLibrary(root, groupBy string, files []scannedFile) *Library {
+	library := &Library{
+		MusicFolder: fileLocation(root),
+		Tracks:      make(map[string]Track),
+	}
+	groups := make(map[string][]Track)
+	groupNames := make([]string, 0)
+	for i, file := range files {
+		track := file.toTrack(root, i+1)
+		library.Tracks[strconv.Itoa(track.TrackId)] = track
+		var group string
+		if groupBy == "album" {
+			group = albumPlaylistName(&track, file.relPath)
+			if group == "" {
+				logrus.Debugf("No album tag and not in any folder: %s", file.relPath)
+				continue
+			}
+		} else {
+			parts := strings.SplitN(filepath.ToSlash(file.relPath), "/", 2)
+			if len(parts) < 2 {
+				logrus.Debugf("Not in any folder: %s", file.relPath)
+				continue
+			}
+			group = parts[0]
+		}
+		if _, ok := groups[group]; !ok {
+			groupNames = append(groupNames, group)
+		}
+		groups[group] = append(groups[group], track)
+	}
+	sort.Strings(groupNames)
+	for _, name := range groupNames {
+		tracks := groups[name]
+		sort.SliceStable(tracks, func(i, j int) bool {
+			a, b := &tracks[i], &tracks[j]
+			if dirA, dirB := path.Dir(a.Location), path.Dir(b.Location); dirA != dirB {
+				return dirA < dirB
+			}
+			if a.DiscNumber != b.DiscNumber {
+				return a.DiscNumber < b.DiscNumber
+			}
+			if a.TrackNumber != b.TrackNumber {
+				return a.TrackNumber < b.TrackNumber
+			}
+			return a.Location < b.Location
+		})
+		playlist := Playlist{
+			Name:                 name,
+			PlaylistPersistentId: derivePersistentId("playlist:" + groupBy + ":" + name),
+			Visible:              true,
+		}
+		for _, track := range tracks {
+			playlist.PlaylistItems = append(playlist.PlaylistItems, PlaylistItem{TrackId: track.TrackId})
+		}
+		library.Playlists = append(library.Playlists, playlist)
+	}
+	library.buildIndex()
+	return library
+}
+
+// "Album Artist - Album", falls back to the directory name for untagged
+// files, "" for untagged files at the root
+func albumPlaylistName(track *Track, relPath string) string {
+	if track.Album == "" {
+		if dir := filepath.Dir(relPath); dir != "." {
+			return filepath.ToSlash(dir)
+		}
+		return ""
+	}
+	artist := track.AlbumArtist
+	if artist == "" {
+		artist = track.Artist
+	}
+	if artist == "" {
+		return track.Album
+	}
+	return fmt.Sprintf("%s - %s", artist, track.Album)
+}
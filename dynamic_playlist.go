@@ -0,0 +1,680 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Playlists defined in config by a query over Track fields, evaluated
+// against every track of the source (not available for subsonic):
+//
+//	dynamic_playlists:
+//	  - name: Fresh favorites
+//	    query: 'Rating >= 80 and Genre in [Jazz, "Bossa Nova"] and DateAdded within 30d'
+//	    sort: -Rating, DateAdded
+//	    limit: 2h
+//
+// Field names are those of Track (case-insensitive). Operators are
+// = != < <= > >= ~ (contains), in [...] and within <duration>, combined
+// with and, or, not and parentheses. Rating is 0-100 like iTunes.
+// limit is a track count ("100"), a duration ("90m", "2h") or a size ("2GB").
+
+type DynamicPlaylistConfig struct {
+	Name  string `yaml:"name"`
+	Query string `yaml:"query"`
+	Sort  string `yaml:"sort"`
+	Limit string `yaml:"limit"`
+}
+
+type DynamicPlaylistSource struct {
+	LibrarySource
+	playlists []Playlist
+	defs      map[string]*dynamicPlaylist
+}
+
+type dynamicPlaylist struct {
+	query trackQuery
+	sorts []trackSort
+	limit trackLimit
+}
+
+// Sources which can enumerate every track cheaply, not only ones in
+// playlists. Dynamic playlists need one.
+type allTrackLister interface {
+	AllTracks() ([]Track, error)
+}
+
+// Libraries hold every track once loaded. For playlist files these are the
+// tracks of all files in the directory.
+func (library *Library) AllTracks() ([]Track, error) {
+	tracks := make([]Track, 0, len(library.Tracks))
+	for _, track := range library.Tracks {
+		tracks = append(tracks, track)
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].TrackId < tracks[j].TrackId
+	})
+	return tracks, nil
+}
+
+func NewDynamicPlaylistSource(source LibrarySource, configs []DynamicPlaylistConfig) (*DynamicPlaylistSource, error) {
+	if _, ok := source.(allTrackLister); !ok && len(configs) > 0 {
+		// a union of playlists would resolve (and download) all of them
+		return nil, errors.New("Dynamic playlists are not supported by this source, it cannot list all tracks")
+	}
+	s := &DynamicPlaylistSource{
+		LibrarySource: source,
+		defs:          make(map[string]*dynamicPlaylist, len(configs)),
+	}
+	for _, conf := range configs {
+		if conf.Name == "" {
+			return nil, fmt.Errorf("Dynamic playlist without name (query: %s)", conf.Query)
+		}
+		if _, ok := s.defs[conf.Name]; ok {
+			return nil, fmt.Errorf("Dynamic playlist %s defined twice", conf.Name)
+		}
+		def := &dynamicPlaylist{}
+		var err error
+		if def.query, err = parseTrackQuery(conf.Query); err != nil {
+			return nil, fmt.Errorf("Dynamic playlist %s: %s", conf.Name, err)
+		}
+		if def.sorts, err = parseTrackSorts(conf.Sort); err != nil {
+			return nil, fmt.Errorf("Dynamic playlist %s: %s", conf.Name, err)
+		}
+		if def.limit, err = parseTrackLimit(conf.Limit); err != nil {
+			return nil, fmt.Errorf("Dynamic playlist %s: %s", conf.Name, err)
+		}
+		s.defs[conf.Name] = def
+		s.playlists = append(s.playlists, Playlist{
+			Name:                 conf.Name,
+			PlaylistPersistentId: derivePersistentId("dynamic:" + conf.Name),
+			Visible:              true,
+		})
+	}
+	return s, nil
+}
+
+// Names of the dynamic playlists, in config order
+func (s *DynamicPlaylistSource) Names() []string {
+	names := make([]string, 0, len(s.playlists))
+	for _, playlist := range s.playlists {
+		names = append(names, playlist.Name)
+	}
+	return names
+}
+
+func (s *DynamicPlaylistSource) ListPlaylists() []*Playlist {
+	ret := s.LibrarySource.ListPlaylists()
+	for i := range s.playlists {
+		ret = append(ret, &s.playlists[i])
+	}
+	return ret
+}
+
+func (s *DynamicPlaylistSource) FindPlaylist(name string) (*Playlist, bool) {
+	for i := range s.playlists {
+		if s.playlists[i].Name == name {
+			return &s.playlists[i], true
+		}
+	}
+	return s.LibrarySource.FindPlaylist(name)
+}
+
+func (s *DynamicPlaylistSource) PlaylistTracks(playlist *Playlist) ([]Track, error) {
+	def, ok := s.defs[playlist.Name]
+	if !ok || playlist.PlaylistPersistentId != derivePersistentId("dynamic:"+playlist.Name) {
+		return s.LibrarySource.PlaylistTracks(playlist)
+	}
+	all, err := s.LibrarySource.(allTrackLister).AllTracks()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	matched := make([]Track, 0)
+	for _, track := range all {
+		if def.query == nil || def.query.match(&track, now) {
+			matched = append(matched, track)
+		}
+	}
+	sortTracks(matched, def.sorts, playlist.PlaylistPersistentId)
+	return def.limit.apply(matched), nil
+}
+
+// ---------------- query ----------------
+
+type trackQuery interface {
+	match(track *Track, now time.Time) bool
+}
+
+type queryAnd []trackQuery
+type queryOr []trackQuery
+type queryNot struct{ inner trackQuery }
+
+type queryCond struct {
+	field  int // index in Track
+	op     string
+	values []string
+	// parsed forms of values, by field kind
+	numbers []float64
+	date    time.Time
+	within  time.Duration
+}
+
+func (q queryAnd) match(track *Track, now time.Time) bool {
+	for _, sub := range q {
+		if !sub.match(track, now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q queryOr) match(track *Track, now time.Time) bool {
+	for _, sub := range q {
+		if sub.match(track, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q queryNot) match(track *Track, now time.Time) bool {
+	return !q.inner.match(track, now)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Index of Track field, case-insensitive
+func trackFieldIndex(name string) (int, bool) {
+	trackType := reflect.TypeOf(Track{})
+	for i := 0; i < trackType.NumField(); i++ {
+		if strings.EqualFold(trackType.Field(i).Name, name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (c *queryCond) match(track *Track, now time.Time) bool {
+	value := reflect.ValueOf(track).Elem().Field(c.field)
+	switch value.Kind() {
+	case reflect.String:
+		s := strings.ToLower(value.String())
+		switch c.op {
+		case "~":
+			return strings.Contains(s, strings.ToLower(c.values[0]))
+		case "=", "in":
+			for _, v := range c.values {
+				if s == strings.ToLower(v) {
+					return true
+				}
+			}
+			return false
+		case "!=":
+			return s != strings.ToLower(c.values[0])
+		}
+		return compareOrdered(strings.Compare(s, strings.ToLower(c.values[0])), c.op)
+	case reflect.Int:
+		n := float64(value.Int())
+		switch c.op {
+		case "=", "in":
+			for _, v := range c.numbers {
+				if n == v {
+					return true
+				}
+			}
+			return false
+		case "!=":
+			return n != c.numbers[0]
+		}
+		diff := 0
+		if n < c.numbers[0] {
+			diff = -1
+		} else if n > c.numbers[0] {
+			diff = 1
+		}
+		return compareOrdered(diff, c.op)
+	case reflect.Bool:
+		b, _ := strconv.ParseBool(c.values[0])
+		if c.op == "!=" {
+			return value.Bool() != b
+		}
+		return value.Bool() == b
+	case reflect.Struct:
+		t := value.Interface().(time.Time)
+		if c.op == "within" {
+			return !t.IsZero() && t.After(now.Add(-c.within))
+		}
+		diff := 0
+		if t.Before(c.date) {
+			diff = -1
+		} else if t.After(c.date) {
+			diff = 1
+		}
+		return compareOrdered(diff, c.op)
+	}
+	return false
+}
+
+func compareOrdered(diff int, op string) bool {
+	switch op {
+	case "=":
+		return diff == 0
+	case "!=":
+		return diff != 0
+	case "<":
+		return diff < 0
+	case "<=":
+		return diff <= 0
+	case ">":
+		return diff > 0
+	case ">=":
+		return diff >= 0
+	}
+	return false
+}
+
+func tokenizeTrackQuery(query string) ([]string, error) {
+	tokens := make([]string, 0)
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("Unterminated quote in %s", query)
+			}
+			// keep the quote to tell strings from keywords
+			tokens = append(tokens, string(runes[i:end]))
+			i = end + 1
+		case strings.ContainsRune("()[],~", r):
+			tokens = append(tokens, string(r))
+			i++
+		case strings.ContainsRune("=!<>", r):
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, string(runes[i:i+2]))
+				i += 2
+			} else {
+				tokens = append(tokens, string(r))
+				i++
+			}
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()[],~=!<>\"'", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type trackQueryParser struct {
+	tokens []string
+	pos    int
+}
+
+// Empty query matches everything, returns nil
+func parseTrackQuery(query string) (trackQuery, error) {
+	tokens, err := tokenizeTrackQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &trackQueryParser{tokens: tokens}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected '%s' in query", p.tokens[p.pos])
+	}
+	return q, nil
+}
+
+func (p *trackQueryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *trackQueryParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("Unexpected end of query")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *trackQueryParser) parseOr() (trackQuery, error) {
+	terms := queryOr{}
+	for {
+		term, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		if !strings.EqualFold(p.peek(), "or") {
+			break
+		}
+		p.pos++
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *trackQueryParser) parseAnd() (trackQuery, error) {
+	factors := queryAnd{}
+	for {
+		factor, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		factors = append(factors, factor)
+		if !strings.EqualFold(p.peek(), "and") {
+			break
+		}
+		p.pos++
+	}
+	if len(factors) == 1 {
+		return factors[0], nil
+	}
+	return factors, nil
+}
+
+func (p *trackQueryParser) parseFactor() (trackQuery, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(token, "not") {
+		inner, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{inner}, nil
+	}
+	if token == "(" {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing, _ := p.next(); closing != ")" {
+			return nil, fmt.Errorf("Missing ')' in query")
+		}
+		return inner, nil
+	}
+	return p.parseCond(token)
+}
+
+func unquote(token string) string {
+	if len(token) > 0 && (token[0] == '"' || token[0] == '\'') {
+		return token[1:]
+	}
+	return token
+}
+
+func (p *trackQueryParser) parseCond(fieldName string) (trackQuery, error) {
+	index, ok := trackFieldIndex(fieldName)
+	if !ok {
+		return nil, fmt.Errorf("Unknown field: %s", fieldName)
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op = strings.ToLower(op)
+	cond := &queryCond{field: index, op: op}
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=", "~", "within":
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		cond.values = []string{unquote(value)}
+	case "in":
+		if open, _ := p.next(); open != "[" {
+			return nil, fmt.Errorf("'in' needs a list like [a, b]")
+		}
+		for {
+			value, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			if value == "]" {
+				break
+			}
+			if value == "," {
+				continue
+			}
+			cond.values = append(cond.values, unquote(value))
+		}
+		if len(cond.values) == 0 {
+			return nil, fmt.Errorf("Empty list for %s", fieldName)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown operator '%s' for %s", op, fieldName)
+	}
+	field := reflect.TypeOf(Track{}).Field(index)
+	switch {
+	case field.Type.Kind() == reflect.String:
+		if op == "within" {
+			return nil, fmt.Errorf("'within' is for dates, not %s", field.Name)
+		}
+	case field.Type.Kind() == reflect.Int:
+		if op == "~" || op == "within" {
+			return nil, fmt.Errorf("'%s' is not for numbers (%s)", op, field.Name)
+		}
+		for _, v := range cond.values {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s needs a number: %s", field.Name, v)
+			}
+			cond.numbers = append(cond.numbers, n)
+		}
+	case field.Type.Kind() == reflect.Bool:
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("%s can only be compared with = or !=", field.Name)
+		}
+		if _, err := strconv.ParseBool(cond.values[0]); err != nil {
+			return nil, fmt.Errorf("%s needs true or false: %s", field.Name, cond.values[0])
+		}
+	case field.Type == timeType:
+		if op == "within" {
+			if cond.within, err = parseLongDuration(cond.values[0]); err != nil {
+				return nil, err
+			}
+		} else if op == "in" || op == "~" {
+			return nil, fmt.Errorf("'%s' is not for dates (%s)", op, field.Name)
+		} else if cond.date, err = parseQueryDate(cond.values[0]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Field %s cannot be queried", field.Name)
+	}
+	return cond, nil
+}
+
+var longDurationPattern = regexp.MustCompile(`^(\d+)(d|w|y)$`)
+
+// time.ParseDuration, plus days, weeks and years ("30d", "2w", "1y")
+func parseLongDuration(value string) (time.Duration, error) {
+	if m := longDurationPattern.FindStringSubmatch(value); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		day := 24 * time.Hour
+		switch m[2] {
+		case "d":
+			return time.Duration(n) * day, nil
+		case "w":
+			return time.Duration(n) * 7 * day, nil
+		case "y":
+			return time.Duration(n) * 365 * day, nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration: %s", value)
+	}
+	return d, nil
+}
+
+func parseQueryDate(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid date: %s (YYYY-MM-DD)", value)
+}
+
+// ---------------- sort and limit ----------------
+
+type trackSort struct {
+	field      int
+	descending bool
+	random     bool
+}
+
+// "-Rating, DateAdded", or "random"
+func parseTrackSorts(value string) ([]trackSort, error) {
+	sorts := make([]trackSort, 0)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.EqualFold(part, "random") {
+			sorts = append(sorts, trackSort{random: true})
+			continue
+		}
+		s := trackSort{}
+		if strings.HasPrefix(part, "-") {
+			s.descending = true
+			part = part[1:]
+		} else {
+			part = strings.TrimPrefix(part, "+")
+		}
+		index, ok := trackFieldIndex(part)
+		if !ok {
+			return nil, fmt.Errorf("Unknown sort field: %s", part)
+		}
+		s.field = index
+		sorts = append(sorts, s)
+	}
+	return sorts, nil
+}
+
+func compareTrackField(a, b *Track, field int) int {
+	va := reflect.ValueOf(a).Elem().Field(field)
+	vb := reflect.ValueOf(b).Elem().Field(field)
+	switch va.Kind() {
+	case reflect.String:
+		return strings.Compare(strings.ToLower(va.String()), strings.ToLower(vb.String()))
+	case reflect.Int:
+		switch {
+		case va.Int() < vb.Int():
+			return -1
+		case va.Int() > vb.Int():
+			return 1
+		}
+	case reflect.Bool:
+		if va.Bool() != vb.Bool() {
+			if vb.Bool() {
+				return -1
+			}
+			return 1
+		}
+	case reflect.Struct:
+		ta, tb := va.Interface().(time.Time), vb.Interface().(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+	}
+	return 0
+}
+
+func sortTracks(tracks []Track, sorts []trackSort, playlistId string) {
+	for _, s := range sorts {
+		if s.random {
+			// stable, or a limit picks other tracks on every sync
+			stableShuffleTracks(tracks, playlistId)
+			return
+		}
+	}
+	if len(sorts) == 0 {
+		return
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		for _, s := range sorts {
+			diff := compareTrackField(&tracks[i], &tracks[j], s.field)
+			if diff != 0 {
+				return (diff < 0) != s.descending
+			}
+		}
+		return false
+	})
+}
+
+type trackLimit struct {
+	count    int
+	duration time.Duration
+	bytes    int64
+}
+
+// "100" (tracks), "90m" (duration) or "2GB" (size)
+func parseTrackLimit(value string) (trackLimit, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return trackLimit{}, nil
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return trackLimit{count: n}, nil
+	}
+	if bytes, ok := parseSize(value); ok {
+		return trackLimit{bytes: bytes}, nil
+	}
+	d, err := parseLongDuration(value)
+	if err != nil {
+		return trackLimit{}, fmt.Errorf("Invalid limit: %s (count, duration or size)", value)
+	}
+	return trackLimit{duration: d}, nil
+}
+
+// Takes leading tracks until the limit is reached
+func (l trackLimit) apply(tracks []Track) []Track {
+	if l.count > 0 && len(tracks) > l.count {
+		return tracks[:l.count]
+	}
+	var totalTime time.Duration
+	var totalBytes int64
+	for i := range tracks {
+		totalTime += time.Duration(tracks[i].TotalTime) * time.Millisecond
+		totalBytes += int64(tracks[i].Size)
+		if (l.duration > 0 && totalTime > l.duration) || (l.bytes > 0 && totalBytes > l.bytes) {
+			return tracks[:i]
+		}
+	}
+	return tracks
+}
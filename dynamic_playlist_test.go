@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// "random" with a limit keeps picking the same tracks
+func TestDynamicPlaylistRandomStable(t *testing.T) {
+	library := &Library{Tracks: make(map[string]Track)}
+	for i := 1; i <= 20; i++ {
+		library.Tracks[fmt.Sprint(i)] = Track{TrackId: i, Name: fmt.Sprint("Song ", i), PersistentId: fmt.Sprintf("T%02d", i), Location: "file:///Music/song.mp3"}
+	}
+	library.buildIndex()
+	picked := func() string {
+		source, err := NewDynamicPlaylistSource(library, []DynamicPlaylistConfig{{Name: "Pick", Sort: "random", Limit: "5"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		playlist, _ := source.FindPlaylist("Pick")
+		tracks, err := source.PlaylistTracks(playlist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0, len(tracks))
+		for _, track := range tracks {
+			ids = append(ids, track.PersistentId)
+		}
+		return strings.Join(ids, " ")
+	}
+	first := picked()
+	if len(strings.Fields(first)) != 5 {
+		t.Fatalf("picked %s", first)
+	}
+	for i := 0; i < 10; i++ {
+		if again := picked(); again != first {
+			t.Fatalf("picked %s, then %s", first, again)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Naming rules of the filesystem on the device. Walkmans are formatted
+// with FAT32 or exFAT, where names follow the Windows rules:
+//
+//	filesystem: fat32   # fat32, exfat, hfsplus or ext4 (default: detected)
+
+type FilesystemProfile struct {
+	Name string
+	// Replaced with "_", in addition to "/" and NUL
+	IllegalChars string
+	// Control characters (U+0001 - U+001F) are illegal
+	NoControlChars bool
+	// DOS device names (CON, NUL, COM1, ...) are illegal, also with extensions
+	NoReservedNames bool
+	// Trailing dots and spaces are dropped by Windows
+	NoTrailingDots bool
+	// Max length of a name, in UTF-16 units or in bytes
+	MaxNameLength int
+	CountUTF16    bool
+	// Form names are stored in, nil to keep as is. Normalization-insensitive
+	// if set.
+	Normalization *norm.Form
+	// "Song" and "song" are the same file
+	CaseInsensitive bool
+}
+
+var nfc, nfd = norm.NFC, norm.NFD
+
+var windowsIllegalChars = `"*:<>?\|`
+
+var filesystemProfiles = map[string]*FilesystemProfile{
+	"fat32": {
+		Name:            "fat32",
+		IllegalChars:    windowsIllegalChars,
+		NoControlChars:  true,
+		NoReservedNames: true,
+		NoTrailingDots:  true,
+		MaxNameLength:   255,
+		CountUTF16:      true,
+		Normalization:   &nfc,
+		CaseInsensitive: true,
+	},
+	"exfat": {
+		Name:            "exfat",
+		IllegalChars:    windowsIllegalChars,
+		NoControlChars:  true,
+		NoReservedNames: true,
+		NoTrailingDots:  true,
+		MaxNameLength:   255,
+		CountUTF16:      true,
+		Normalization:   &nfc,
+		CaseInsensitive: true,
+	},
+	"hfsplus": {
+		Name:            "hfsplus",
+		MaxNameLength:   255,
+		CountUTF16:      true,
+		Normalization:   &nfd,
+		CaseInsensitive: true,
+	},
+	"ext4": {
+		Name:          "ext4",
+		MaxNameLength: 255,
+	},
+}
+
+// Mount types (/proc/mounts, statfs) -> profile name
+var fsTypeProfiles = map[string]string{
+	"vfat":    "fat32",
+	"msdos":   "fat32",
+	"exfat":   "exfat",
+	"fuseblk": "exfat", // exfat-fuse or ntfs-3g, both with Windows rules
+	"ntfs":    "exfat",
+	"ntfs3":   "exfat",
+	"hfsplus": "hfsplus",
+	"hfs":     "hfsplus",
+	"apfs":    "hfsplus",
+	"ext2":    "ext4",
+	"ext3":    "ext4",
+	"ext4":    "ext4",
+}
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+var caseFolder = cases.Fold()
+
+func FindFilesystemProfile(name string) (*FilesystemProfile, error) {
+	if profile, ok := filesystemProfiles[strings.ToLower(name)]; ok {
+		return profile, nil
+	}
+	names := make([]string, 0, len(filesystemProfiles))
+	for name := range filesystemProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("Unknown filesystem: %s (%s)", name, strings.Join(names, ", "))
+}
+
+// Profile for the filesystem targetPath is on, DEFAULT_FILESYSTEM if unknown
+func DetectFilesystemProfile(targetPath string) *FilesystemProfile {
+	fsType, err := filesystemType(targetPath)
+	if err != nil {
+		logrus.Debugf("Cannot detect filesystem of %s: %s", targetPath, err)
+		return filesystemProfiles[DEFAULT_FILESYSTEM]
+	}
+	name, ok := fsTypeProfiles[fsType]
+	if !ok {
+		logrus.Debugf("Unknown filesystem type %s, using %s rules", fsType, DEFAULT_FILESYSTEM)
+		name = DEFAULT_FILESYSTEM
+	}
+	logrus.Infof("Filesystem: %s (%s)", name, fsType)
+	return filesystemProfiles[name]
+}
+
+// Valid name for a file or directory: illegal characters are replaced,
+// and it is normalized and cut to MaxNameLength
+func (fs *FilesystemProfile) Sanitize(name string) string {
+	return fs.truncate(fs.sanitize(name), 0)
+}
+
+// Valid file name of name + extension, name is cut to leave room for the extension
+func (fs *FilesystemProfile) FileName(name, extension string) string {
+	return fs.truncate(fs.sanitize(name), fs.length(extension)) + extension
+}
+
+func (fs *FilesystemProfile) sanitize(name string) string {
+	if fs.Normalization != nil {
+		name = fs.Normalization.String(name)
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == 0:
+			return '_'
+		case fs.NoControlChars && r < 0x20:
+			return '_'
+		case strings.ContainsRune(fs.IllegalChars, r):
+			return '_'
+		}
+		return r
+	}, name)
+	if fs.NoTrailingDots {
+		name = strings.TrimRight(name, ". ")
+	}
+	if fs.NoReservedNames {
+		// "CON" and "con.mp3" are both the console
+		base := strings.TrimRight(strings.SplitN(name, ".", 2)[0], " ")
+		if reservedNames[strings.ToUpper(base)] {
+			name = base + "_" + name[len(base):]
+		}
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+func (fs *FilesystemProfile) length(s string) int {
+	if fs.CountUTF16 {
+		return len(utf16.Encode([]rune(s)))
+	}
+	return len(s)
+}
+
+// Cuts name at a grapheme boundary to fit in MaxNameLength - reserve, so
+// that combining marks and emoji sequences are never split
+func (fs *FilesystemProfile) truncate(name string, reserve int) string {
+	limit := fs.MaxNameLength - reserve
+	if fs.MaxNameLength <= 0 || fs.length(name) <= limit {
+		return name
+	}
+	var buf strings.Builder
+	used := 0
+	graphemes := uniseg.NewGraphemes(name)
+	for graphemes.Next() {
+		cluster := graphemes.Str()
+		if used+fs.length(cluster) > limit {
+			break
+		}
+		used += fs.length(cluster)
+		buf.WriteString(cluster)
+	}
+	ret := buf.String()
+	if fs.NoTrailingDots {
+		ret = strings.TrimRight(ret, ". ")
+	}
+	if ret == "" {
+		ret = "_"
+	}
+	return ret
+}
+
+// Names with the same key are the same file on the filesystem
+func (fs *FilesystemProfile) CollisionKey(name string) string {
+	if fs.Normalization != nil {
+		name = norm.NFC.String(name)
+	}
+	if fs.CaseInsensitive {
+		name = caseFolder.String(name)
+	}
+	return name
+}
+
+func (fs *FilesystemProfile) String() string {
+	return fs.Name
+}
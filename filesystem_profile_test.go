@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// é is "\u00e9" (NFC) or "e\u0301" (NFD)
+func TestFilesystemSanitize(t *testing.T) {
+	cases := []struct {
+		profile  string
+		name     string
+		expected string
+	}{
+		{"fat32", `a:b?c*"d<e>f|g\h`, "a_b_c__d_e_f_g_h"},
+		{"fat32", "a/b", "a_b"},
+		{"fat32", "\x01a\x1f", "_a_"},
+		{"fat32", "CON", "CON_"},
+		{"fat32", "con.mp3", "con_.mp3"},
+		{"fat32", "Lpt1 .txt", "Lpt1_ .txt"},
+		{"fat32", "CONSOLE", "CONSOLE"},
+		{"fat32", "Song. . ", "Song"},
+		{"fat32", "...", "_"},
+		{"fat32", "e\u0301", "\u00e9"},
+		{"exfat", "AUX", "AUX_"},
+		{"exfat", "Live?.", "Live_"},
+		{"hfsplus", `a:b?"c`, `a:b?"c`},
+		{"hfsplus", "CON", "CON"},
+		{"hfsplus", "Song.", "Song."},
+		{"hfsplus", "\u00e9", "e\u0301"},
+		{"hfsplus", "a/b", "a_b"},
+		{"ext4", "a:b\x01", "a:b\x01"},
+		{"ext4", "e\u0301", "e\u0301"},
+		{"ext4", "..", "_"},
+		{"ext4", "", "_"},
+	}
+	for _, c := range cases {
+		fs, _ := FindFilesystemProfile(c.profile)
+		if sanitized := fs.Sanitize(c.name); sanitized != c.expected {
+			t.Errorf("%s: %q -> %q, expected %q", c.profile, c.name, sanitized, c.expected)
+		}
+	}
+}
+
+func TestFilesystemTruncate(t *testing.T) {
+	family := "\U0001F468\u200d\U0001F469\u200d\U0001F467" // 8 UTF-16 units, 18 bytes
+	cases := []struct {
+		profile string
+		name    string
+		// name part kept before the extension
+		expected string
+	}{
+		// 255 UTF-16 units on FAT, "あ" is one unit
+		{"fat32", strings.Repeat("あ", 300), strings.Repeat("あ", 251)},
+		{"exfat", strings.Repeat("\U0001F600", 200), strings.Repeat("\U0001F600", 125)},
+		{"fat32", strings.Repeat(family, 40), strings.Repeat(family, 31)},
+		// a dot left at the end is dropped
+		{"fat32", strings.Repeat("a", 250) + "." + strings.Repeat("b", 10), strings.Repeat("a", 250)},
+		{"hfsplus", strings.Repeat("\u00e9", 300), strings.Repeat("e\u0301", 125)},
+		// 255 bytes on ext4
+		{"ext4", strings.Repeat("あ", 100), strings.Repeat("あ", 83)},
+		{"ext4", strings.Repeat("e\u0301", 100), strings.Repeat("e\u0301", 83)},
+		{"ext4", strings.Repeat(family, 20), strings.Repeat(family, 13)},
+		{"ext4", "short", "short"},
+	}
+	for _, c := range cases {
+		fs, _ := FindFilesystemProfile(c.profile)
+		fileName := fs.FileName(c.name, ".mp3")
+		if fileName != c.expected+".mp3" {
+			t.Errorf("%s: %d units, expected %d", c.profile, fs.length(fileName), fs.length(c.expected+".mp3"))
+		}
+		if fs.length(fileName) > fs.MaxNameLength || !utf8.ValidString(fileName) {
+			t.Errorf("%s: invalid %q", c.profile, fileName)
+		}
+	}
+}
+
+func TestFilesystemCollisionKey(t *testing.T) {
+	cases := []struct {
+		profile string
+		a, b    string
+		same    bool
+	}{
+		{"fat32", "01 Song.mp3", "01 song.MP3", true},
+		{"fat32", "Caf\u00e9", "Cafe\u0301", true},
+		{"fat32", "Straße", "STRASSE", true},
+		{"exfat", "A", "a", true},
+		{"hfsplus", "Caf\u00e9", "CAFE\u0301", true},
+		{"ext4", "Song", "song", false},
+		{"ext4", "Caf\u00e9", "Cafe\u0301", false},
+		{"ext4", "Song", "Song", true},
+	}
+	for _, c := range cases {
+		fs, _ := FindFilesystemProfile(c.profile)
+		if same := fs.CollisionKey(c.a) == fs.CollisionKey(c.b); same != c.same {
+			t.Errorf("%s: %q and %q same: %t", c.profile, c.a, c.b, same)
+		}
+	}
+}
@@ -5,16 +5,26 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
+	"golang.org/x/text/unicode/norm"
 	"gopkg.in/cheggaaa/pb.v1"
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
 	"time"
 )
 
 type IOEngine struct {
 	actions      *list.List
 	trashActions *list.List
+	// Directories actions may touch, see Confine
+	roots []string
+	// Where the journal is kept while running, no journal if empty
+	journalDir string
+	// Actions performed at once
+	concurrency int
+	// Naming rules of the target, paths written twice are compared by them
+	filesystem *FilesystemProfile
 }
 
 type IOAction interface {
@@ -23,40 +33,119 @@ type IOAction interface {
 	String() string
 	SizeDelta() int64
 	ProcessCost() int64
+	// Paths the action creates, replaces or removes
+	TouchedPaths() []string
+	// What Finish does, for the journal
+	FinishStep() JournalStep
 }
 
+// IOActions reporting bytes while performing, progress may be called
+// from the performing goroutine only
+type progressReporter interface {
+	SetProgress(progress func(int64))
+}
+
+// IOActions performed after all the others, as they use their results
+type lateAction interface {
+	performsLate() bool
+}
+
+// IOActions writing a track file, its size and checksum after Perform
+type writtenFileAction interface {
+	WrittenFile() (int64, string)
+}
+
+// Actions performed at once if not configured: one reads the source
+// while another writes to the device
+const DEFAULT_CONCURRENCY = 2
+
 func NewIOEngine() *IOEngine {
 	return &IOEngine{
 		actions: list.New(),
 	}
 }
 
-func (e *IOEngine) Check(targetPath string) (bool, error) {
+// Performs up to n actions at once
+func (e *IOEngine) SetConcurrency(n int) {
+	e.concurrency = n
+}
+
+// Keeps a journal in dir while running, see RecoverJournal
+func (e *IOEngine) JournalAt(dir string) {
+	e.journalDir = dir
+}
+
+// Compares paths by the naming rules of fs, conservativePathKey if not set
+func (e *IOEngine) SetFilesystem(fs *FilesystemProfile) {
+	e.filesystem = fs
+}
+
+// Allows actions to touch paths under root
+func (e *IOEngine) Confine(root string) {
+	e.roots = append(e.roots, root)
+}
+
+// Net bytes the actions will take on the device
+func (e *IOEngine) WillConsume() int64 {
+	var willConsume int64 = 0
+	for action := e.actions.Front(); action != nil; action = action.Next() {
+		if ioAction, ok := action.Value.(IOAction); ok {
+			willConsume += ioAction.SizeDelta()
+		}
+	}
+	return willConsume
+}
+
+// Bytes needed while performing: copies are all written before deletes
+// and replaced files free their space in Finish
+func (e *IOEngine) PeakUsage() int64 {
+	var peak int64 = 0
+	for action := e.actions.Front(); action != nil; action = action.Next() {
+		if ioAction, ok := action.Value.(IOAction); ok {
+			if delta := ioAction.SizeDelta(); delta > 0 {
+				peak += delta
+			}
+		}
+	}
+	return peak
+}
+
+// Checks the actions stay in the target and fit in its free space, keeping reserve bytes
+func (e *IOEngine) Check(targetPath string, reserve int64) (bool, error) {
 	if e.actions.Len() == 0 {
 		logrus.Infof("No actions: nothing todo")
 		fmt.Println("Everything up-to-date.")
 		return false, nil
 	}
-	var willConsume int64 = 0
+	actions := make([]IOAction, 0, e.actions.Len())
 	for action := e.actions.Front(); action != nil; action = action.Next() {
 		if ioAction, ok := action.Value.(IOAction); ok {
-			willConsume += ioAction.SizeDelta()
-		} else {
-			logrus.Fatalf("Invalid IOAction: %s is not IOAction", ioAction)
+			actions = append(actions, ioAction)
 		}
 	}
+	roots := e.roots
+	if len(roots) == 0 {
+		roots = []string{targetPath}
+	}
+	if err := checkActionPaths(actions, roots); err != nil {
+		return false, err
+	}
+	willConsume, peak := e.WillConsume(), e.PeakUsage()
 	stat, err := DiskUsage(targetPath)
 	if err != nil {
 		return false, err
 	}
-	fmt.Printf("Disk %s: Free %dMB(%d%%), will consume %dMB(%d%%)\n", targetPath, stat.Free/MiB, (stat.Free*100)/stat.All, willConsume/MiB, uint64(willConsume*100)/stat.All)
-	if int64(stat.All) < int64(stat.Free)+willConsume {
+	fmt.Printf("Disk %s: Free %dMB(%d%%), will consume %dMB(%d%%), writing %dMB first\n", targetPath, stat.Free/MiB, (stat.Free*100)/stat.All, willConsume/MiB, willConsume*100/int64(stat.All), peak/MiB)
+	if peak > 0 && peak+reserve > int64(stat.Free) {
 		return false, errors.New("Capacity over! ")
 	}
 	return true, nil
 }
 
 func (e *IOEngine) Run() error {
+	if err := e.orderFinishes(); err != nil {
+		return err
+	}
 	var wholeCost int64 = 0
 	for action := e.actions.Front(); action != nil; action = action.Next() {
 		if ioAction, ok := action.Value.(IOAction); ok {
@@ -72,27 +161,35 @@ func (e *IOEngine) Run() error {
 	bar.Start()
 
 	dryRun := *argDryRun
+	var journal *Journal
+	if e.journalDir != "" && !dryRun {
+		actions := make([]IOAction, 0, e.actions.Len())
+		for action := e.actions.Front(); action != nil; action = action.Next() {
+			actions = append(actions, action.Value.(IOAction))
+		}
+		var err error
+		journal, err = CreateJournal(e.journalDir, e.roots, actions)
+		if err != nil {
+			return fmt.Errorf("Cannot write journal: %s", err)
+		}
+	}
 	// Perform
-	for action := e.actions.Front(); action != nil; action = action.Next() {
-		if ioAction, ok := action.Value.(IOAction); ok {
-			if dryRun {
-				logrus.Infof("DRYRUN: IO: %s", ioAction)
-			} else {
-				logrus.Debugf("%s", ioAction)
-				err := ioAction.Perform()
-				if err != nil {
-					logrus.Errorf("Error: %s", err)
-					return err
-				}
-				bar.Add64(ioAction.ProcessCost())
-			}
-		} else {
-			logrus.Fatalf("Invalid IOAction: %s is not IOAction", ioAction)
+	if dryRun {
+		for action := e.actions.Front(); action != nil; action = action.Next() {
+			logrus.Infof("DRYRUN: IO: %s", action.Value)
 		}
+	} else if err := e.performAll(bar); err != nil {
+		return err
 	}
 	bar.Finish()
 	logrus.Infof("Finishing sync...")
+	if journal != nil {
+		if err := journal.MarkPerformed(); err != nil {
+			return err
+		}
+	}
 	// Finish
+	index := 0
 	for action := e.actions.Front(); action != nil; action = action.Next() {
 		if ioAction, ok := action.Value.(IOAction); ok {
 			if dryRun {
@@ -104,10 +201,206 @@ func (e *IOEngine) Run() error {
 					logrus.Errorf("Error: %s", err)
 					return err
 				}
+				if journal != nil {
+					if err := journal.MarkDone(index); err != nil {
+						return err
+					}
+				}
 			}
 		} else {
 			logrus.Fatalf("Invalid IOAction: %s is not IOAction", ioAction)
 		}
+		index += 1
+	}
+	if journal != nil {
+		return journal.Close()
+	}
+	return nil
+}
+
+// Reorders actions so that no Finish overwrites a file which is still to
+// be renamed or deleted. Planners rename files when the playlist order
+// shifts, so "01 A" -> "02 A" may run before "02 B" -> "03 B", or a copy
+// may land on "01 A" before it moved. Such renames go through a temp name
+// first (A -> tmp, ..., tmp -> B), which also resolves swaps and
+// rotations, and deletes of files written by other actions come first.
+// Sink dirs moving onto each other's names go to a temp name where they
+// were to move, and to their new names after everything else.
+// Two actions writing the same path are a planning error.
+func (e *IOEngine) orderFinishes() error {
+	actions := make([]IOAction, 0, e.actions.Len())
+	for action := e.actions.Front(); action != nil; action = action.Next() {
+		actions = append(actions, action.Value.(IOAction))
+	}
+	// paths written by each action
+	destinations := make(map[string][]IOAction)
+	existing := make(map[string]bool)
+	writers := make(map[string]IOAction)
+	for _, action := range actions {
+		step := action.FinishStep()
+		if step.Op == "rename" {
+			// "01 a.m4a" and "01 A.m4a" are one file on FAT
+			writerKey := conservativePathKey(step.To)
+			if e.filesystem != nil {
+				writerKey = e.filesystem.CollisionKey(path.Clean(step.To))
+			}
+			if other, ok := writers[writerKey]; ok {
+				return fmt.Errorf("Both %s and %s write %s", other, action, step.To)
+			}
+			writers[writerKey] = action
+			key := conservativePathKey(step.To)
+			destinations[key] = append(destinations[key], action)
+			existing[step.To] = true
+		}
+	}
+	vacated := make(map[string]bool)
+	for _, action := range actions {
+		if move, ok := action.(*MoveDir); ok {
+			vacated[conservativePathKey(move.from)] = true
+		}
+	}
+	writtenByOthers := func(p string, self IOAction) bool {
+		for _, action := range destinations[conservativePathKey(p)] {
+			if action != self {
+				return true
+			}
+		}
+		return false
+	}
+	deletes := make([]IOAction, 0)
+	moveOuts := make([]IOAction, 0)
+	moveIns := make([]IOAction, 0)
+	rest := make([]IOAction, 0, len(actions))
+	for _, action := range actions {
+		switch act := action.(type) {
+		case *Delete:
+			if writtenByOthers(act.target, act) {
+				deletes = append(deletes, act)
+				continue
+			}
+		case *Rename:
+			if writtenByOthers(act.from, act) {
+				tempPath := uniqueTempPath(path.Dir(act.from), existing)
+				logrus.Debugf("Renaming through %s: %s --> %s", tempPath, act.from, act.to)
+				moveOuts = append(moveOuts, NewRename(act.from, tempPath))
+				rest = append(rest, NewRename(tempPath, act.to))
+				continue
+			}
+		case *MoveDir:
+			// files in the dir are handled before it moves, so it moves out in place
+			if writtenByOthers(act.from, act) || vacated[conservativePathKey(act.to)] {
+				tempPath := uniqueTempPath(path.Dir(act.from), existing)
+				logrus.Debugf("Moving through %s: %s --> %s", tempPath, act.from, act.to)
+				rest = append(rest, NewMoveDir(act.from, tempPath, act.root))
+				moveIns = append(moveIns, NewMoveDir(tempPath, act.to, act.root))
+				continue
+			}
+		}
+		rest = append(rest, action)
+	}
+	if len(deletes) == 0 && len(moveOuts) == 0 && len(moveIns) == 0 {
+		return nil
+	}
+	e.actions.Init()
+	for _, acts := range [][]IOAction{deletes, moveOuts, rest, moveIns} {
+		for _, act := range acts {
+			e.actions.PushBack(act)
+		}
+	}
+	return nil
+}
+
+// Same key for paths which may be the same file on some filesystem
+// (case or Unicode normalization differs)
+func conservativePathKey(p string) string {
+	return caseFolder.String(norm.NFC.String(path.Clean(p)))
+}
+
+// Name in dir not used by any file or action
+func uniqueTempPath(dir string, used map[string]bool) string {
+	for i := 0; ; i++ {
+		tempPath := path.Join(dir, fmt.Sprintf(".iwalk-rename-%d.tmp", i))
+		if !used[tempPath] && !isFileExists(tempPath) {
+			used[tempPath] = true
+			return tempPath
+		}
+	}
+}
+
+// Performs actions by concurrency workers. Finish steps wait for all of
+// them, so their order is kept.
+func (e *IOEngine) performAll(bar *pb.ProgressBar) error {
+	concurrency := e.concurrency
+	if concurrency < 1 {
+		concurrency = DEFAULT_CONCURRENCY
+	}
+	jobs := make(chan IOAction)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return firstErr != nil
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ioAction := range jobs {
+				if failed() {
+					continue
+				}
+				if err := performWithProgress(ioAction, bar); err != nil {
+					logrus.Errorf("Error: %s", err)
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	late := make([]IOAction, 0)
+	for action := e.actions.Front(); action != nil && !failed(); action = action.Next() {
+		ioAction := action.Value.(IOAction)
+		if la, ok := ioAction.(lateAction); ok && la.performsLate() {
+			late = append(late, ioAction)
+			continue
+		}
+		jobs <- ioAction
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	for _, ioAction := range late {
+		if err := performWithProgress(ioAction, bar); err != nil {
+			logrus.Errorf("Error: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Performs the action, adding its bytes to the bar as they are copied if
+// it reports them
+func performWithProgress(ioAction IOAction, bar *pb.ProgressBar) error {
+	logrus.Debugf("%s", ioAction)
+	var reported int64
+	if reporter, ok := ioAction.(progressReporter); ok {
+		reporter.SetProgress(func(n int64) {
+			reported += n
+			bar.Add64(n)
+		})
+	}
+	if err := ioAction.Perform(); err != nil {
+		return err
+	}
+	if rest := ioAction.ProcessCost() - reported; rest > 0 {
+		bar.Add64(rest)
 	}
 	return nil
 }
@@ -140,6 +433,9 @@ func (r *Rename) Perform() error {
 }
 
 func (r *Rename) Finish() error {
+	if err := os.MkdirAll(path.Dir(r.to), 0775); err != nil {
+		return err
+	}
 	return os.Rename(r.from, r.to)
 }
 
@@ -155,16 +451,66 @@ func (r *Rename) ProcessCost() int64 {
 	return 0
 }
 
+func (r *Rename) TouchedPaths() []string {
+	return []string{r.from, r.to}
+}
+
+func (r *Rename) FinishStep() JournalStep {
+	return renameStep(r.from, r.to, false)
+}
+
+// Moves a sink dir, then removes folder directories it leaves empty up to root
+type MoveDir struct {
+	Rename
+	root string
+}
+
+func NewMoveDir(from, to, root string) *MoveDir {
+	return &MoveDir{
+		Rename: Rename{from: from, to: to},
+		root:   root,
+	}
+}
+
+func (m *MoveDir) Finish() error {
+	if err := m.Rename.Finish(); err != nil {
+		return err
+	}
+	removeEmptyParents(m.root, m.from)
+	return nil
+}
+
+func (m *MoveDir) String() string {
+	return fmt.Sprintf("MOVE   %s --> %s", m.from, m.to)
+}
+
 type Copy struct {
 	from     string
 	to       string
 	size     int64
 	track    *Track
 	tempFile string
+	progress func(int64)
+	// downloads from, if the source does so on demand
+	fetch func() error
+	// of the written file, after Perform
+	checksum string
 }
 
-func NewCopy(from, to string, copyingTrack *Track) *Copy {
+// Size of the source file, or of the track if it is fetched when copying
+func sourceFileSize(from string, track *Track) (int64, error) {
 	st, err := os.Stat(from)
+	if err != nil {
+		if os.IsNotExist(err) && track.fetch != nil {
+			return int64(track.Size), nil
+		}
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+func NewCopy(from, to string, copyingTrack *Track) *Copy {
+	size, err := sourceFileSize(from, copyingTrack)
 	if err != nil {
 		logrus.Errorf("Cannot access: %s", from)
 		return nil
@@ -175,33 +521,94 @@ func NewCopy(from, to string, copyingTrack *Track) *Copy {
 		to:       to,
 		tempFile: tempFile,
 		track:    copyingTrack,
-		size:     st.Size(),
+		size:     size,
+		fetch:    copyingTrack.fetch,
 	}
 }
 
+// Downloads the source if needed, and takes its actual size
+func (c *Copy) fetchSource() error {
+	if c.fetch == nil {
+		return nil
+	}
+	if err := c.fetch(); err != nil {
+		return err
+	}
+	st, err := os.Stat(c.from)
+	if err != nil {
+		return err
+	}
+	c.size = st.Size()
+	return nil
+}
+
 func (c *Copy) Perform() error {
+	if err := c.fetchSource(); err != nil {
+		return err
+	}
+	// filename templates may place tracks in subdirectories
+	if err := os.MkdirAll(path.Dir(c.tempFile), 0775); err != nil {
+		return err
+	}
 	stat, err := os.Stat(c.tempFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// normal copy
-			return CopyFile(c.from, c.tempFile)
+			return c.copy()
 		} else {
 			return err
 		}
 	} else {
 		// resume
 		if stat.Size() == c.size {
-			// ok
-			logrus.Debugf("Skipping: %s (temp: %s, size match)", c.to, c.tempFile)
-			return nil
-		} else {
-			// overwrite copy
-			logrus.Debugf("Overwrite: broken file %s (temp: %s)", c.to, c.tempFile)
-			return CopyFile(c.from, c.tempFile)
+			// same size, the contents must match too
+			tempChecksum, _, err := hashFile(c.tempFile, false)
+			if err != nil {
+				return err
+			}
+			sourceChecksum, _, err := hashFile(c.from, false)
+			if err != nil {
+				return err
+			}
+			if tempChecksum == sourceChecksum {
+				logrus.Debugf("Skipping: %s (temp: %s, checksum match)", c.to, c.tempFile)
+				c.checksum = tempChecksum
+				return nil
+			}
 		}
+		// overwrite copy
+		logrus.Debugf("Overwrite: broken file %s (temp: %s)", c.to, c.tempFile)
+		return c.copy()
 	}
 }
 
+// Copies into the temp file, and reads it back from the device with -verify_writes
+func (c *Copy) copy() error {
+	hasher := newChecksumHash()
+	if err := CopyFile(c.from, c.tempFile, c.progress, hasher); err != nil {
+		return err
+	}
+	c.checksum = formatChecksum(hasher)
+	if *argVerifyWrites {
+		written, _, err := hashFile(c.tempFile, true)
+		if err != nil {
+			return err
+		}
+		if written != c.checksum {
+			return fmt.Errorf("Verification failed: %s (written %s, copied %s)", c.to, written, c.checksum)
+		}
+	}
+	return nil
+}
+
+func (c *Copy) WrittenFile() (int64, string) {
+	return c.size, c.checksum
+}
+
+func (c *Copy) SetProgress(progress func(int64)) {
+	c.progress = progress
+}
+
 func (c *Copy) Finish() error {
 	return os.Rename(c.tempFile, c.to)
 }
@@ -218,6 +625,14 @@ func (c *Copy) ProcessCost() int64 {
 	return c.size
 }
 
+func (c *Copy) TouchedPaths() []string {
+	return []string{c.tempFile, c.to}
+}
+
+func (c *Copy) FinishStep() JournalStep {
+	return renameStep(c.tempFile, c.to, true)
+}
+
 type Delete struct {
 	target string
 	size   int64
@@ -255,10 +670,22 @@ func (d *Delete) ProcessCost() int64 {
 	return 0
 }
 
+func (d *Delete) TouchedPaths() []string {
+	return []string{d.target}
+}
+
+func (d *Delete) FinishStep() JournalStep {
+	return JournalStep{Op: "remove", To: d.target}
+}
+
 type WriteFileAction struct {
 	data       []byte
 	targetPath string
 	tempPath   string
+	// Makes data when performing, if not nil
+	render func() ([]byte, error)
+	// Size rendered when planning, the progress bar was set up with it
+	planned int64
 }
 
 func NewWriteFileAction(targetPath, tmpPath string, data []byte) *WriteFileAction {
@@ -269,10 +696,37 @@ func NewWriteFileAction(targetPath, tmpPath string, data []byte) *WriteFileActio
 	}
 }
 
+// Writes data made after every other action performed, from their results.
+// data is rendered once here for the size estimate.
+func NewLateWriteFileAction(targetPath, tmpPath string, render func() ([]byte, error)) (*WriteFileAction, error) {
+	data, err := render()
+	if err != nil {
+		return nil, err
+	}
+	return &WriteFileAction{
+		targetPath: targetPath,
+		tempPath:   tmpPath,
+		data:       data,
+		render:     render,
+		planned:    int64(len(data)),
+	}, nil
+}
+
 func (uma *WriteFileAction) Perform() error {
+	if uma.render != nil {
+		data, err := uma.render()
+		if err != nil {
+			return err
+		}
+		uma.data = data
+	}
 	return ioutil.WriteFile(uma.tempPath, uma.data, 0644)
 }
 
+func (uma *WriteFileAction) performsLate() bool {
+	return uma.render != nil
+}
+
 func (uma *WriteFileAction) Finish() error {
 	return os.Rename(uma.tempPath, uma.targetPath)
 }
@@ -284,5 +738,76 @@ func (uma *WriteFileAction) SizeDelta() int64 {
 	return int64(len(uma.data))
 }
 func (uma *WriteFileAction) ProcessCost() int64 {
+	if uma.render != nil {
+		return uma.planned
+	}
 	return int64(len(uma.data))
 }
+func (uma *WriteFileAction) TouchedPaths() []string {
+	return []string{uma.tempPath, uma.targetPath}
+}
+func (uma *WriteFileAction) FinishStep() JournalStep {
+	return renameStep(uma.tempPath, uma.targetPath, true)
+}
+
+// Removes empty directories under root (but not root itself)
+type PruneEmptyDirs struct {
+	root string
+}
+
+func NewPruneEmptyDirs(root string) *PruneEmptyDirs {
+	return &PruneEmptyDirs{
+		root: root,
+	}
+}
+
+func (pe *PruneEmptyDirs) Perform() error {
+	return nil
+}
+
+func (pe *PruneEmptyDirs) Finish() error {
+	_, err := pruneEmptyDirs(pe.root, true)
+	return err
+}
+
+// Returns whether dir has been removed
+func pruneEmptyDirs(dir string, isRoot bool) (bool, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	remains := len(infos)
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		removed, err := pruneEmptyDirs(path.Join(dir, info.Name()), false)
+		if err != nil {
+			return false, err
+		}
+		if removed {
+			remains -= 1
+		}
+	}
+	if remains > 0 || isRoot {
+		return false, nil
+	}
+	logrus.Debugf("Removing empty directory: %s", dir)
+	return true, os.Remove(dir)
+}
+
+func (pe *PruneEmptyDirs) String() string {
+	return fmt.Sprintf("PRUNE  %s", pe.root)
+}
+func (pe *PruneEmptyDirs) SizeDelta() int64 {
+	return 0
+}
+func (pe *PruneEmptyDirs) ProcessCost() int64 {
+	return 0
+}
+func (pe *PruneEmptyDirs) TouchedPaths() []string {
+	return []string{pe.root}
+}
+func (pe *PruneEmptyDirs) FinishStep() JournalStep {
+	return JournalStep{Op: "prune", To: pe.root}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOrderFinishes(t *testing.T) {
+	cases := []struct {
+		name    string
+		files   map[string]string // name -> content before
+		actions func(dir string) []IOAction
+		after   map[string]string
+	}{
+		{
+			name:  "swap",
+			files: map[string]string{"1 A.mp3": "A", "1 B.mp3": "B"},
+			actions: func(dir string) []IOAction {
+				return []IOAction{
+					NewRename(path.Join(dir, "1 A.mp3"), path.Join(dir, "1 B.mp3")),
+					NewRename(path.Join(dir, "1 B.mp3"), path.Join(dir, "1 A.mp3")),
+				}
+			},
+			after: map[string]string{"1 A.mp3": "B", "1 B.mp3": "A"},
+		},
+		{
+			name:  "rotation",
+			files: map[string]string{"1 A.mp3": "A", "2 B.mp3": "B", "3 C.mp3": "C"},
+			actions: func(dir string) []IOAction {
+				return []IOAction{
+					NewRename(path.Join(dir, "1 A.mp3"), path.Join(dir, "2 B.mp3")),
+					NewRename(path.Join(dir, "2 B.mp3"), path.Join(dir, "3 C.mp3")),
+					NewRename(path.Join(dir, "3 C.mp3"), path.Join(dir, "1 A.mp3")),
+				}
+			},
+			after: map[string]string{"1 A.mp3": "C", "2 B.mp3": "A", "3 C.mp3": "B"},
+		},
+		{
+			// a new track at index 0 shifts the others
+			name:  "insert",
+			files: map[string]string{"01 A.mp3": "A", "02 B.mp3": "B", "new.mp3": "N"},
+			actions: func(dir string) []IOAction {
+				track := &Track{Name: "New", PersistentId: "N1", Location: fileLocation(path.Join(dir, "new.mp3"))}
+				return []IOAction{
+					NewCopy(track.LocalPath(), path.Join(dir, "01 A.mp3"), track),
+					NewRename(path.Join(dir, "01 A.mp3"), path.Join(dir, "02 B.mp3")),
+					NewRename(path.Join(dir, "02 B.mp3"), path.Join(dir, "03 B.mp3")),
+				}
+			},
+			after: map[string]string{"01 A.mp3": "N", "02 B.mp3": "A", "03 B.mp3": "B", "new.mp3": "N"},
+		},
+		{
+			// same key on a case-insensitive filesystem, renamed directly
+			name:  "case only",
+			files: map[string]string{"1 a.mp3": "A"},
+			actions: func(dir string) []IOAction {
+				return []IOAction{
+					NewRename(path.Join(dir, "1 a.mp3"), path.Join(dir, "1 A.mp3")),
+				}
+			},
+			after: map[string]string{"1 A.mp3": "A"},
+		},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "iwalk-engine")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for name, content := range c.files {
+			ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644)
+		}
+		engine := NewIOEngine()
+		for _, act := range c.actions(dir) {
+			engine.Push(act)
+		}
+		if err := engine.Run(); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		infos, _ := ioutil.ReadDir(dir)
+		after := make([]string, 0)
+		for _, info := range infos {
+			data, _ := ioutil.ReadFile(path.Join(dir, info.Name()))
+			after = append(after, info.Name()+"="+string(data))
+		}
+		expected := make([]string, 0)
+		for name, content := range c.after {
+			expected = append(expected, name+"="+content)
+		}
+		sort.Strings(expected)
+		if strings.Join(after, ", ") != strings.Join(expected, ", ") {
+			t.Errorf("%s: %v, expected %v", c.name, after, expected)
+		}
+	}
+}
+
+func TestOrderFinishesConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"1 A.mp3", "2 B.mp3"} {
+		ioutil.WriteFile(path.Join(dir, name), []byte(name), 0644)
+	}
+	engine := NewIOEngine()
+	engine.Push(NewRename(path.Join(dir, "1 A.mp3"), path.Join(dir, "3 C.mp3")))
+	engine.Push(NewRename(path.Join(dir, "2 B.mp3"), path.Join(dir, "3 C.mp3")))
+	if err := engine.Run(); err == nil {
+		t.Fatal("renamed twice onto 3 C.mp3")
+	}
+	if !isFileExists(path.Join(dir, "1 A.mp3")) || !isFileExists(path.Join(dir, "2 B.mp3")) {
+		t.Fatal("renamed before the conflict was found")
+	}
+}
+
+// Sink dirs of two playlists swapping names, and one moving onto a name
+// another vacates, in the order planners push them
+func TestOrderFinishesMoveDir(t *testing.T) {
+	cases := []struct {
+		name    string
+		dirs    []string
+		actions func(root string) []IOAction
+		after   map[string]string // dir -> meta.json
+	}{
+		{
+			name: "swap",
+			dirs: []string{"A", "B"},
+			actions: func(root string) []IOAction {
+				return []IOAction{
+					NewRename(path.Join(root, "A", "1 a.mp3"), path.Join(root, "A", "2 a.mp3")),
+					NewMoveDir(path.Join(root, "A"), path.Join(root, "B"), root),
+					NewRename(path.Join(root, "B", "1 b.mp3"), path.Join(root, "B", "2 b.mp3")),
+					NewMoveDir(path.Join(root, "B"), path.Join(root, "A"), root),
+				}
+			},
+			after: map[string]string{"A": "B", "B": "A"},
+		},
+		{
+			name: "vacated",
+			dirs: []string{"A", "B"},
+			actions: func(root string) []IOAction {
+				return []IOAction{
+					NewMoveDir(path.Join(root, "A"), path.Join(root, "B"), root),
+					NewMoveDir(path.Join(root, "B"), path.Join(root, "Sub", "C"), root),
+				}
+			},
+			after: map[string]string{"B": "A", "Sub/C": "B"},
+		},
+	}
+	for _, c := range cases {
+		root, err := ioutil.TempDir("", "iwalk-engine")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		for _, dir := range c.dirs {
+			os.MkdirAll(path.Join(root, dir), 0755)
+			ioutil.WriteFile(path.Join(root, dir, META_JSON_FILENAME), []byte(dir), 0644)
+			ioutil.WriteFile(path.Join(root, dir, "1 "+strings.ToLower(dir)+".mp3"), []byte(dir), 0644)
+		}
+		engine := NewIOEngine()
+		for _, act := range c.actions(root) {
+			engine.Push(act)
+		}
+		if err := engine.Run(); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		for dir, meta := range c.after {
+			if data, _ := ioutil.ReadFile(path.Join(root, dir, META_JSON_FILENAME)); string(data) != meta {
+				t.Errorf("%s: %s has meta.json of %q, expected %q", c.name, dir, data, meta)
+			}
+		}
+		infos, _ := ioutil.ReadDir(root)
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), ".tmp") {
+				t.Errorf("%s: %s left", c.name, info.Name())
+			}
+		}
+	}
+}
+
+// Names differing in case are one file on FAT, two on ext4
+func TestOrderFinishesCaseConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.m4a", "b.m4a"} {
+		ioutil.WriteFile(path.Join(dir, name), []byte(name), 0644)
+	}
+	for _, c := range []struct {
+		profile  string
+		conflict bool
+	}{{"", true}, {"fat32", true}, {"exfat", true}, {"ext4", false}} {
+		engine := NewIOEngine()
+		if c.profile != "" {
+			fs, _ := FindFilesystemProfile(c.profile)
+			engine.SetFilesystem(fs)
+		}
+		engine.Push(NewRename(path.Join(dir, "a.m4a"), path.Join(dir, "01 a.m4a")))
+		engine.Push(NewRename(path.Join(dir, "b.m4a"), path.Join(dir, "01 A.m4a")))
+		if err := engine.orderFinishes(); (err != nil) != c.conflict {
+			t.Errorf("%s: %v", c.profile, err)
+		}
+	}
+}
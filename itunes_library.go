@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/DHowett/go-plist"
+	"github.com/Sirupsen/logrus"
 	"os"
 	"strconv"
 	"time"
@@ -32,11 +33,22 @@ type Track struct {
 	Composer            string
 	Album               string
 	Genre               string
+	Grouping            string
+	Comments            string
 	Kind                string
 	Size                int
 	TotalTime           int `plist:"Total Time"`
 	TrackNumber         int `plist:"Track Number"`
+	DiscNumber          int `plist:"Disc Number"`
 	Year                int
+	BPM                 int
+	Compilation         bool
+	Podcast             bool
+	HasVideo            bool `plist:"Has Video"`
+	Movie               bool
+	MusicVideo          bool      `plist:"Music Video"`
+	TVShow              bool      `plist:"TV Show"`
+	Disabled            bool      // unchecked in iTunes
 	DateModified        time.Time `plist:"Date Modified"`
 	DateAdded           time.Time `plist:"Date Added"`
 	BitRate             int       `plist:"Bit Rate"`
@@ -55,13 +67,18 @@ type Track struct {
 	Location            string
 	FileFolderCount     int `plist:"File Folder Count"`
 	LibraryFolderCount  int `plist:"Library Folder Count"`
+	// Makes the file at Location local, for sources which download tracks
+	// when they are copied. nil if the file is local.
+	fetch func() error
 }
 
 type Playlist struct {
 	Name                 string
 	Master               bool
+	Folder               bool
 	PlaylistId           int    `plist:"Playlist ID"`
 	PlaylistPersistentId string `plist:"Playlist Persistent ID"`
+	ParentPersistentId   string `plist:"Parent Persistent ID"` // containing folder
 	DistinguishedKind    int    `plist:"Distinguished Kind"`
 	Visible              bool
 	AllItems             bool           `plist:"All Items"`
@@ -97,12 +114,21 @@ func LoadLibrary(fileLocation string) (returnLibrary *Library, err error) {
 		return
 	}
 
+	library.buildIndex()
+	return &library, err
+}
+
+// Builds lookup maps, should be called after Tracks and Playlists are filled.
+func (library *Library) buildIndex() {
 	library.PlaylistMap = make(map[string]Playlist, len(library.Playlists))
 	for _, value := range library.Playlists {
 		library.PlaylistMap[value.Name] = value
 	}
-
-	return &library, err
+	library.persistentMap = make(map[string]*Track, len(library.Tracks))
+	for key := range library.Tracks {
+		track := library.Tracks[key]
+		library.persistentMap[track.PersistentId] = &track
+	}
 }
 
 func (playlist *Playlist) Tracks(library *Library) []Track {
@@ -115,3 +141,53 @@ func (playlist *Playlist) Tracks(library *Library) []Track {
 	}
 	return tracks
 }
+
+// Local file path of the track
+func (t *Track) LocalPath() string {
+	return normalizeLocation(t.Location)
+}
+
+// Makes sure the file at LocalPath exists
+func (t *Track) Fetch() error {
+	if t.fetch == nil {
+		return nil
+	}
+	return t.fetch()
+}
+
+func (library *Library) ListPlaylists() []*Playlist {
+	ret := make([]*Playlist, 0, len(library.Playlists))
+	for i := range library.Playlists {
+		ret = append(ret, &library.Playlists[i])
+	}
+	return ret
+}
+
+func (library *Library) FindPlaylist(name string) (*Playlist, bool) {
+	playlist, ok := library.PlaylistMap[name]
+	return &playlist, ok
+}
+
+func (library *Library) PlaylistTracks(playlist *Playlist) ([]Track, error) {
+	return library.playlistTracks(playlist, 0)
+}
+
+func (library *Library) playlistTracks(playlist *Playlist, depth int) ([]Track, error) {
+	if *argEvalSmart && playlist.IsSmart() {
+		tracks, err := library.evaluateSmartPlaylist(playlist, depth)
+		if err == nil {
+			return tracks, nil
+		}
+		logrus.Warnf("Cannot evaluate smart playlist %s, using iTunes' result: %s", playlist.Name, err)
+	}
+	return playlist.Tracks(library), nil
+}
+
+func (playlist *Playlist) IsSmart() bool {
+	return len(playlist.SmartInfo) > 0 && len(playlist.SmartCriteria) > 0
+}
+
+func (library *Library) FindTrack(persistentId string) (*Track, bool) {
+	track, ok := library.persistentMap[persistentId]
+	return track, ok
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Decoder and evaluator for iTunes smart playlists ("Smart Info" and
+// "Smart Criteria" in the library XML). The binary format is undocumented;
+// layout follows what other importers (Banshee, itunessmart) found out.
+// Rules using unknown fields fail to evaluate, and callers fall back to
+// the expansion iTunes exported.
+
+const (
+	SMART_FIELD_NAME          = 0x02
+	SMART_FIELD_ALBUM         = 0x03
+	SMART_FIELD_ARTIST        = 0x04
+	SMART_FIELD_BITRATE       = 0x05
+	SMART_FIELD_SAMPLE_RATE   = 0x06
+	SMART_FIELD_YEAR          = 0x07
+	SMART_FIELD_GENRE         = 0x08
+	SMART_FIELD_KIND          = 0x09
+	SMART_FIELD_DATE_MODIFIED = 0x0a
+	SMART_FIELD_TRACK_NUMBER  = 0x0b
+	SMART_FIELD_SIZE          = 0x0c
+	SMART_FIELD_TIME          = 0x0d
+	SMART_FIELD_COMMENTS      = 0x0e
+	SMART_FIELD_DATE_ADDED    = 0x10
+	SMART_FIELD_COMPOSER      = 0x12
+	SMART_FIELD_PLAY_COUNT    = 0x16
+	SMART_FIELD_LAST_PLAYED   = 0x17
+	SMART_FIELD_DISC_NUMBER   = 0x18
+	SMART_FIELD_RATING        = 0x19
+	SMART_FIELD_COMPILATION   = 0x1f
+	SMART_FIELD_BPM           = 0x23
+	SMART_FIELD_GROUPING      = 0x27
+	SMART_FIELD_PLAYLIST      = 0x28
+	SMART_FIELD_SKIP_COUNT    = 0x44
+	SMART_FIELD_LAST_SKIPPED  = 0x45
+	SMART_FIELD_ALBUM_ARTIST  = 0x47
+	SMART_FIELD_ALBUM_RATING  = 0x5a
+)
+
+const (
+	SMART_OP_OTHER    = 0x00 // range, or "in the last" for dates
+	SMART_OP_IS       = 0x01
+	SMART_OP_CONTAINS = 0x02
+	SMART_OP_STARTS   = 0x04
+	SMART_OP_ENDS     = 0x08
+	SMART_OP_GREATER  = 0x10
+	SMART_OP_LESS     = 0x40
+)
+
+const (
+	SMART_LIMIT_MINUTES = 0x01
+	SMART_LIMIT_MB      = 0x02
+	SMART_LIMIT_ITEMS   = 0x03
+	SMART_LIMIT_HOURS   = 0x04
+	SMART_LIMIT_GB      = 0x05
+)
+
+const (
+	SMART_SELECT_LOWEST_RATING   = 0x01
+	SMART_SELECT_RANDOM          = 0x02
+	SMART_SELECT_NAME            = 0x05
+	SMART_SELECT_ALBUM           = 0x06
+	SMART_SELECT_ARTIST          = 0x07
+	SMART_SELECT_GENRE           = 0x09
+	SMART_SELECT_RECENTLY_ADDED  = 0x15
+	SMART_SELECT_OFTEN_PLAYED    = 0x19
+	SMART_SELECT_RECENTLY_PLAYED = 0x1a
+	SMART_SELECT_HIGHEST_RATING  = 0x1c
+)
+
+const SMART_CRITERIA_HEADER_LEN = 136
+const SMART_RULE_HEADER_LEN = 56
+const SMART_INT_VALUE_LEN = 68
+
+// Dates are seconds since 1904-01-01
+var smartEpoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var smartStringFields = map[int]string{
+	SMART_FIELD_NAME:         "Name",
+	SMART_FIELD_ALBUM:        "Album",
+	SMART_FIELD_ARTIST:       "Artist",
+	SMART_FIELD_GENRE:        "Genre",
+	SMART_FIELD_KIND:         "Kind",
+	SMART_FIELD_COMMENTS:     "Comments",
+	SMART_FIELD_COMPOSER:     "Composer",
+	SMART_FIELD_GROUPING:     "Grouping",
+	SMART_FIELD_ALBUM_ARTIST: "Album Artist",
+}
+
+var smartIntFields = map[int]string{
+	SMART_FIELD_BITRATE:      "Bit Rate",
+	SMART_FIELD_SAMPLE_RATE:  "Sample Rate",
+	SMART_FIELD_YEAR:         "Year",
+	SMART_FIELD_TRACK_NUMBER: "Track Number",
+	SMART_FIELD_SIZE:         "Size",
+	SMART_FIELD_TIME:         "Time",
+	SMART_FIELD_PLAY_COUNT:   "Plays",
+	SMART_FIELD_DISC_NUMBER:  "Disc Number",
+	SMART_FIELD_RATING:       "Rating",
+	SMART_FIELD_COMPILATION:  "Compilation",
+	SMART_FIELD_BPM:          "BPM",
+	SMART_FIELD_PLAYLIST:     "Playlist",
+	SMART_FIELD_SKIP_COUNT:   "Skips",
+	SMART_FIELD_ALBUM_RATING: "Album Rating",
+}
+
+var smartDateFields = map[int]string{
+	SMART_FIELD_DATE_MODIFIED: "Date Modified",
+	SMART_FIELD_DATE_ADDED:    "Date Added",
+	SMART_FIELD_LAST_PLAYED:   "Last Played",
+	SMART_FIELD_LAST_SKIPPED:  "Last Skipped",
+}
+
+type SmartInfo struct {
+	LiveUpdating     bool
+	MatchEnabled     bool
+	LimitEnabled     bool
+	LimitType        int
+	LimitValue       int
+	SelectionMethod  int
+	SelectionReverse bool // "least" instead of "most"
+	OnlyChecked      bool
+}
+
+type SmartCriteria struct {
+	MatchAny bool
+	Rules    []SmartRule
+}
+
+type SmartRule struct {
+	Field  int
+	Negate bool
+	Op     int
+	Text   string
+	IntA   int64
+	IntB   int64
+	// "in the last TimeValue*TimeMultiple seconds", TimeValue is negative
+	TimeValue    int64
+	TimeMultiple int64
+	// Nested rule group
+	Sub *SmartCriteria
+}
+
+func DecodeSmartInfo(data []byte) (*SmartInfo, error) {
+	if len(data) < 14 {
+		return nil, errors.New("Smart Info too short")
+	}
+	return &SmartInfo{
+		LiveUpdating:     data[0] != 0,
+		MatchEnabled:     data[1] != 0,
+		LimitEnabled:     data[2] != 0,
+		LimitType:        int(data[3]),
+		SelectionMethod:  int(data[7]),
+		LimitValue:       int(binary.BigEndian.Uint32(data[8:12])),
+		OnlyChecked:      data[12] != 0,
+		SelectionReverse: data[13] != 0,
+	}, nil
+}
+
+func DecodeSmartCriteria(data []byte) (*SmartCriteria, error) {
+	criteria, _, err := decodeSmartCriteria(data)
+	return criteria, err
+}
+
+// Returns criteria and consumed length
+func decodeSmartCriteria(data []byte) (*SmartCriteria, int, error) {
+	if len(data) < SMART_CRITERIA_HEADER_LEN || !bytes.HasPrefix(data, []byte("SLst")) {
+		return nil, 0, errors.New("Invalid Smart Criteria header")
+	}
+	ruleCount := int(binary.BigEndian.Uint32(data[8:12]))
+	criteria := &SmartCriteria{
+		MatchAny: data[15] == 1,
+	}
+	offset := SMART_CRITERIA_HEADER_LEN
+	for i := 0; (ruleCount == 0 || i < ruleCount) && offset < len(data); i++ {
+		if bytes.HasPrefix(data[offset:], []byte("SLst")) {
+			sub, consumed, err := decodeSmartCriteria(data[offset:])
+			if err != nil {
+				return nil, 0, err
+			}
+			criteria.Rules = append(criteria.Rules, SmartRule{Sub: sub})
+			offset += consumed
+			continue
+		}
+		rule, consumed, err := decodeSmartRule(data[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		criteria.Rules = append(criteria.Rules, *rule)
+		offset += consumed
+	}
+	return criteria, offset, nil
+}
+
+func decodeSmartRule(data []byte) (*SmartRule, int, error) {
+	if len(data) < SMART_RULE_HEADER_LEN {
+		return nil, 0, errors.New("Smart rule too short")
+	}
+	rule := &SmartRule{
+		Field:  int(binary.BigEndian.Uint32(data[0:4])),
+		Negate: data[4]&0x02 != 0,
+		Op:     int(data[7]),
+	}
+	valueLen := int(binary.BigEndian.Uint32(data[52:56]))
+	if SMART_RULE_HEADER_LEN+valueLen > len(data) {
+		return nil, 0, fmt.Errorf("Smart rule value overflows (field 0x%02x)", rule.Field)
+	}
+	value := data[SMART_RULE_HEADER_LEN : SMART_RULE_HEADER_LEN+valueLen]
+	if _, ok := smartStringFields[rule.Field]; ok {
+		// UTF-16BE
+		units := make([]uint16, len(value)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(value[i*2:])
+		}
+		rule.Text = string(utf16.Decode(units))
+	} else if len(value) >= 32 {
+		rule.IntA = int64(binary.BigEndian.Uint64(value[0:8]))
+		rule.TimeValue = int64(binary.BigEndian.Uint64(value[8:16]))
+		rule.TimeMultiple = int64(binary.BigEndian.Uint64(value[16:24]))
+		rule.IntB = int64(binary.BigEndian.Uint64(value[24:32]))
+	}
+	return rule, SMART_RULE_HEADER_LEN + valueLen, nil
+}
+
+// ---------------- evaluation ----------------
+
+type smartContext struct {
+	library *Library
+	now     time.Time
+	depth   int
+}
+
+func trackStringField(track *Track, field int) (string, bool) {
+	switch field {
+	case SMART_FIELD_NAME:
+		return track.Name, true
+	case SMART_FIELD_ALBUM:
+		return track.Album, true
+	case SMART_FIELD_ARTIST:
+		return track.Artist, true
+	case SMART_FIELD_GENRE:
+		return track.Genre, true
+	case SMART_FIELD_KIND:
+		return track.Kind, true
+	case SMART_FIELD_COMMENTS:
+		return track.Comments, true
+	case SMART_FIELD_COMPOSER:
+		return track.Composer, true
+	case SMART_FIELD_GROUPING:
+		return track.Grouping, true
+	case SMART_FIELD_ALBUM_ARTIST:
+		return track.AlbumArtist, true
+	}
+	return "", false
+}
+
+func trackIntField(track *Track, field int) (int64, bool) {
+	switch field {
+	case SMART_FIELD_BITRATE:
+		return int64(track.BitRate), true
+	case SMART_FIELD_SAMPLE_RATE:
+		return int64(track.SampleRate), true
+	case SMART_FIELD_YEAR:
+		return int64(track.Year), true
+	case SMART_FIELD_TRACK_NUMBER:
+		return int64(track.TrackNumber), true
+	case SMART_FIELD_SIZE:
+		return int64(track.Size), true
+	case SMART_FIELD_TIME:
+		return int64(track.TotalTime), true
+	case SMART_FIELD_PLAY_COUNT:
+		return int64(track.PlayCount), true
+	case SMART_FIELD_DISC_NUMBER:
+		return int64(track.DiscNumber), true
+	case SMART_FIELD_RATING:
+		return int64(track.Rating), true
+	case SMART_FIELD_COMPILATION:
+		if track.Compilation {
+			return 1, true
+		}
+		return 0, true
+	case SMART_FIELD_BPM:
+		return int64(track.BPM), true
+	case SMART_FIELD_SKIP_COUNT:
+		return int64(track.SkipCount), true
+	case SMART_FIELD_ALBUM_RATING:
+		return int64(track.AlbumRating), true
+	}
+	return 0, false
+}
+
+func trackDateField(track *Track, field int) (time.Time, bool) {
+	switch field {
+	case SMART_FIELD_DATE_MODIFIED:
+		return track.DateModified, true
+	case SMART_FIELD_DATE_ADDED:
+		return track.DateAdded, true
+	case SMART_FIELD_LAST_PLAYED:
+		return track.PlayDateUTC, true
+	case SMART_FIELD_LAST_SKIPPED:
+		return track.SkipDate, true
+	}
+	return time.Time{}, false
+}
+
+func (c *SmartCriteria) match(track *Track, ctx *smartContext) (bool, error) {
+	if len(c.Rules) == 0 {
+		return true, nil
+	}
+	for i := range c.Rules {
+		matched, err := c.Rules[i].match(track, ctx)
+		if err != nil {
+			return false, err
+		}
+		if c.MatchAny && matched {
+			return true, nil
+		}
+		if !c.MatchAny && !matched {
+			return false, nil
+		}
+	}
+	return !c.MatchAny, nil
+}
+
+func (r *SmartRule) match(track *Track, ctx *smartContext) (bool, error) {
+	if r.Sub != nil {
+		return r.Sub.match(track, ctx)
+	}
+	matched, err := r.matchPositive(track, ctx)
+	if err != nil {
+		return false, err
+	}
+	return matched != r.Negate, nil
+}
+
+func (r *SmartRule) matchPositive(track *Track, ctx *smartContext) (bool, error) {
+	if value, ok := trackStringField(track, r.Field); ok {
+		value, expected := strings.ToLower(value), strings.ToLower(r.Text)
+		switch r.Op {
+		case SMART_OP_IS:
+			return value == expected, nil
+		case SMART_OP_CONTAINS:
+			return strings.Contains(value, expected), nil
+		case SMART_OP_STARTS:
+			return strings.HasPrefix(value, expected), nil
+		case SMART_OP_ENDS:
+			return strings.HasSuffix(value, expected), nil
+		}
+	} else if r.Field == SMART_FIELD_PLAYLIST {
+		return ctx.isInPlaylist(track, uint64(r.IntA))
+	} else if value, ok := trackIntField(track, r.Field); ok {
+		switch r.Op {
+		case SMART_OP_IS:
+			return value == r.IntA, nil
+		case SMART_OP_GREATER:
+			return value > r.IntA, nil
+		case SMART_OP_LESS:
+			return value < r.IntA, nil
+		case SMART_OP_OTHER:
+			return r.IntA <= value && value <= r.IntB, nil
+		}
+	} else if value, ok := trackDateField(track, r.Field); ok {
+		if r.TimeMultiple > 0 && r.TimeValue != 0 {
+			boundary := ctx.now.Add(time.Duration(r.TimeValue*r.TimeMultiple) * time.Second)
+			if r.Op == SMART_OP_LESS {
+				return value.Before(boundary), nil
+			}
+			return !value.IsZero() && !value.Before(boundary), nil
+		}
+		a := smartEpoch.Add(time.Duration(r.IntA) * time.Second)
+		b := smartEpoch.Add(time.Duration(r.IntB) * time.Second)
+		switch r.Op {
+		case SMART_OP_IS:
+			return value.Year() == a.Year() && value.YearDay() == a.YearDay(), nil
+		case SMART_OP_GREATER:
+			return value.After(a), nil
+		case SMART_OP_LESS:
+			return !value.IsZero() && value.Before(a), nil
+		case SMART_OP_OTHER:
+			return !value.Before(a) && !value.After(b), nil
+		}
+	}
+	return false, fmt.Errorf("Unsupported smart rule: %s", r)
+}
+
+func (ctx *smartContext) isInPlaylist(track *Track, persistentId uint64) (bool, error) {
+	for i := range ctx.library.Playlists {
+		playlist := &ctx.library.Playlists[i]
+		id, err := strconv.ParseUint(playlist.PlaylistPersistentId, 16, 64)
+		if err != nil || id != persistentId {
+			continue
+		}
+		tracks, err := ctx.library.playlistTracks(playlist, ctx.depth+1)
+		if err != nil {
+			return false, err
+		}
+		for _, t := range tracks {
+			if t.PersistentId == track.PersistentId {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("Playlist %016X referred by smart rule not found", persistentId)
+}
+
+// Evaluates smart playlist against the music tracks of the library.
+// Tracks iTunes exported keep their order, newly matched tracks follow.
+func (library *Library) evaluateSmartPlaylist(playlist *Playlist, depth int) ([]Track, error) {
+	if depth > 16 {
+		return nil, errors.New("Too deep smart playlist reference")
+	}
+	info, err := DecodeSmartInfo(playlist.SmartInfo)
+	if err != nil {
+		return nil, err
+	}
+	criteria, err := DecodeSmartCriteria(playlist.SmartCriteria)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &smartContext{library: library, now: time.Now(), depth: depth}
+	// position in the playlist iTunes exported
+	position := make(map[int]int, len(playlist.PlaylistItems))
+	for i, item := range playlist.PlaylistItems {
+		position[item.TrackId] = i
+	}
+	matched := make([]Track, 0)
+	for _, track := range library.Tracks {
+		if _, exported := position[track.TrackId]; !exported && !isSmartMediaKind(&track) {
+			continue
+		}
+		if info.OnlyChecked && track.Disabled {
+			continue
+		}
+		if info.MatchEnabled {
+			ok, err := criteria.match(&track, ctx)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		matched = append(matched, track)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].TrackId < matched[j].TrackId
+	})
+	if info.LimitEnabled {
+		info.sortForSelection(matched, playlist.PlaylistPersistentId)
+		matched = info.limit(matched)
+	}
+	// keep exported order
+	sort.SliceStable(matched, func(i, j int) bool {
+		pi, iok := position[matched[i].TrackId]
+		pj, jok := position[matched[j].TrackId]
+		if iok && jok {
+			return pi < pj
+		}
+		return iok && !jok
+	})
+	return matched, nil
+}
+
+// Smart playlists of the Music library don't pick up videos, podcasts and
+// audiobooks unless iTunes exported them in the playlist
+func isSmartMediaKind(track *Track) bool {
+	return trackContentKind(track) == "music" && !track.HasVideo && !track.Movie && !track.MusicVideo && !track.TVShow
+}
+
+func (info *SmartInfo) sortForSelection(tracks []Track, playlistId string) {
+	var less func(a, b *Track) bool
+	switch info.SelectionMethod {
+	case SMART_SELECT_RANDOM:
+		// not the pick of iTunes, but the same one on every sync
+		stableShuffleTracks(tracks, playlistId)
+		return
+	case SMART_SELECT_NAME:
+		less = func(a, b *Track) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+	case SMART_SELECT_ALBUM:
+		less = func(a, b *Track) bool { return strings.ToLower(a.Album) < strings.ToLower(b.Album) }
+	case SMART_SELECT_ARTIST:
+		less = func(a, b *Track) bool { return strings.ToLower(a.Artist) < strings.ToLower(b.Artist) }
+	case SMART_SELECT_GENRE:
+		less = func(a, b *Track) bool { return strings.ToLower(a.Genre) < strings.ToLower(b.Genre) }
+	case SMART_SELECT_RECENTLY_ADDED:
+		less = func(a, b *Track) bool { return a.DateAdded.After(b.DateAdded) }
+	case SMART_SELECT_OFTEN_PLAYED:
+		less = func(a, b *Track) bool { return a.PlayCount > b.PlayCount }
+	case SMART_SELECT_RECENTLY_PLAYED:
+		less = func(a, b *Track) bool { return a.PlayDateUTC.After(b.PlayDateUTC) }
+	case SMART_SELECT_HIGHEST_RATING:
+		less = func(a, b *Track) bool { return a.Rating > b.Rating }
+	case SMART_SELECT_LOWEST_RATING:
+		less = func(a, b *Track) bool { return a.Rating < b.Rating }
+	default:
+		return
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if info.SelectionReverse {
+			return less(&tracks[j], &tracks[i])
+		}
+		return less(&tracks[i], &tracks[j])
+	})
+}
+
+func (info *SmartInfo) limit(tracks []Track) []Track {
+	var total, max int64
+	measure := func(t *Track) int64 { return int64(t.TotalTime) }
+	switch info.LimitType {
+	case SMART_LIMIT_ITEMS:
+		if len(tracks) > info.LimitValue {
+			return tracks[:info.LimitValue]
+		}
+		return tracks
+	case SMART_LIMIT_MINUTES:
+		max = int64(info.LimitValue) * 60 * 1000
+	case SMART_LIMIT_HOURS:
+		max = int64(info.LimitValue) * 60 * 60 * 1000
+	case SMART_LIMIT_MB:
+		max = int64(info.LimitValue) * MiB
+		measure = func(t *Track) int64 { return int64(t.Size) }
+	case SMART_LIMIT_GB:
+		max = int64(info.LimitValue) * GiB
+		measure = func(t *Track) int64 { return int64(t.Size) }
+	default:
+		return tracks
+	}
+	for i := range tracks {
+		total += measure(&tracks[i])
+		if total > max {
+			return tracks[:i]
+		}
+	}
+	return tracks
+}
+
+// ---------------- description ----------------
+
+var smartOpNames = map[int][2]string{
+	SMART_OP_IS:       {"is", "is not"},
+	SMART_OP_CONTAINS: {"contains", "does not contain"},
+	SMART_OP_STARTS:   {"starts with", "does not start with"},
+	SMART_OP_ENDS:     {"ends with", "does not end with"},
+	SMART_OP_GREATER:  {"is greater than", "is not greater than"},
+	SMART_OP_LESS:     {"is less than", "is not less than"},
+	SMART_OP_OTHER:    {"is in the range", "is not in the range"},
+}
+
+func smartFieldName(field int) string {
+	if name, ok := smartStringFields[field]; ok {
+		return name
+	}
+	if name, ok := smartIntFields[field]; ok {
+		return name
+	}
+	if name, ok := smartDateFields[field]; ok {
+		return name
+	}
+	return fmt.Sprintf("Field(0x%02x)", field)
+}
+
+func (r SmartRule) String() string {
+	if r.Sub != nil {
+		return "(" + r.Sub.String() + ")"
+	}
+	names, ok := smartOpNames[r.Op]
+	if !ok {
+		names = [2]string{fmt.Sprintf("op(0x%02x)", r.Op), fmt.Sprintf("not op(0x%02x)", r.Op)}
+	}
+	op := names[0]
+	if r.Negate {
+		op = names[1]
+	}
+	field := smartFieldName(r.Field)
+	if _, ok := smartStringFields[r.Field]; ok {
+		return fmt.Sprintf("%s %s %q", field, op, r.Text)
+	}
+	if r.Field == SMART_FIELD_PLAYLIST {
+		return fmt.Sprintf("%s %s %016X", field, op, uint64(r.IntA))
+	}
+	if _, ok := smartDateFields[r.Field]; ok {
+		if r.TimeMultiple > 0 && r.TimeValue != 0 {
+			if r.Negate {
+				op = "is not in the last"
+			} else {
+				op = "is in the last"
+			}
+			return fmt.Sprintf("%s %s %s", field, op, time.Duration(-r.TimeValue*r.TimeMultiple)*time.Second)
+		}
+		layout := "2006-01-02"
+		a := smartEpoch.Add(time.Duration(r.IntA) * time.Second).Format(layout)
+		if r.Op == SMART_OP_OTHER {
+			b := smartEpoch.Add(time.Duration(r.IntB) * time.Second).Format(layout)
+			return fmt.Sprintf("%s %s %s to %s", field, op, a, b)
+		}
+		return fmt.Sprintf("%s %s %s", field, op, a)
+	}
+	if r.Op == SMART_OP_OTHER {
+		return fmt.Sprintf("%s %s %d to %d", field, op, r.IntA, r.IntB)
+	}
+	return fmt.Sprintf("%s %s %d", field, op, r.IntA)
+}
+
+func (c *SmartCriteria) String() string {
+	conjunction := " AND "
+	if c.MatchAny {
+		conjunction = " OR "
+	}
+	rules := make([]string, 0, len(c.Rules))
+	for _, rule := range c.Rules {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, conjunction)
+}
+
+var smartLimitUnits = map[int]string{
+	SMART_LIMIT_MINUTES: "minutes",
+	SMART_LIMIT_MB:      "MB",
+	SMART_LIMIT_ITEMS:   "items",
+	SMART_LIMIT_HOURS:   "hours",
+	SMART_LIMIT_GB:      "GB",
+}
+
+var smartSelectionNames = map[int]string{
+	SMART_SELECT_LOWEST_RATING:   "lowest rating",
+	SMART_SELECT_RANDOM:          "random",
+	SMART_SELECT_NAME:            "name",
+	SMART_SELECT_ALBUM:           "album",
+	SMART_SELECT_ARTIST:          "artist",
+	SMART_SELECT_GENRE:           "genre",
+	SMART_SELECT_RECENTLY_ADDED:  "most recently added",
+	SMART_SELECT_OFTEN_PLAYED:    "most often played",
+	SMART_SELECT_RECENTLY_PLAYED: "most recently played",
+	SMART_SELECT_HIGHEST_RATING:  "highest rating",
+}
+
+func (info *SmartInfo) String() string {
+	if !info.LimitEnabled {
+		return "no limit"
+	}
+	selection, ok := smartSelectionNames[info.SelectionMethod]
+	if !ok {
+		selection = fmt.Sprintf("method(0x%02x)", info.SelectionMethod)
+	}
+	if info.SelectionReverse {
+		selection += " (reversed)"
+	}
+	return fmt.Sprintf("limit to %d %s selected by %s", info.LimitValue, smartLimitUnits[info.LimitType], selection)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testdata/smart_library.xml holds smart playlists over four songs, a
+// podcast and a video. The expected rules are what iTunes shows for them.
+var smartPlaylistGolden = []struct {
+	name     string
+	info     string
+	criteria string
+	tracks   []int
+}{
+	{
+		name:     "Loved Rock",
+		info:     "limit to 2 items selected by highest rating",
+		criteria: `Genre contains "rock" AND Rating is greater than 60`,
+		// limited to 2 and 3, in the order iTunes exported
+		tracks: []int{3, 2},
+	},
+	{
+		name:     "2020 or Long",
+		info:     "no limit",
+		criteria: `Date Added is in the range 2020-01-01 to 2020-12-31 OR (Time is greater than 600000 AND Name contains "Live")`,
+		// not the podcast added in 2020
+		tracks: []int{1, 2, 4},
+	},
+	{
+		name:     "Unplayed Lately",
+		info:     "no limit",
+		criteria: `Name does not contain "live" AND Last Played is not in the last 168h0m0s`,
+		// 4 is unchecked; the video was exported by iTunes
+		tracks: []int{6, 1, 3},
+	},
+}
+
+func TestSmartPlaylists(t *testing.T) {
+	library, err := LoadLibrary("testdata/smart_library.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	evalSmart := *argEvalSmart
+	*argEvalSmart = true
+	defer func() { *argEvalSmart = evalSmart }()
+
+	for _, golden := range smartPlaylistGolden {
+		playlist, ok := library.FindPlaylist(golden.name)
+		if !ok || !playlist.IsSmart() {
+			t.Fatalf("%s: not found", golden.name)
+		}
+		info, err := DecodeSmartInfo(playlist.SmartInfo)
+		if err != nil {
+			t.Fatalf("%s: %s", golden.name, err)
+		}
+		if info.String() != golden.info {
+			t.Errorf("%s: info %q, expected %q", golden.name, info, golden.info)
+		}
+		criteria, err := DecodeSmartCriteria(playlist.SmartCriteria)
+		if err != nil {
+			t.Fatalf("%s: %s", golden.name, err)
+		}
+		if criteria.String() != golden.criteria {
+			t.Errorf("%s: criteria\n%s\nexpected\n%s", golden.name, criteria, golden.criteria)
+		}
+		tracks, err := library.PlaylistTracks(playlist)
+		if err != nil {
+			t.Fatalf("%s: %s", golden.name, err)
+		}
+		ids := make([]int, 0, len(tracks))
+		for _, track := range tracks {
+			ids = append(ids, track.TrackId)
+		}
+		if !reflect.DeepEqual(ids, golden.tracks) {
+			t.Errorf("%s: tracks %v, expected %v", golden.name, ids, golden.tracks)
+		}
+	}
+}
+
+func TestSmartCriteriaBroken(t *testing.T) {
+	library, err := LoadLibrary("testdata/smart_library.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist, _ := library.FindPlaylist("Loved Rock")
+	for _, length := range []int{0, 100, len(playlist.SmartCriteria) - 1} {
+		if _, err := DecodeSmartCriteria(playlist.SmartCriteria[:length]); err == nil {
+			t.Errorf("accepted criteria cut at %d bytes", length)
+		}
+	}
+}
+
+// "Selected by random" picks the same tracks whatever order they come in
+func TestSmartSelectRandomStable(t *testing.T) {
+	info := &SmartInfo{SelectionMethod: SMART_SELECT_RANDOM}
+	tracks := func(ids ...string) []Track {
+		ret := make([]Track, 0, len(ids))
+		for _, id := range ids {
+			ret = append(ret, Track{PersistentId: id})
+		}
+		return ret
+	}
+	ids := func(tracks []Track) string {
+		ret := ""
+		for _, track := range tracks {
+			ret += track.PersistentId + " "
+		}
+		return ret
+	}
+	a := tracks("A", "B", "C", "D", "E", "F")
+	b := tracks("F", "E", "D", "C", "B", "A")
+	info.sortForSelection(a, "P1")
+	info.sortForSelection(b, "P1")
+	if ids(a) != ids(b) {
+		t.Fatalf("%s != %s", ids(a), ids(b))
+	}
+	// a new track doesn't move the others
+	c := tracks("A", "B", "C", "D", "E", "F", "G")
+	info.sortForSelection(c, "P1")
+	others := make([]Track, 0)
+	for _, track := range c {
+		if track.PersistentId != "G" {
+			others = append(others, track)
+		}
+	}
+	if ids(others) != ids(a) {
+		t.Fatalf("%s, was %s", ids(others), ids(a))
+	}
+}
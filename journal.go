@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"os"
+	"path/filepath"
+)
+
+// Write-ahead journal of a run, kept at the target while IOEngine runs.
+// The first line records the Finish steps of all actions, followed by a
+// line once every Perform succeeded and a line per finished step. If the
+// run is interrupted, the next one finds the journal before planning:
+//
+//   - interrupted while performing: nothing on the device changed but temp
+//     files, which are removed (rolled back)
+//   - interrupted while finishing: the remaining steps are replayed (rolled
+//     forward). meta.json is written by the last steps, so it matches the
+//     files again afterwards.
+//
+// Paths are relative to the journal, the device may be mounted elsewhere
+// next time.
+
+const JOURNAL_FILENAME = "iwalk-journal.jsonl"
+
+// What IOAction.Finish does to the device
+type JournalStep struct {
+	// rename, remove or prune
+	Op   string `json:"op"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+	// From is a temp file made by Perform
+	Temp bool `json:"temp,omitempty"`
+}
+
+type journalRecord struct {
+	Roots     []string      `json:"roots,omitempty"`
+	Steps     []JournalStep `json:"steps,omitempty"`
+	Performed bool          `json:"performed,omitempty"`
+	Done      *int          `json:"done,omitempty"`
+}
+
+type Journal struct {
+	path string
+	file *os.File
+}
+
+func renameStep(from, to string, temp bool) JournalStep {
+	return JournalStep{Op: "rename", From: from, To: to, Temp: temp}
+}
+
+// Starts a journal in dir, recording the Finish steps of actions
+func CreateJournal(dir string, roots []string, actions []IOAction) (*Journal, error) {
+	record := journalRecord{}
+	for _, root := range roots {
+		rel, err := filepath.Rel(dir, root)
+		if err != nil {
+			return nil, err
+		}
+		record.Roots = append(record.Roots, rel)
+	}
+	for _, action := range actions {
+		step := action.FinishStep()
+		var err error
+		if step.From != "" {
+			if step.From, err = filepath.Rel(dir, step.From); err != nil {
+				return nil, err
+			}
+		}
+		if step.To, err = filepath.Rel(dir, step.To); err != nil {
+			return nil, err
+		}
+		record.Steps = append(record.Steps, step)
+	}
+	journalPath := filepath.Join(dir, JOURNAL_FILENAME)
+	f, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{path: journalPath, file: f}
+	if err := j.append(record); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) append(record journalRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Every Perform succeeded, Finish steps begin
+func (j *Journal) MarkPerformed() error {
+	return j.append(journalRecord{Performed: true})
+}
+
+// Finish step i is done
+func (j *Journal) MarkDone(i int) error {
+	return j.append(journalRecord{Done: &i})
+}
+
+// The run completed, removes the journal
+func (j *Journal) Close() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(j.path)
+}
+
+// Rolls an interrupted run in dir back or forward, and removes its journal
+func RecoverJournal(dir string) error {
+	journalPath := filepath.Join(dir, JOURNAL_FILENAME)
+	f, err := os.Open(journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	plan, performed, done, err := readJournal(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if *argDryRun {
+		logrus.Warnf("DRYRUN: Interrupted sync found in %s, not recovering", dir)
+		return nil
+	}
+	roots := make([]string, 0, len(plan.Roots))
+	for _, root := range plan.Roots {
+		roots = append(roots, filepath.Join(dir, root))
+	}
+	if len(roots) == 0 {
+		roots = append(roots, dir)
+	}
+	for i := range plan.Steps {
+		step := &plan.Steps[i]
+		if step.From != "" {
+			step.From = filepath.Join(dir, step.From)
+		}
+		step.To = filepath.Join(dir, step.To)
+		for _, p := range []string{step.From, step.To} {
+			if p == "" {
+				continue
+			}
+			if err := checkContained(roots, p); err != nil {
+				return fmt.Errorf("Broken %s: %s", journalPath, err)
+			}
+		}
+	}
+	if !performed {
+		logrus.Warnf("Interrupted sync found, rolling back (removing temp files)")
+		for _, step := range plan.Steps {
+			if step.Temp {
+				if err := os.Remove(step.From); err != nil && !os.IsNotExist(err) {
+					logrus.Warnf("Cannot remove %s: %s", step.From, err)
+				}
+			}
+		}
+	} else {
+		left := 0
+		for i := range plan.Steps {
+			if !done[i] {
+				left += 1
+			}
+		}
+		logrus.Warnf("Interrupted sync found, finishing it (%d of %d steps left)", left, len(plan.Steps))
+		for i, step := range plan.Steps {
+			if done[i] {
+				continue
+			}
+			if err := step.replay(); err != nil {
+				logrus.Warnf("Recovery step failed: %s %s -> %s: %s", step.Op, step.From, step.To, err)
+			}
+		}
+	}
+	return os.Remove(journalPath)
+}
+
+// Plan, whether performing completed, and finished steps. A torn last line
+// is ignored.
+func readJournal(f *os.File) (journalRecord, bool, map[int]bool, error) {
+	var plan journalRecord
+	performed := false
+	done := make(map[int]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*KiB), 256*MiB)
+	first := true
+	for scanner.Scan() {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			if first {
+				// torn while writing the plan, nothing was performed yet
+				logrus.Warnf("Broken journal %s: %s", f.Name(), err)
+			}
+			break
+		}
+		switch {
+		case first:
+			plan = record
+			first = false
+		case record.Performed:
+			performed = true
+		case record.Done != nil:
+			done[*record.Done] = true
+		}
+	}
+	return plan, performed, done, scanner.Err()
+}
+
+// Redoes the step, if it's not done yet
+func (s JournalStep) replay() error {
+	switch s.Op {
+	case "rename":
+		if !isFileExists(s.From) {
+			if !isFileExists(s.To) {
+				return fmt.Errorf("both are missing")
+			}
+			return nil // renamed, but interrupted before marking it done
+		}
+		if err := os.MkdirAll(filepath.Dir(s.To), 0775); err != nil {
+			return err
+		}
+		return os.Rename(s.From, s.To)
+	case "remove":
+		if err := os.Remove(s.To); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case "prune":
+		if !isFileExists(s.To) {
+			return nil
+		}
+		_, err := pruneEmptyDirs(s.To, true)
+		return err
+	}
+	return fmt.Errorf("unknown journal op: %s", s.Op)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Mix synced as 1.mp3=A 2.mp3=B 3.mp3=C, then reordered to B A D: A and B
+// swap through temp names, C is deleted before D is copied onto 3.mp3
+func newJournalTestSync(t *testing.T, dir string) (*Library, string, *SyncOptions) {
+	sinkPath := path.Join(dir, "sink")
+	os.MkdirAll(sinkPath, 0755)
+	library := &Library{
+		Tracks:    make(map[string]Track),
+		Playlists: []Playlist{{Name: "Mix", PlaylistPersistentId: "P1", PlaylistItems: []PlaylistItem{{TrackId: 1}, {TrackId: 2}, {TrackId: 3}}}},
+	}
+	for i, name := range []string{"A", "B", "C", "D"} {
+		src := path.Join(dir, name+".mp3")
+		ioutil.WriteFile(src, []byte(name), 0644)
+		library.Tracks[string('1'+rune(i))] = Track{TrackId: i + 1, Name: name, PersistentId: "T" + name, Location: fileLocation(src), DateModified: time.Unix(100, 0)}
+	}
+	library.buildIndex()
+	options := &SyncOptions{Playlists: []string{"Mix"}, FileNameTemplate: "{{.Number}}"}
+	if err := startSync(library, sinkPath, options); err != nil {
+		t.Fatal(err)
+	}
+	library.Playlists[0].PlaylistItems = []PlaylistItem{{TrackId: 2}, {TrackId: 1}, {TrackId: 4}}
+	library.buildIndex()
+	return library, sinkPath, options
+}
+
+// Files in the sink dir and their contents, and whether meta.json lists them
+func journalTestState(t *testing.T, sinkPath string) string {
+	dirPath := path.Join(sinkPath, "Mix")
+	data, err := ioutil.ReadFile(path.Join(dirPath, META_JSON_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sinkDir SinkDir
+	if err := json.Unmarshal(data, &sinkDir); err != nil {
+		t.Fatalf("meta.json: %s", err)
+	}
+	files := make([]string, 0)
+	for id, meta := range sinkDir.Tracks {
+		content, err := ioutil.ReadFile(path.Join(dirPath, meta.FileName))
+		if err != nil || "T"+string(content) != id {
+			t.Errorf("meta.json lists %s as %s, has %q", meta.FileName, id, content)
+		}
+	}
+	infos, _ := ioutil.ReadDir(dirPath)
+	for _, info := range infos {
+		if info.Name() == META_JSON_FILENAME {
+			continue
+		}
+		content, _ := ioutil.ReadFile(path.Join(dirPath, info.Name()))
+		files = append(files, info.Name()+"="+string(content))
+	}
+	sort.Strings(files)
+	if len(files) != len(sinkDir.Tracks) {
+		t.Errorf("meta.json lists %d tracks, %v on the device", len(sinkDir.Tracks), files)
+	}
+	return strings.Join(files, " ")
+}
+
+func TestRecoverJournal(t *testing.T) {
+	const OLD_STATE = "1.mp3=A 2.mp3=B 3.mp3=C"
+	const NEW_STATE = "1.mp3=B 2.mp3=A 3.mp3=D"
+	// stage: "plan" (torn while writing it), "perform", "performed", or
+	// the number of Finish steps done before the interruption
+	type stage struct {
+		name     string
+		finished int
+	}
+	stages := []stage{{"plan", -1}, {"perform", -1}, {"performed", 0}}
+	dir, err := ioutil.TempDir("", "iwalk-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	library, sinkPath, options := newJournalTestSync(t, dir)
+	steps := len(journalTestActions(t, library, sinkPath, options))
+	os.RemoveAll(dir)
+	for i := 1; i <= steps; i++ {
+		stages = append(stages, stage{"finishing", i})
+	}
+
+	for _, s := range stages {
+		dir, err := ioutil.TempDir("", "iwalk-journal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		library, sinkPath, options := newJournalTestSync(t, dir)
+		actions := journalTestActions(t, library, sinkPath, options)
+		journal, err := CreateJournal(sinkPath, []string{sinkPath}, actions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := NEW_STATE
+		switch s.name {
+		case "plan":
+			expected = OLD_STATE
+			journal.file.Close()
+			st, _ := os.Stat(journal.path)
+			os.Truncate(journal.path, st.Size()/2)
+		case "perform":
+			expected = OLD_STATE
+			for _, action := range actions {
+				if err := action.Perform(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			journal.file.Close()
+		default:
+			for _, action := range actions {
+				if err := action.Perform(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			journal.MarkPerformed()
+			for i := 0; i < s.finished; i++ {
+				if err := actions[i].Finish(); err != nil {
+					t.Fatal(err)
+				}
+				// the last one done is not marked, its mark is torn
+				if i < s.finished-1 {
+					journal.MarkDone(i)
+				}
+			}
+			journal.file.WriteString(`{"do`)
+			journal.file.Close()
+		}
+
+		if err := RecoverJournal(sinkPath); err != nil {
+			t.Fatalf("%s %d: %s", s.name, s.finished, err)
+		}
+		if isFileExists(path.Join(sinkPath, JOURNAL_FILENAME)) {
+			t.Fatalf("%s %d: journal left", s.name, s.finished)
+		}
+		if state := journalTestState(t, sinkPath); state != expected {
+			t.Errorf("%s %d: %s, expected %s", s.name, s.finished, state, expected)
+		}
+		// the next sync completes the change
+		if err := startSync(library, sinkPath, options); err != nil {
+			t.Fatalf("%s %d: %s", s.name, s.finished, err)
+		}
+		if state := journalTestState(t, sinkPath); state != NEW_STATE {
+			t.Errorf("%s %d: after sync %s", s.name, s.finished, state)
+		}
+	}
+}
+
+// Actions of the reorder, in the order they finish
+func journalTestActions(t *testing.T, library *Library, sinkPath string, options *SyncOptions) []IOAction {
+	ctx, err := newSyncContext(library, sinkPath, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist, _ := library.FindPlaylist("Mix")
+	plan, err := ctx.plan([]*Playlist{playlist}, [][]string{nil}, map[string]bool{"Mix": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.engine.orderFinishes(); err != nil {
+		t.Fatal(err)
+	}
+	actions := make([]IOAction, 0)
+	temps := 0
+	for action := plan.engine.actions.Front(); action != nil; action = action.Next() {
+		act := action.Value.(IOAction)
+		if step := act.FinishStep(); strings.HasPrefix(filepath.Base(step.To), ".iwalk-rename-") {
+			temps += 1
+		}
+		actions = append(actions, act)
+	}
+	if temps != 2 {
+		t.Fatalf("swap not through temp names: %v", actions)
+	}
+	return actions
+}
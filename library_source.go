@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// LibrarySource provides playlists and tracks to be synced.
+// iTunes Library implements this, and other music managers can feed the
+// planner by implementing it too.
+type LibrarySource interface {
+	// All playlists in the source
+	ListPlaylists() []*Playlist
+	// Finds playlist by its name
+	FindPlaylist(name string) (*Playlist, bool)
+	// Resolves tracks of the playlist, in playlist order.
+	// Tracks must have stable PersistentId, DateModified and Location(file URL).
+	PlaylistTracks(playlist *Playlist) ([]Track, error)
+	// Finds track by its PersistentId
+	FindTrack(persistentId string) (*Track, bool)
+}
+
+// Derives iTunes-like persistent ID for sources which have no stable ID of
+// their own, so that meta.json keeps tracking the same track across syncs.
+func derivePersistentId(key string) string {
+	digest := sha1.Sum([]byte(key))
+	return strings.ToUpper(hex.EncodeToString(digest[:8]))
+}
+
+// Shuffles tracks by a digest of the playlist and each track, like
+// Rhythmbox "Random": the same tracks are picked on every sync
+func stableShuffleTracks(tracks []Track, playlistId string) {
+	keys := make(map[string]string, len(tracks))
+	for _, track := range tracks {
+		keys[track.PersistentId] = derivePersistentId(playlistId + "\x00" + track.PersistentId)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return keys[tracks[i].PersistentId] < keys[tracks[j].PersistentId]
+	})
+}
+
+// file:// URL for Track.Location
+func fileLocation(filePath string) string {
+	u := url.URL{Scheme: "file", Path: filePath}
+	return u.String()
+}
+
+// Names of folders containing the playlist, outermost first
+func playlistFolderPath(source LibrarySource, playlist *Playlist) []string {
+	byId := make(map[string]*Playlist)
+	for _, p := range source.ListPlaylists() {
+		byId[p.PlaylistPersistentId] = p
+	}
+	folders := make([]string, 0)
+	seen := make(map[string]bool)
+	for parentId := playlist.ParentPersistentId; parentId != "" && !seen[parentId]; {
+		seen[parentId] = true
+		folder, ok := byId[parentId]
+		if !ok {
+			logrus.Warnf("Parent folder %s of %s not found", parentId, playlist.Name)
+			break
+		}
+		folders = append([]string{folder.Name}, folders...)
+		parentId = folder.ParentPersistentId
+	}
+	return folders
+}
+
+// Finds playlist by name, persistent ID, or by path with folders
+// ("Folder/Sub/Playlist")
+func resolvePlaylist(source LibrarySource, ref string) (*Playlist, bool) {
+	if playlist, ok := source.FindPlaylist(ref); ok && !playlist.Folder {
+		return playlist, true
+	}
+	for _, playlist := range source.ListPlaylists() {
+		if playlist.Folder {
+			continue
+		}
+		if strings.EqualFold(playlist.PlaylistPersistentId, ref) {
+			return playlist, true
+		}
+		if playlist.ParentPersistentId != "" && path.Join(append(playlistFolderPath(source, playlist), playlist.Name)...) == ref {
+			return playlist, true
+		}
+	}
+	return nil, false
+}
+
+// Paths of all playlists under the folder (name or path), recursively
+func folderPlaylistRefs(source LibrarySource, folderRef string) ([]string, error) {
+	var folderId string
+	for _, playlist := range source.ListPlaylists() {
+		if !playlist.Folder {
+			continue
+		}
+		if playlist.Name == folderRef || path.Join(append(playlistFolderPath(source, playlist), playlist.Name)...) == folderRef {
+			if folderId != "" {
+				return nil, fmt.Errorf("Folder name '%s' is ambiguous, use its path", folderRef)
+			}
+			folderId = playlist.PlaylistPersistentId
+		}
+	}
+	if folderId == "" {
+		return nil, fmt.Errorf("Playlist folder '%s' not found in library", folderRef)
+	}
+	byId := make(map[string]*Playlist)
+	for _, p := range source.ListPlaylists() {
+		byId[p.PlaylistPersistentId] = p
+	}
+	refs := make([]string, 0)
+	for _, playlist := range source.ListPlaylists() {
+		if playlist.Folder {
+			continue
+		}
+		seen := make(map[string]bool)
+		for parentId := playlist.ParentPersistentId; parentId != "" && !seen[parentId]; {
+			if parentId == folderId {
+				refs = append(refs, path.Join(append(playlistFolderPath(source, playlist), playlist.Name)...))
+				break
+			}
+			seen[parentId] = true
+			parent, ok := byId[parentId]
+			if !ok {
+				break
+			}
+			parentId = parent.ParentPersistentId
+		}
+	}
+	return refs, nil
+}
+
+func openLibrarySource(conf *SourceConfig) (LibrarySource, error) {
+	switch conf.Type {
+	case "", "itunes":
+		libPath, ok := findLibraryPath(conf.Path)
+		if !ok {
+			return nil, errors.New("Library.xml not found!")
+		}
+		logrus.Infof("Library: %s", libPath)
+		lib, err := LoadLibrary(libPath)
+		if err != nil {
+			return nil, err
+		}
+		return lib, nil
+	case "rhythmbox":
+		dbPath, playlistsPath := defaultRhythmboxPaths()
+		if conf.Path != "" {
+			dbPath = os.ExpandEnv(conf.Path)
+		}
+		if conf.PlaylistsPath != "" {
+			playlistsPath = os.ExpandEnv(conf.PlaylistsPath)
+		}
+		cacheDir := defaultCacheDir()
+		if conf.CacheDir != "" {
+			cacheDir = os.ExpandEnv(conf.CacheDir)
+		}
+		logrus.Infof("Rhythmbox: %s, %s", dbPath, playlistsPath)
+		lib, err := LoadRhythmboxLibrary(dbPath, playlistsPath, cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		return lib, nil
+	case "playlist_files":
+		if conf.Path == "" {
+			return nil, errors.New("source.path is required for playlist_files")
+		}
+		logrus.Infof("Playlist files: %s", conf.Path)
+		source, err := LoadPlaylistFileSource(os.ExpandEnv(conf.Path))
+		if err != nil {
+			return nil, err
+		}
+		return source, nil
+	case "directory":
+		if conf.Path == "" {
+			return nil, errors.New("source.path is required for directory")
+		}
+		lib, err := ScanDirectoryLibrary(os.ExpandEnv(conf.Path), conf.GroupBy, os.ExpandEnv(conf.CacheDir))
+		if err != nil {
+			return nil, err
+		}
+		return lib, nil
+	case "beets":
+		dbPath := defaultBeetsLibraryPath()
+		if conf.Path != "" {
+			dbPath = os.ExpandEnv(conf.Path)
+		}
+		logrus.Infof("beets: %s", dbPath)
+		source, err := LoadBeetsSource(dbPath, conf.Queries)
+		if err != nil {
+			return nil, err
+		}
+		return source, nil
+	case "subsonic":
+		if conf.URL == "" {
+			return nil, errors.New("source.url is required for subsonic")
+		}
+		cacheDir := defaultCacheDir()
+		if conf.CacheDir != "" {
+			cacheDir = os.ExpandEnv(conf.CacheDir)
+		}
+		logrus.Infof("Subsonic: %s (cache: %s)", conf.URL, cacheDir)
+		client := &SubsonicClient{
+			BaseURL:  conf.URL,
+			User:     conf.User,
+			Password: os.ExpandEnv(conf.Password),
+		}
+		source, err := NewSubsonicSource(client, cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		return source, nil
+	case "mpd":
+		address, password := defaultMPDAddress()
+		if conf.Address != "" {
+			address = conf.Address
+		}
+		if conf.Password != "" {
+			password = os.ExpandEnv(conf.Password)
+		}
+		musicDir := os.ExpandEnv(conf.MusicDirectory)
+		if musicDir == "" {
+			musicDir = path.Join(os.Getenv("HOME"), "Music")
+		}
+		logrus.Infof("MPD: %s (music_directory: %s)", address, musicDir)
+		lib, err := LoadMPDLibrary(address, password, musicDir)
+		if err != nil {
+			return nil, err
+		}
+		return lib, nil
+	default:
+		return nil, fmt.Errorf("Unknown library source type: %s", conf.Type)
+	}
+}
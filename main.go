@@ -7,6 +7,7 @@ import (
 	"github.com/cloudfoundry-incubator/candiedyaml"
 	"os"
 	"path"
+	"strings"
 )
 
 var (
@@ -16,16 +17,137 @@ var (
 	argDebug           *bool   = flag.Bool("vv", false, "More verbose output(Debug output)")
 	argDryRun          *bool   = flag.Bool("dryrun", false, "DryRun mode")
 	argPrintLibSummary *bool   = flag.Bool("print_library", false, "Print iTunes Library summary and exit with do nothing.")
+	argEvalSmart       *bool   = flag.Bool("eval_smart", true, "Evaluate iTunes smart playlist rules, as the tracks saved by iTunes go stale (-eval_smart=false uses them)")
+	argVerifyWrites    *bool   = flag.Bool("verify_writes", false, "Read copied files back from the device and compare checksums")
+	argRepair          *bool   = flag.Bool("repair", false, "With 'verify', sync again copying broken tracks")
+	argRebuild         *bool   = flag.Bool("rebuild", false, "With 'adopt', also replace existing meta.json")
+	argAdoptHash       *bool   = flag.Bool("adopt_hash", false, "With 'adopt', match files by comparing contents with the library files")
+	argUnmatched       *string = flag.String("unmatched", "keep", "With 'adopt', what to do with files not matched: keep, delete or ignore")
 )
 
+const CONFIG_PATH = "$HOME/.config/iwalk.yaml"
+
 type Config struct {
+	Source SourceConfig `yaml:"source"`
+	// Playlist names, paths like "Folder/Playlist", or persistent IDs.
+	// IDs keep working when the playlist is renamed.
 	Playlists []string `yaml:"playlists"`
+	// Playlist folders to sync with every playlist under them
+	Folders []string `yaml:"folders"`
+	// Playlists defined by query, synced along with Playlists
+	DynamicPlaylists []DynamicPlaylistConfig `yaml:"dynamic_playlists"`
+	// Converts lossless or large tracks while syncing, if given
+	Transcode *TranscodeConfig `yaml:"transcode"`
+	// Write "<playlist>.m3u8" into each playlist directory
+	PlaylistFiles bool `yaml:"playlist_files"`
+	// With playlist_files, name files without the "0001 " order prefix
+	DropNumberPrefix bool `yaml:"drop_number_prefix"`
+	// "playlist"(default): a directory per playlist, "pool": each track
+	// stored once in a shared directory, playlists as M3U8 files
+	Layout string `yaml:"layout"`
+	// Name of files in playlist directories, Go text/template over Track
+	// fields plus .Index and .Number, may contain "/" for subdirectories:
+	// "{{or .AlbumArtist .Artist}}/{{.Album}}/{{printf \"%02d\" .TrackNumber}} {{.Name}}"
+	FileNameTemplate string `yaml:"filename_template"`
+	// Templates for specific playlists (by name, path or persistent ID)
+	FileNameTemplates map[string]string `yaml:"filename_templates"`
+	// Naming rules of the device: fat32, exfat, hfsplus or ext4 (default: detected),
+	// may be set per target
+	Filesystem string `yaml:"filesystem"`
+	// Files copied or converted at once (default 2), may be set per target
+	Concurrency int `yaml:"concurrency"`
+	// Leaves tracks off when the device is full
+	Capacity *CapacityConfig `yaml:"capacity"`
+	// Settings of each target, overriding the ones above. Keyed by the
+	// target path, the device mount point, or a directory name in the path:
+	//
+	//	targets:
+	//	  /Volumes/WALKMAN:
+	//	    concurrency: 1      # slow SD card
+	//	  SDCARD:
+	//	    filesystem: exfat
+	//	    concurrency: 4
+	Targets map[string]TargetConfig `yaml:"targets"`
+}
+
+type TargetConfig struct {
+	Filesystem  string `yaml:"filesystem"`
+	Concurrency int    `yaml:"concurrency"`
+}
+
+// Settings of the target at targetPath: the exact path, then the longest
+// mount point containing it, then the deepest directory name in the path
+func (c *Config) targetConfig(targetPath string) (TargetConfig, bool) {
+	targetPath = path.Clean(targetPath)
+	if target, ok := c.Targets[targetPath]; ok {
+		return target, true
+	}
+	best := ""
+	for key := range c.Targets {
+		if strings.HasPrefix(targetPath, path.Clean(key)+"/") && len(key) > len(best) {
+			best = key
+		}
+	}
+	if best != "" {
+		return c.Targets[best], true
+	}
+	names := strings.Split(targetPath, "/")
+	for i := len(names) - 1; i >= 0; i-- {
+		if target, ok := c.Targets[names[i]]; ok && names[i] != "" {
+			return target, true
+		}
+	}
+	return TargetConfig{}, false
 }
 
-func findLibraryPath() (string, bool) {
+// Where to read playlists and tracks from
+type SourceConfig struct {
+	// itunes(default), rhythmbox, playlist_files, directory, beets, subsonic, mpd
+	Type string `yaml:"type"`
+	// Library database path (iTunes Music Library.xml, rhythmdb.xml, library.db),
+	// playlist directory for playlist_files or music root for directory
+	Path string `yaml:"path"`
+	// Playlist definitions path, if the source keeps them apart (playlists.xml)
+	PlaylistsPath string `yaml:"playlists_path"`
+	// directory: make playlists per top-level "folder"(default) or per "album"
+	GroupBy string `yaml:"group_by"`
+	// beets: playlist name -> beets query ("genre:jazz year:1960..1969")
+	Queries map[string]string `yaml:"queries"`
+	// subsonic: server URL and credentials ($ENV_VAR is expanded in password)
+	URL      string `yaml:"url"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// mpd: "host:port" or unix socket path (default: $MPD_HOST or localhost:6600),
+	// and music_directory of mpd.conf to resolve song paths
+	Address        string `yaml:"address"`
+	MusicDirectory string `yaml:"music_directory"`
+	// Where to keep scan results, downloads and Rhythmbox playlist IDs (default: ~/.cache/iwalk)
+	CacheDir string `yaml:"cache_dir"`
+}
+
+func loadConfig() (*Config, error) {
+	confFp, err := os.Open(os.ExpandEnv(CONFIG_PATH))
+	if err != nil {
+		return nil, fmt.Errorf("Config not found: %s", err)
+	}
+	defer confFp.Close()
+	decoder := candiedyaml.NewDecoder(confFp)
+	var config Config
+	err = decoder.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse config: %s", err)
+	}
+	return &config, nil
+}
+
+func findLibraryPath(configured string) (string, bool) {
 	logrus.Debugf("Finding library...")
 	ret := *argLibraryPath
 	logrus.Debugf("Checking argument: %s", *argLibraryPath)
+	if ret == "" && configured != "" {
+		logrus.Debugf("Checking config: %s", configured)
+		ret = os.ExpandEnv(configured)
+	}
 	if ret == "" {
 		defaultLibPath := defaultLibraryPath()
 		logrus.Debugf("Checking default library: %s", defaultLibPath)
@@ -41,8 +163,12 @@ func findLibraryPath() (string, bool) {
 }
 
 func isValidWalkmanDevice(devicePath string) bool {
-	return isFileExists(path.Join(devicePath, "capability_00.xml")) ||
-		isFileExists(path.Join(devicePath, "default-capability.xml"))
+	for _, name := range WALKMAN_CAPABILITY_FILES {
+		if isFileExists(path.Join(devicePath, name)) {
+			return true
+		}
+	}
+	return false
 }
 
 func findTargetPath() (string, bool) {
@@ -62,14 +188,69 @@ func findTargetPath() (string, bool) {
 	}
 }
 
-func printLibrarySummary(libPath string) {
-	l, err := LoadLibrary(libPath)
+func printLibrarySummary(source LibrarySource) {
+	fmt.Println("-------- Playlists ------------")
+	for _, playlist := range source.ListPlaylists() {
+		name := path.Join(append(playlistFolderPath(source, playlist), playlist.Name)...)
+		if playlist.Folder {
+			fmt.Printf("%s/ (folder)\n", name)
+			continue
+		}
+		tracks, err := source.PlaylistTracks(playlist)
+		if err != nil {
+			logrus.Warnf("Failed to resolve tracks of %s: %s", playlist.Name, err)
+			continue
+		}
+		fmt.Printf("%s: %d tracks [%s]\n", name, len(tracks), playlist.PlaylistPersistentId)
+		if playlist.IsSmart() {
+			printSmartRules(playlist)
+		}
+	}
+}
+
+func mapValues(m map[string]string) []string {
+	ret := make([]string, 0, len(m))
+	for _, value := range m {
+		ret = append(ret, value)
+	}
+	return ret
+}
+
+// Appends names not in list yet
+func appendMissing(list []string, names []string) []string {
+	ret := append([]string{}, list...)
+	for _, name := range names {
+		found := false
+		for _, existing := range list {
+			if existing == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+func printSmartRules(playlist *Playlist) {
+	info, err := DecodeSmartInfo(playlist.SmartInfo)
 	if err != nil {
-		logrus.Fatalf("Failed to load library", err)
+		fmt.Printf("    (undecodable smart info: %s)\n", err)
+		return
 	}
-	fmt.Println("-------- Playlists ------------")
-	for _, playlist := range l.Playlists {
-		fmt.Printf("%s: %d tracks\n", playlist.Name, len(playlist.PlaylistItems))
+	criteria, err := DecodeSmartCriteria(playlist.SmartCriteria)
+	if err != nil {
+		fmt.Printf("    (undecodable smart criteria: %s)\n", err)
+		return
+	}
+	if info.MatchEnabled {
+		fmt.Printf("    match: %s\n", criteria)
+	}
+	fmt.Printf("    %s\n", info)
+	if info.OnlyChecked {
+		fmt.Println("    only checked items")
 	}
 }
 
@@ -82,25 +263,41 @@ func main() {
 	if *argDebug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-	libPath, ok := findLibraryPath()
-	if !ok {
-		logrus.Fatalf("Library.xml not found!")
-	} else {
-		logrus.Infof("Library: %s", libPath)
-	}
-	if *argPrintLibSummary {
-		printLibrarySummary(libPath)
-		return
+	// a mistyped subcommand must not fall back to syncing
+	if flag.NArg() > 1 || (flag.NArg() == 1 && flag.Arg(0) != "adopt" && flag.Arg(0) != "verify") {
+		logrus.Fatalf("Usage: iwalk [flags] [adopt|verify], got: %s", strings.Join(flag.Args(), " "))
 	}
-	confFp, err := os.Open(os.ExpandEnv("$HOME/.config/iwalk.yaml"))
+	config, err := loadConfig()
 	if err != nil {
-		logrus.Fatalf("Config not found: %s", err)
+		if !*argPrintLibSummary {
+			logrus.Fatalf("%s", err)
+		}
+		logrus.Infof("%s: using default library", err)
+		config = &Config{}
 	}
-	decoder := candiedyaml.NewDecoder(confFp)
-	var config Config
-	err = decoder.Decode(&config)
+	lib, err := openLibrarySource(&config.Source)
 	if err != nil {
-		logrus.Fatalf("Could not parse config: %s", err)
+		logrus.Fatalf("Failed to load library: %s", err)
+	}
+	playlists := config.Playlists
+	if len(config.DynamicPlaylists) > 0 {
+		dynamicSource, err := NewDynamicPlaylistSource(lib, config.DynamicPlaylists)
+		if err != nil {
+			logrus.Fatalf("%s", err)
+		}
+		lib = dynamicSource
+		playlists = appendMissing(playlists, dynamicSource.Names())
+	}
+	for _, folder := range config.Folders {
+		refs, err := folderPlaylistRefs(lib, folder)
+		if err != nil {
+			logrus.Fatalf("%s", err)
+		}
+		playlists = appendMissing(playlists, refs)
+	}
+	if *argPrintLibSummary {
+		printLibrarySummary(lib)
+		return
 	}
 	targetPath, ok := findTargetPath()
 	if !ok {
@@ -108,11 +305,114 @@ func main() {
 	} else {
 		logrus.Infof("Target: %s", targetPath)
 	}
-	logrus.Infof("Playlists: %v", config.Playlists)
+	logrus.Infof("Playlists: %v", playlists)
 	if *argDryRun {
 		logrus.Infof("============ DRYRUN Mode ==============")
 	}
-	err = startSync(libPath, targetPath, config.Playlists)
+	target, ok := config.targetConfig(targetPath)
+	if ok {
+		if target.Filesystem != "" {
+			config.Filesystem = target.Filesystem
+		}
+		if target.Concurrency > 0 {
+			config.Concurrency = target.Concurrency
+		}
+	}
+	options := &SyncOptions{
+		Playlists:         playlists,
+		PlaylistFiles:     config.PlaylistFiles,
+		DropNumberPrefix:  config.DropNumberPrefix,
+		Layout:            config.Layout,
+		Concurrency:       config.Concurrency,
+		FileNameTemplate:  config.FileNameTemplate,
+		FileNameTemplates: config.FileNameTemplates,
+	}
+	for _, text := range append([]string{config.FileNameTemplate}, mapValues(config.FileNameTemplates)...) {
+		if _, err := parseFileNameTemplate(text); err != nil {
+			logrus.Fatalf("%s", err)
+		}
+	}
+	if config.Filesystem != "" {
+		options.Filesystem, err = FindFilesystemProfile(config.Filesystem)
+		if err != nil {
+			logrus.Fatalf("%s", err)
+		}
+	}
+	if config.Capacity != nil {
+		if config.Capacity.Reserve != "" {
+			reserve, ok := parseSize(config.Capacity.Reserve)
+			if !ok {
+				logrus.Fatalf("Invalid capacity reserve: %s (e.g. 500MB)", config.Capacity.Reserve)
+			}
+			options.Reserve = reserve
+		}
+		if drop := config.Capacity.Drop; drop != "" && drop != "priority" && drop != "rating" {
+			logrus.Fatalf("Unknown capacity drop order: %s (priority or rating)", drop)
+		}
+		options.Priorities = config.Capacity.Priorities
+		options.DropOrder = config.Capacity.Drop
+	}
+	if options.Layout != "" && options.Layout != "playlist" && options.Layout != "pool" {
+		logrus.Fatalf("Unknown layout: %s (playlist or pool)", options.Layout)
+	}
+	if config.Transcode != nil {
+		options.Transcode, err = NewTranscodeProfile(config.Transcode)
+		if err != nil {
+			logrus.Fatalf("%s", err)
+		}
+		logrus.Infof("Transcode: %s", options.Transcode.Name)
+	}
+	if capability, ok := FindWalkmanCapability(targetPath); ok {
+		logrus.Infof("Capability: %s (%s)", capability.Path, capability)
+		options.Capability = capability
+		// syncing into the music folder, podcasts and audiobooks go next to it
+		if path.Dir(capability.Path) == path.Dir(targetPath) && strings.EqualFold(path.Base(targetPath), capability.Folder("music")) {
+			options.DeviceRoot = path.Dir(targetPath)
+		}
+		if options.Transcode != nil && !capability.CanPlayProfile(options.Transcode) {
+			logrus.Warnf("Transcode profile %s is not supported by the device", options.Transcode.Name)
+		}
+	}
+	if flag.Arg(0) == "adopt" {
+		if *argUnmatched != "keep" && *argUnmatched != "delete" && *argUnmatched != "ignore" {
+			logrus.Fatalf("Unknown -unmatched: %s (keep, delete or ignore)", *argUnmatched)
+		}
+		err = startAdopt(lib, targetPath, options, &AdoptOptions{
+			Rebuild:   *argRebuild,
+			Hash:      *argAdoptHash,
+			Unmatched: *argUnmatched,
+		})
+		if err != nil {
+			logrus.Fatalf("Error: %s", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "verify" {
+		if options.Filesystem == nil {
+			options.Filesystem = DetectFilesystemProfile(targetPath)
+		}
+		sinkPaths := []string{targetPath}
+		if options.DeviceRoot != "" {
+			for _, kind := range []string{"podcast", "audiobook"} {
+				if kindPath := path.Join(options.DeviceRoot, options.Capability.Folder(kind)); isFileExists(kindPath) {
+					sinkPaths = append(sinkPaths, kindPath)
+				}
+			}
+		}
+		result, err := verifySinks(sinkPaths, options.Filesystem)
+		if err != nil {
+			logrus.Fatalf("Error: %s", err)
+		}
+		printVerifyResult(result)
+		if len(result.Problems) == 0 {
+			return
+		}
+		if !*argRepair {
+			os.Exit(1)
+		}
+		options.Repair = result.BrokenPaths()
+	}
+	err = startSync(lib, targetPath, options)
 	if err != nil {
 		logrus.Fatalf("Error: %s", err)
 	}
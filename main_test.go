@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTargetConfig(t *testing.T) {
+	config := &Config{
+		Concurrency: 2,
+		Targets: map[string]TargetConfig{
+			"/Volumes/WALKMAN/MUSIC": {Concurrency: 1},
+			"/Volumes/WALKMAN":       {Concurrency: 3},
+			"/media":                 {Concurrency: 5},
+			"SDCARD":                 {Filesystem: "exfat", Concurrency: 4},
+			"MUSIC":                  {Concurrency: 6},
+		},
+	}
+	cases := []struct {
+		target      string
+		concurrency int
+	}{
+		{"/Volumes/WALKMAN/MUSIC/", 1},
+		{"/Volumes/WALKMAN/PODCASTS", 3},
+		// a mount point goes before a directory name
+		{"/media/user/SDCARD/MUSIC", 5},
+		{"/mnt/SDCARD/Music", 4},
+		{"/mnt/PLAYER/MUSIC", 6},
+		{"/mnt/PLAYER", 0},
+	}
+	for _, c := range cases {
+		target, ok := config.targetConfig(c.target)
+		if ok != (c.concurrency != 0) || target.Concurrency != c.concurrency {
+			t.Errorf("%s: %+v %t, expected concurrency %d", c.target, target, ok, c.concurrency)
+		}
+	}
+}
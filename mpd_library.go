@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stored playlists of MPD as a source. Only the small subset of the MPD
+// protocol needed to read playlists is implemented.
+
+const MPD_DEFAULT_ADDRESS = "localhost:6600"
+const MPD_TIMEOUT = 30 * time.Second
+
+type mpdClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// A response line, "key: value"
+type mpdAttr struct {
+	Key   string
+	Value string
+}
+
+// "host:port", or path of unix socket
+func dialMPD(address string) (*mpdClient, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, address, MPD_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newMPDClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func newMPDClient(conn net.Conn) (*mpdClient, error) {
+	client := &mpdClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+	conn.SetDeadline(time.Now().Add(MPD_TIMEOUT))
+	greeting, err := client.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "OK MPD ") {
+		return nil, fmt.Errorf("Not an MPD server: %s", strings.TrimSpace(greeting))
+	}
+	return client, nil
+}
+
+func (c *mpdClient) Close() error {
+	return c.conn.Close()
+}
+
+func quoteMPDArg(arg string) string {
+	arg = strings.Replace(arg, "\\", "\\\\", -1)
+	arg = strings.Replace(arg, "\"", "\\\"", -1)
+	return "\"" + arg + "\""
+}
+
+// Sends a command and reads attributes until OK
+func (c *mpdClient) command(name string, args ...string) ([]mpdAttr, error) {
+	line := name
+	for _, arg := range args {
+		line += " " + quoteMPDArg(arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(MPD_TIMEOUT))
+	if _, err := fmt.Fprintf(c.conn, "%s\n", line); err != nil {
+		return nil, err
+	}
+	attrs := make([]mpdAttr, 0)
+	for {
+		resp, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		resp = strings.TrimRight(resp, "\n")
+		switch {
+		case resp == "OK":
+			return attrs, nil
+		case strings.HasPrefix(resp, "ACK "):
+			return nil, fmt.Errorf("MPD %s: %s", name, strings.TrimPrefix(resp, "ACK "))
+		}
+		kv := strings.SplitN(resp, ": ", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("MPD %s: malformed response %q", name, resp)
+		}
+		attrs = append(attrs, mpdAttr{Key: kv[0], Value: kv[1]})
+	}
+}
+
+// Splits attributes into records, each starting with the given key
+func splitMPDRecords(attrs []mpdAttr, firstKey string) []map[string]string {
+	records := make([]map[string]string, 0)
+	for _, attr := range attrs {
+		if attr.Key == firstKey {
+			records = append(records, make(map[string]string))
+		}
+		if len(records) == 0 {
+			continue
+		}
+		record := records[len(records)-1]
+		if _, ok := record[attr.Key]; !ok {
+			record[attr.Key] = attr.Value
+		}
+	}
+	return records
+}
+
+// MPD_HOST may be "password@host"
+func defaultMPDAddress() (string, string) {
+	host, port := os.Getenv("MPD_HOST"), os.Getenv("MPD_PORT")
+	password := ""
+	if at := strings.LastIndex(host, "@"); at > 0 {
+		password, host = host[:at], host[at+1:]
+	}
+	if host == "" {
+		return MPD_DEFAULT_ADDRESS, password
+	}
+	if strings.HasPrefix(host, "/") {
+		return host, password
+	}
+	if port == "" {
+		port = "6600"
+	}
+	return net.JoinHostPort(host, port), password
+}
+
+func LoadMPDLibrary(address, password, musicDir string) (*Library, error) {
+	client, err := dialMPD(address)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return loadMPDPlaylists(client, password, musicDir)
+}
+
+func loadMPDPlaylists(client *mpdClient, password, musicDir string) (*Library, error) {
+	if password != "" {
+		if _, err := client.command("password", password); err != nil {
+			return nil, err
+		}
+	}
+	attrs, err := client.command("listplaylists")
+	if err != nil {
+		return nil, err
+	}
+	library := &Library{
+		MusicFolder: fileLocation(musicDir),
+		Tracks:      make(map[string]Track),
+	}
+	trackMap := make(map[string]int)
+	for _, record := range splitMPDRecords(attrs, "playlist") {
+		name := record["playlist"]
+		songAttrs, err := client.command("listplaylistinfo", name)
+		if err != nil {
+			logrus.Warnf("Failed to read MPD playlist %s: %s", name, err)
+			continue
+		}
+		playlist := Playlist{
+			Name:                 name,
+			PlaylistPersistentId: derivePersistentId("mpd-playlist:" + name),
+			Visible:              true,
+		}
+		for _, song := range splitMPDRecords(songAttrs, "file") {
+			file := song["file"]
+			trackId, ok := trackMap[file]
+			if !ok {
+				filePath, local := resolveMPDFile(musicDir, file)
+				if !local {
+					logrus.Debugf("MPD: skipping non-local entry %s (playlist %s)", file, name)
+					continue
+				}
+				stat, err := os.Stat(filePath)
+				if err != nil {
+					logrus.Warnf("MPD: cannot access %s (playlist %s): %s", filePath, name, err)
+					continue
+				}
+				trackId = len(trackMap) + 1
+				trackMap[file] = trackId
+				library.Tracks[strconv.Itoa(trackId)] = mpdSongToTrack(song, trackId, filePath, stat)
+			}
+			playlist.PlaylistItems = append(playlist.PlaylistItems, PlaylistItem{TrackId: trackId})
+		}
+		library.Playlists = append(library.Playlists, playlist)
+	}
+	library.buildIndex()
+	return library, nil
+}
+
+// Song paths are relative to music_directory, except for playlists holding
+// absolute paths or URLs
+func resolveMPDFile(musicDir, file string) (string, bool) {
+	if strings.Contains(file, "://") {
+		u, err := url.Parse(file)
+		if err != nil || u.Scheme != "file" {
+			return "", false
+		}
+		return u.Path, true
+	}
+	if path.IsAbs(file) {
+		return file, true
+	}
+	return path.Join(musicDir, file), true
+}
+
+func mpdSongToTrack(song map[string]string, trackId int, filePath string, stat os.FileInfo) Track {
+	name := song["Title"]
+	if name == "" {
+		name = strings.TrimSuffix(path.Base(filePath), path.Ext(filePath))
+	}
+	track := Track{
+		TrackId:      trackId,
+		Name:         name,
+		Artist:       song["Artist"],
+		AlbumArtist:  song["AlbumArtist"],
+		Composer:     song["Composer"],
+		Album:        song["Album"],
+		Genre:        song["Genre"],
+		Size:         int(stat.Size()),
+		TrackNumber:  leadingInt(song["Track"]),
+		DiscNumber:   leadingInt(song["Disc"]),
+		Year:         leadingInt(song["Date"]),
+		DateModified: stat.ModTime(),
+		DateAdded:    stat.ModTime(),
+		PersistentId: derivePersistentId("mpd:" + song["file"]),
+		TrackType:    "File",
+		Location:     fileLocation(filePath),
+	}
+	if duration, err := strconv.ParseFloat(song["duration"], 64); err == nil {
+		track.TotalTime = int(duration * 1000)
+	} else if seconds, err := strconv.Atoi(song["Time"]); err == nil {
+		track.TotalTime = seconds * 1000
+	}
+	if modified, err := time.Parse(time.RFC3339, song["Last-Modified"]); err == nil {
+		track.DateModified = modified
+	}
+	return track
+}
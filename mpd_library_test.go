@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Stand-in MPD server answering from canned stored playlists
+type fakeMPD struct {
+	password  string
+	playlists map[string][]string // name -> response lines of listplaylistinfo
+	order     []string
+}
+
+// Splits a command line into the command and its unquoted arguments
+func parseMPDCommand(line string) (string, []string) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) == 1 {
+		return fields[0], nil
+	}
+	args := make([]string, 0)
+	rest := fields[1]
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ")
+		if !strings.HasPrefix(rest, "\"") {
+			break
+		}
+		var arg []byte
+		i := 1
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+			}
+			arg = append(arg, rest[i])
+		}
+		args = append(args, string(arg))
+		rest = rest[i+1:]
+	}
+	return fields[0], args
+}
+
+func (f *fakeMPD) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "OK MPD 0.23.5\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		name, args := parseMPDCommand(strings.TrimRight(line, "\n"))
+		switch {
+		case name == "password" && len(args) == 1 && args[0] == f.password:
+			fmt.Fprintf(conn, "OK\n")
+		case name == "password":
+			fmt.Fprintf(conn, "ACK [3@0] {password} incorrect password\n")
+		case name == "listplaylists":
+			for _, playlist := range f.order {
+				fmt.Fprintf(conn, "playlist: %s\nLast-Modified: 2020-01-01T00:00:00Z\n", playlist)
+			}
+			fmt.Fprintf(conn, "OK\n")
+		case name == "listplaylistinfo" && len(args) == 1:
+			lines, ok := f.playlists[args[0]]
+			if !ok {
+				fmt.Fprintf(conn, "ACK [50@0] {listplaylistinfo} No such playlist\n")
+				continue
+			}
+			for _, l := range lines {
+				fmt.Fprintf(conn, "%s\n", l)
+			}
+			fmt.Fprintf(conn, "OK\n")
+		default:
+			fmt.Fprintf(conn, "ACK [5@0] {%s} unknown command\n", name)
+		}
+	}
+}
+
+func newFakeMPD(t *testing.T) (*fakeMPD, string) {
+	musicDir, err := ioutil.TempDir("", "iwalk-mpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a/01 One.mp3", "a/02 Two.flac"} {
+		os.MkdirAll(path.Dir(path.Join(musicDir, file)), 0755)
+		if err := ioutil.WriteFile(path.Join(musicDir, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake := &fakeMPD{
+		password: "secret",
+		playlists: map[string][]string{
+			"Road \"Trip\"": {
+				"file: a/01 One.mp3",
+				"Title: One",
+				"Artist: Someone",
+				"Track: 1/10",
+				"duration: 201.500",
+				"file: http://radio.example.com/stream",
+				"file: a/02 Two.flac",
+				"Time: 180",
+				"file: a/missing.mp3",
+			},
+			"Again": {
+				"file: a/02 Two.flac",
+			},
+		},
+		order: []string{"Road \"Trip\"", "Vanished", "Again"},
+	}
+	return fake, musicDir
+}
+
+func TestMPDPlaylists(t *testing.T) {
+	fake, musicDir := newFakeMPD(t)
+	defer os.RemoveAll(musicDir)
+	serverConn, clientConn := net.Pipe()
+	go fake.serve(serverConn)
+
+	client, err := newMPDClient(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	library, err := loadMPDPlaylists(client, "secret", musicDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "Vanished" is answered with ACK and skipped
+	if len(library.Playlists) != 2 || library.Playlists[0].Name != "Road \"Trip\"" || library.Playlists[1].Name != "Again" {
+		t.Fatalf("playlists: %+v", library.Playlists)
+	}
+	road := library.Playlists[0].PlaylistItems
+	if len(road) != 2 {
+		t.Fatalf("Road items: %+v", road)
+	}
+	one := library.Tracks[fmt.Sprint(road[0].TrackId)]
+	if one.Name != "One" || one.Artist != "Someone" || one.TrackNumber != 1 || one.TotalTime != 201500 {
+		t.Fatalf("track: %+v", one)
+	}
+	if one.LocalPath() != path.Join(musicDir, "a/01 One.mp3") {
+		t.Fatalf("path: %s", one.LocalPath())
+	}
+	two := library.Tracks[fmt.Sprint(road[1].TrackId)]
+	if two.Name != "02 Two" || two.TotalTime != 180000 {
+		t.Fatalf("track: %+v", two)
+	}
+	// a song in two playlists is one track
+	if again := library.Playlists[1].PlaylistItems; len(again) != 1 || again[0].TrackId != road[1].TrackId {
+		t.Fatalf("Again items: %+v", again)
+	}
+}
+
+func TestMPDErrors(t *testing.T) {
+	fake, musicDir := newFakeMPD(t)
+	defer os.RemoveAll(musicDir)
+
+	serverConn, clientConn := net.Pipe()
+	go fake.serve(serverConn)
+	client, err := newMPDClient(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMPDPlaylists(client, "wrong", musicDir); err == nil || !strings.Contains(err.Error(), "incorrect password") {
+		t.Fatalf("wrong password: %v", err)
+	}
+	// the connection is still usable after ACK
+	if _, err := client.command("listplaylists"); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	serverConn, clientConn = net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		fmt.Fprintf(serverConn, "SSH-2.0-OpenSSH\n")
+	}()
+	if _, err := newMPDClient(clientConn); err == nil {
+		t.Fatal("accepted a non-MPD greeting")
+	}
+	clientConn.Close()
+}
+
+func TestMPDUnixSocket(t *testing.T) {
+	fake, musicDir := newFakeMPD(t)
+	defer os.RemoveAll(musicDir)
+	socketPath := path.Join(musicDir, "mpd.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+
+	library, err := LoadMPDLibrary(socketPath, "secret", musicDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(library.Playlists) != 2 {
+		t.Fatalf("playlists: %+v", library.Playlists)
+	}
+}
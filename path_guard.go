@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Every IOAction must stay inside the sinks it was planned for. Playlist
+// names and meta.json file names come from outside, so "../Music" or a
+// symlinked directory on the device could otherwise make Delete or Rename
+// act anywhere. Paths are checked after resolving symlinks, before
+// anything is performed.
+
+// Resolves symlinks in p. The missing part of p (files to be created) is
+// appended as is to its longest existing ancestor.
+func resolvePath(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	rest := make([]string, 0)
+	current := p
+	for {
+		resolved, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return p, nil
+		}
+		rest = append([]string{filepath.Base(current)}, rest...)
+		current = parent
+	}
+}
+
+// Whether p is root or inside it, both already resolved
+func isWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Checks that p is inside one of roots after resolving symlinks
+func checkContained(roots []string, p string) error {
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		resolvedRoot, err := resolvePath(root)
+		if err != nil {
+			return err
+		}
+		if isWithin(resolvedRoot, resolved) {
+			return nil
+		}
+	}
+	if resolved != filepath.Clean(p) {
+		return fmt.Errorf("%s (-> %s) is outside of %s", p, resolved, strings.Join(roots, ", "))
+	}
+	return fmt.Errorf("%s is outside of %s", p, strings.Join(roots, ", "))
+}
+
+// Errors of every action touching paths outside of roots
+func checkActionPaths(actions []IOAction, roots []string) error {
+	messages := make([]string, 0)
+	for _, action := range actions {
+		for _, p := range action.TouchedPaths() {
+			if err := checkContained(roots, p); err != nil {
+				messages = append(messages, fmt.Sprintf("  %s: %s", action, err))
+			}
+		}
+	}
+	if len(messages) > 0 {
+		return fmt.Errorf("Refusing to sync, actions escape the sync target:\n%s", strings.Join(messages, "\n"))
+	}
+	return nil
+}
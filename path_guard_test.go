@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// dir/sink with Linked -> dir/Music, and dir/Music/song.mp3
+func newPathGuardTestDir(t *testing.T) (dir, sinkPath, musicPath string) {
+	dir, err := ioutil.TempDir("", "iwalk-guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TempDir itself may be under a symlink
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	sinkPath, musicPath = path.Join(dir, "sink"), path.Join(dir, "Music")
+	os.MkdirAll(path.Join(sinkPath, "Mix"), 0755)
+	os.MkdirAll(musicPath, 0755)
+	ioutil.WriteFile(path.Join(musicPath, "song.mp3"), []byte("song"), 0644)
+	ioutil.WriteFile(path.Join(sinkPath, "Mix", "1 song.mp3"), []byte("song"), 0644)
+	if err := os.Symlink(musicPath, path.Join(sinkPath, "Linked")); err != nil {
+		t.Fatal(err)
+	}
+	return dir, sinkPath, musicPath
+}
+
+func TestResolvePath(t *testing.T) {
+	dir, sinkPath, musicPath := newPathGuardTestDir(t)
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		p        string
+		expected string
+	}{
+		{path.Join(sinkPath, "Mix", "1 song.mp3"), path.Join(sinkPath, "Mix", "1 song.mp3")},
+		{sinkPath + "/../Music", musicPath},
+		{path.Join(sinkPath, "Linked", "song.mp3"), path.Join(musicPath, "song.mp3")},
+		// missing tail under a symlink
+		{path.Join(sinkPath, "Linked", "New", "1 a.mp3"), path.Join(musicPath, "New", "1 a.mp3")},
+		{path.Join(sinkPath, "New", "1 a.mp3"), path.Join(sinkPath, "New", "1 a.mp3")},
+	}
+	for _, c := range cases {
+		resolved, err := resolvePath(c.p)
+		if err != nil {
+			t.Fatalf("%s: %s", c.p, err)
+		}
+		if resolved != c.expected {
+			t.Errorf("%s: %s, expected %s", c.p, resolved, c.expected)
+		}
+	}
+}
+
+func TestCheckContained(t *testing.T) {
+	dir, sinkPath, _ := newPathGuardTestDir(t)
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		p  string
+		ok bool
+	}{
+		{sinkPath, true},
+		{path.Join(sinkPath, "Mix", "1 song.mp3"), true},
+		{path.Join(sinkPath, "New", "1 a.mp3"), true},
+		// playlist named "../Music"
+		{sinkPath + "/../Music/song.mp3", false},
+		{sinkPath + "/../sink2", false},
+		// absolute meta.json FileName stays under the sink dir when joined
+		{path.Join(sinkPath, "Mix", path.Join(dir, "Music", "song.mp3")), true},
+		{path.Join(sinkPath, "Linked", "song.mp3"), false},
+		{path.Join(sinkPath, "Linked", "New", "1 a.mp3"), false},
+	}
+	for _, c := range cases {
+		if err := checkContained([]string{sinkPath}, c.p); (err == nil) != c.ok {
+			t.Errorf("%s: %v, expected ok=%t", c.p, err, c.ok)
+		}
+	}
+	// a sink dir reached through a symlinked root is inside
+	if err := checkContained([]string{path.Join(sinkPath, "Linked")}, path.Join(dir, "Music", "a.mp3")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckActionPaths(t *testing.T) {
+	dir, sinkPath, musicPath := newPathGuardTestDir(t)
+	defer os.RemoveAll(dir)
+	mixPath := path.Join(sinkPath, "Mix")
+	track := &Track{Name: "song", PersistentId: "A1", Location: fileLocation(path.Join(musicPath, "song.mp3"))}
+	inside := []IOAction{
+		NewRename(path.Join(mixPath, "1 song.mp3"), path.Join(mixPath, "2 song.mp3")),
+		NewCopy(track.LocalPath(), path.Join(mixPath, path.Join(dir, "Music", "song.mp3")), track),
+		NewDelete(path.Join(mixPath, "1 song.mp3")),
+	}
+	if err := checkActionPaths(inside, []string{sinkPath}); err != nil {
+		t.Fatal(err)
+	}
+	escaping := [][]IOAction{
+		// meta.json FileName "../../Music/song.mp3"
+		{NewDelete(path.Join(mixPath, "../../Music/song.mp3"))},
+		{NewRename(path.Join(mixPath, "1 song.mp3"), path.Join(sinkPath, "../Music/1 song.mp3"))},
+		{NewCopy(track.LocalPath(), path.Join(sinkPath, "Linked", "New", "1 song.mp3"), track)},
+		{NewRename(path.Join(sinkPath, "Linked", "song.mp3"), path.Join(mixPath, "2 song.mp3"))},
+	}
+	for _, actions := range escaping {
+		if err := checkActionPaths(actions, []string{sinkPath}); err == nil {
+			t.Errorf("%s: not refused", actions[0])
+		}
+	}
+}
+
+func TestCreateSinkDirOutside(t *testing.T) {
+	dir, sinkPath, musicPath := newPathGuardTestDir(t)
+	defer os.RemoveAll(dir)
+	sink, err := NewSink(sinkPath, DetectFilesystemProfile(sinkPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dirPath := range []string{sinkPath + "/../Other", path.Join(sinkPath, "Linked", "Fav")} {
+		if _, err := sink.createSinkDir(dirPath); err == nil {
+			t.Errorf("%s: created", dirPath)
+		}
+	}
+	if isFileExists(path.Join(dir, "Other")) || isFileExists(path.Join(musicPath, "Fav")) {
+		t.Fatal("directory made outside of the sink")
+	}
+	if _, err := sink.createSinkDir(path.Join(sinkPath, "Fav")); err != nil || !isFileExists(path.Join(sinkPath, "Fav")) {
+		t.Fatalf("not created: %v", err)
+	}
+}
@@ -1,78 +1,154 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"math"
+	"path"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
 )
 
 // Creates sync plan
 type Planner struct {
-	lib            *Library
+	lib            LibrarySource
 	playlist       *Playlist
 	sinkDir        *SinkDir
+	options        *SyncOptions
 	SkippedTracks  int
 	SyncingTracks  int
 	DeletingTracks int
+	// Bytes written for each track by the sync
+	TrackWrites map[string]int64
+}
+
+// Filename template, extension is appended
+const DEFAULT_FILENAME_TEMPLATE = "{{.Number}} {{.Name}}"
+const UNNUMBERED_FILENAME_TEMPLATE = "{{.Name}}"
+
+// Data for filename templates: Track fields, and position in the playlist
+type fileNameData struct {
+	Track
+	Index  int    // 1, 2, ...
+	Number string // Index zero-padded to the playlist length
 }
 
 type SinkResult struct {
-	Track     Track
-	Filename  string
-	Performed []IOAction
+	Track            Track
+	Filename         string
+	TranscodeProfile string
+	Performed        []IOAction
 }
 
-func NewPlanner(lib *Library, pl *Playlist, sinkDir *SinkDir) *Planner {
+func NewPlanner(lib LibrarySource, pl *Playlist, sinkDir *SinkDir, options *SyncOptions) *Planner {
 	return &Planner{
-		lib:      lib,
-		playlist: pl,
-		sinkDir:  sinkDir,
+		lib:         lib,
+		playlist:    pl,
+		sinkDir:     sinkDir,
+		options:     options,
+		TrackWrites: make(map[string]int64),
 	}
 }
 
-func (p *Planner) Start(engine *IOEngine) {
+func (p *Planner) Start(engine *IOEngine) error {
 	logrus.Infof("---------- Sync: %s --------------", p.playlist.Name)
-	itemLen := len(p.playlist.PlaylistItems)
+	tracks, err := p.lib.PlaylistTracks(p.playlist)
+	if err != nil {
+		return err
+	}
+	itemLen := len(tracks)
 	results := make([]SinkResult, 0)
 	if itemLen == 0 {
-		return
+		return nil
 	}
 	prefixLen := int(math.Ceil(math.Log10(float64(itemLen))))
+	tmplText := p.fileNameTemplate()
+	tmpl, err := parseFileNameTemplate(tmplText)
+	if err != nil {
+		return err
+	}
+	prevTemplate := p.sinkDir.FileNameTemplate
+	templateChanged := prevTemplate != tmplText
+	if templateChanged {
+		logrus.Infof("Filename template changed: %q -> %q", p.sinkDir.FileNameTemplate, tmplText)
+		p.sinkDir.FileNameTemplate = tmplText
+	}
 	skippedTracks := 0
 	copyAndRenameActions := make([]IOAction, 0)
-	for index, track := range p.playlist.Tracks(p.lib) {
+	usedNames := make(map[string]string)
+	for index, track := range tracks {
 		if len(track.Location) == 0 {
 			logrus.Warnf("No File(iCloud): %s", track.Name)
 			continue
 		}
 		extension := filepath.Ext(track.Location)
+		profile, ok := p.options.trackProfile(&track)
+		if !ok {
+			if meta, synced := p.sinkDir.Tracks[track.PersistentId]; synced && !p.options.leftOff[track.PersistentId] {
+				// synced before the device was known not to play it, keep the file
+				logrus.Warnf("-- KEEP  : %s (%s, synced before)", track.Name, meta.FileName)
+				p.sinkDir.CheckedTracks[track.PersistentId] = true
+				usedNames[p.options.Filesystem.CollisionKey(meta.FileName)] = meta.FileName
+				kept := track
+				kept.DateModified = meta.ModifiedTime
+				skippedTracks += 1
+				results = append(results, SinkResult{
+					Track:            kept,
+					Filename:         meta.FileName,
+					TranscodeProfile: meta.TranscodeProfile,
+				})
+			}
+			continue
+		}
+		profileName := ""
+		if profile != nil {
+			profileName = profile.Name
+			extension = profile.Extension()
+		}
 		// 0001 Track Name.m4a
 		// 0002 Track Name2.mp3
 		// ...
-		newFileName := fmt.Sprintf(fmt.Sprintf("%%0%dd %%s%%s", prefixLen), index+1, escapeFilename(track.Name), extension)
-		acts := p.sinkDir.SinkTrack(&track, newFileName)
+		newFileName, err := renderFileName(p.options.Filesystem, tmpl, &track, index, prefixLen, extension, usedNames)
+		if err != nil {
+			return fmt.Errorf("Filename template failed for %s: %s", track.Name, err)
+		}
+		if meta, ok := p.sinkDir.Tracks[track.PersistentId]; ok {
+			meta.Broken = p.options.Repair[path.Join(p.sinkDir.Path, meta.FileName)]
+		}
+		acts := p.sinkDir.SinkTrack(&track, newFileName, profile)
+		p.TrackWrites[track.PersistentId] = trackWriteSize(acts)
 		if len(acts) == 0 {
 			skippedTracks += 1
 		}
 		copyAndRenameActions = append(copyAndRenameActions, acts...)
 		results = append(results, SinkResult{
-			Track:     track,
-			Filename:  newFileName,
-			Performed: acts,
+			Track:            track,
+			Filename:         newFileName,
+			TranscodeProfile: profileName,
+			Performed:        acts,
 		})
 	}
 	// Action order
-	// Trash -> Copy and Rename -> Update meta.json
+	// Trash -> Copy and Rename -> Playlist file -> Update meta.json
 	trashUncheckedActions := p.sinkDir.TrashUncheckedTracks(p.lib)
+	playlistFileName := ""
+	if p.options.PlaylistFiles {
+		playlistFileName = p.options.Filesystem.FileName(p.playlist.Name, p.options.playlistFileExt())
+	}
+	// order changes rename nothing without numbered file names
+	playlistFileStale := p.sinkDir.isPlaylistFileStale(results, playlistFileName)
 	p.SkippedTracks = skippedTracks
-	p.SyncingTracks = len(p.playlist.PlaylistItems) - skippedTracks
+	p.SyncingTracks = len(results) - skippedTracks
 	p.DeletingTracks = len(trashUncheckedActions)
-	if p.DeletingTracks == 0 && p.SyncingTracks == 0 {
+	if p.DeletingTracks == 0 && p.SyncingTracks == 0 && !p.sinkDir.Moved && !playlistFileStale && !templateChanged {
 		// nothing changed, skip
 		logrus.Debugf("Nothing changed: skipping %s", p.playlist.Name)
-		return
+		return nil
 	}
+	playlistFileActions := p.sinkDir.WritePlaylistFile(results, playlistFileName)
 	updateMetaActions, err := p.sinkDir.UpdateMeta(results)
 	if err != nil {
 		logrus.Fatalf("Failed to update metadata for %s", p.playlist.Name)
@@ -83,10 +159,105 @@ func (p *Planner) Start(engine *IOEngine) {
 	for _, act := range copyAndRenameActions {
 		engine.Push(act)
 	}
+	for _, act := range playlistFileActions {
+		engine.Push(act)
+	}
 	for _, act := range updateMetaActions {
 		engine.Push(act)
 	}
+	if strings.Contains(tmplText, "/") || strings.Contains(prevTemplate, "/") {
+		// directories emptied by renames and deletes
+		engine.Push(NewPruneEmptyDirs(p.sinkDir.Path))
+	}
+	if p.sinkDir.Move != nil {
+		// everything above is done at the old place
+		engine.Push(p.sinkDir.Move)
+	}
 	if skippedTracks > 0 {
 		logrus.Infof("SKIP Tracks: %d", skippedTracks)
 	}
+	return nil
+}
+
+// Template for the playlist, from filename_templates by name, path or
+// persistent ID, or the default one
+func (p *Planner) fileNameTemplate() string {
+	if len(p.options.FileNameTemplates) > 0 {
+		playlistPath := path.Join(append(playlistFolderPath(p.lib, p.playlist), p.playlist.Name)...)
+		for _, key := range []string{p.playlist.PlaylistPersistentId, playlistPath, p.playlist.Name} {
+			if tmpl, ok := p.options.FileNameTemplates[key]; ok {
+				return tmpl
+			}
+		}
+	}
+	if p.options.FileNameTemplate != "" {
+		return p.options.FileNameTemplate
+	}
+	if p.options.PlaylistFiles && p.options.DropNumberPrefix {
+		// order is kept by the playlist file
+		return UNNUMBERED_FILENAME_TEMPLATE
+	}
+	return DEFAULT_FILENAME_TEMPLATE
+}
+
+func parseFileNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filename template %q: %s", text, err)
+	}
+	return tmpl, nil
+}
+
+// Relative path of the track from the template, with each directory and
+// file name valid on the filesystem
+func renderFileName(fs *FilesystemProfile, tmpl *template.Template, track *Track, index, prefixLen int, extension string, used map[string]string) (string, error) {
+	var buf bytes.Buffer
+	// "/" in values must not make directories
+	escaped := *track
+	value := reflect.ValueOf(&escaped).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Field(i); field.Kind() == reflect.String {
+			field.SetString(escapeFilename(field.String()))
+		}
+	}
+	data := fileNameData{
+		Track:  escaped,
+		Index:  index + 1,
+		Number: fmt.Sprintf("%0*d", prefixLen, index+1),
+	}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	parts := make([]string, 0)
+	for _, part := range strings.Split(buf.String(), "/") {
+		part = strings.TrimSpace(part)
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		parts = append(parts, track.PersistentId)
+	}
+	dirs := parts[:len(parts)-1]
+	for i, dir := range dirs {
+		dirs[i] = fs.Sanitize(dir)
+	}
+	return uniqueFileName(fs, used, path.Join(dirs...), parts[len(parts)-1], extension), nil
+}
+
+// "dir/Name.m4a", or "dir/Name (2).m4a" if the filesystem would take it for
+// another name in used (collision key -> file name)
+func uniqueFileName(fs *FilesystemProfile, used map[string]string, dir, name, extension string) string {
+	fileName := path.Join(dir, fs.FileName(name, extension))
+	other, taken := used[fs.CollisionKey(fileName)]
+	if taken && other != fileName {
+		logrus.Warnf("%s collides with %s on %s, renaming", fileName, other, fs)
+	}
+	for i := 2; taken; i++ {
+		fileName = path.Join(dir, fs.FileName(name, fmt.Sprintf(" (%d)%s", i, extension)))
+		_, taken = used[fs.CollisionKey(fileName)]
+	}
+	used[fs.CollisionKey(fileName)] = fileName
+	return fileName
 }
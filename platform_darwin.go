@@ -2,9 +2,7 @@ package main
 
 import (
 	"fmt"
-	"github.com/Sirupsen/logrus"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -13,12 +11,8 @@ import (
 
 const VOLUMES = "/Volumes"
 
-const (
-	R_OK uint32 = 4
-	W_OK uint32 = 2
-	X_OK uint32 = 1
-	F_OK uint32 = 0
-)
+// Naming rules used when the filesystem of the target is unknown
+const DEFAULT_FILESYSTEM = "hfsplus"
 
 var VOLUMES_IGNORES = []string{"Macintosh HD", "MobileBackups", "Time Machine"}
 
@@ -30,16 +24,6 @@ func defaultLibraryPath() string {
 	return fmt.Sprintf("/Users/%v/Music/iTunes/iTunes Music Library.xml", os.Getenv("USER"))
 }
 
-func normalizeLocation(path string) string {
-	url, err := url.Parse(path)
-	if err != nil {
-		logrus.Fatalf("Invlaid Location URL: %s", path)
-		return ""
-	} else {
-		return url.Path
-	}
-}
-
 var hfsPlusReplacer = strings.NewReplacer(
 	"/", "_", // UNIX rule
 	"\x00", "_", // HFS+ rule
@@ -49,6 +33,22 @@ func escapeFilename(name string) string {
 	return hfsPlusReplacer.Replace(name)
 }
 
+// Type of the filesystem targetPath is on: msdos, exfat, hfs, apfs, ...
+func filesystemType(targetPath string) (string, error) {
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(targetPath, &fs); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 0, len(fs.Fstypename))
+	for _, c := range fs.Fstypename {
+		if c == 0 {
+			break
+		}
+		buf = append(buf, byte(c))
+	}
+	return string(buf), nil
+}
+
 func listDeviceCandidates() []string {
 	fInfos, err := ioutil.ReadDir(VOLUMES)
 	if err != nil {
@@ -72,39 +72,3 @@ func listDeviceCandidates() []string {
 	}
 	return ret
 }
-
-func isReadable(path string) bool {
-	err := syscall.Access(path, R_OK)
-	return err == nil
-}
-
-func isWritable(path string) bool {
-	err := syscall.Access(path, W_OK)
-	return err == nil
-}
-
-type DiskStatus struct {
-	All  uint64 `json:"all"`
-	Used uint64 `json:"used"`
-	Free uint64 `json:"free"`
-}
-
-// disk usage of path/disk
-func DiskUsage(path string) (disk DiskStatus, err error) {
-	fs := syscall.Statfs_t{}
-	err = syscall.Statfs(path, &fs)
-	if err != nil {
-		return
-	}
-	disk.All = fs.Blocks * uint64(fs.Bsize)
-	disk.Free = fs.Bfree * uint64(fs.Bsize)
-	disk.Used = disk.All - disk.Free
-	return
-}
-
-const (
-	Byte = 1
-	KiB  = 1024 * Byte
-	MiB  = 1024 * KiB
-	GiB  = 1024 * MiB
-)
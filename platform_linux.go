@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const PROC_MOUNTS = "/proc/mounts"
+
+// Naming rules used when the filesystem of the target is unknown
+const DEFAULT_FILESYSTEM = "ext4"
+
+// Filesystems which removable music players are usually formatted with
+var DEVICE_FSTYPES = []string{"vfat", "msdos", "exfat", "fuseblk", "hfsplus"}
+
+func isWindows() bool {
+	return false
+}
+
+func libraryPathCandidates() []string {
+	home := os.Getenv("HOME")
+	return []string{
+		path.Join(home, "Music/iTunes/iTunes Music Library.xml"),
+		path.Join(home, "Music/iTunes/iTunes Library.xml"),
+		path.Join(home, "Music/iTunes Music Library.xml"),
+	}
+}
+
+func defaultLibraryPath() string {
+	candidates := libraryPathCandidates()
+	for _, candidate := range candidates {
+		if isFileExists(candidate) {
+			return candidate
+		}
+	}
+	return candidates[0]
+}
+
+var unixReplacer = strings.NewReplacer(
+	"/", "_", // UNIX rule
+	"\x00", "_", // UNIX rule
+)
+
+func escapeFilename(name string) string {
+	return unixReplacer.Replace(name)
+}
+
+type mountEntry struct {
+	Device     string
+	MountPoint string
+	FsType     string
+}
+
+// Decodes octal escapes(\040 etc.) in /proc/mounts fields
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	buf := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if code, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				buf = append(buf, byte(code))
+				i += 3
+				continue
+			}
+		}
+		buf = append(buf, field[i])
+	}
+	return string(buf)
+}
+
+func readMounts() ([]mountEntry, error) {
+	f, err := os.Open(PROC_MOUNTS)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := make([]mountEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		ret = append(ret, mountEntry{
+			Device:     unescapeMountField(fields[0]),
+			MountPoint: unescapeMountField(fields[1]),
+			FsType:     fields[2],
+		})
+	}
+	return ret, scanner.Err()
+}
+
+// Type of the mount targetPath is on, by the longest mount point prefix
+func filesystemType(targetPath string) (string, error) {
+	absPath, err := filepath.Abs(targetPath)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(absPath); err == nil {
+		absPath = resolved
+	}
+	mounts, err := readMounts()
+	if err != nil {
+		return "", err
+	}
+	fsType, matched := "", ""
+	for _, mount := range mounts {
+		mountPoint := mount.MountPoint
+		if absPath != mountPoint && !strings.HasPrefix(absPath, strings.TrimSuffix(mountPoint, "/")+"/") {
+			continue
+		}
+		if len(mountPoint) >= len(matched) {
+			fsType, matched = mount.FsType, mountPoint
+		}
+	}
+	if matched == "" {
+		return "", fmt.Errorf("No mount found for %s", absPath)
+	}
+	return fsType, nil
+}
+
+func isDeviceFsType(fsType string) bool {
+	for _, t := range DEVICE_FSTYPES {
+		if t == fsType {
+			return true
+		}
+	}
+	return false
+}
+
+func listDeviceCandidates() []string {
+	user := os.Getenv("USER")
+	mountPoints := make([]string, 0)
+	for _, root := range []string{path.Join("/media", user), path.Join("/run/media", user)} {
+		fInfos, err := ioutil.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, info := range fInfos {
+			if info.IsDir() {
+				mountPoints = append(mountPoints, path.Join(root, info.Name()))
+			}
+		}
+	}
+	if mounts, err := readMounts(); err == nil {
+		for _, mount := range mounts {
+			if isDeviceFsType(mount.FsType) {
+				mountPoints = append(mountPoints, mount.MountPoint)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	ret := make([]string, 0, len(mountPoints))
+	for _, devicePath := range mountPoints {
+		if seen[devicePath] {
+			continue
+		}
+		seen[devicePath] = true
+		if isValidWalkmanDevice(devicePath) {
+			ret = append(ret, path.Join(devicePath, "MUSIC"))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,52 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"net/url"
+	"syscall"
+)
+
+const (
+	R_OK uint32 = 4
+	W_OK uint32 = 2
+	X_OK uint32 = 1
+	F_OK uint32 = 0
+)
+
+func normalizeLocation(path string) string {
+	url, err := url.Parse(path)
+	if err != nil {
+		logrus.Fatalf("Invlaid Location URL: %s", path)
+		return ""
+	} else {
+		return url.Path
+	}
+}
+
+func isReadable(path string) bool {
+	err := syscall.Access(path, R_OK)
+	return err == nil
+}
+
+func isWritable(path string) bool {
+	err := syscall.Access(path, W_OK)
+	return err == nil
+}
+
+// disk usage of path/disk
+func DiskUsage(path string) (disk DiskStatus, err error) {
+	fs := syscall.Statfs_t{}
+	err = syscall.Statfs(path, &fs)
+	if err != nil {
+		return
+	}
+	// Bsize is uint32 on darwin and int64 on linux
+	disk.All = fs.Blocks * uint64(fs.Bsize)
+	// Bavail: Bfree includes blocks reserved for root
+	disk.Free = fs.Bavail * uint64(fs.Bsize)
+	disk.Used = disk.All - fs.Bfree*uint64(fs.Bsize)
+	return
+}
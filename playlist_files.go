@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Playlists kept as plain files (M3U/M3U8, PLS, XSPF) in a directory.
+// Playlist names are paths relative to the directory without extension
+// ("Rock", "Live/2016"), or with it when files of several formats share a
+// name ("Rock.m3u8", "Rock.xspf"). config.Playlists may also refer to a playlist
+// file directly ("Live/2016.m3u8", "/path/to/some.xspf").
+type PlaylistFileSource struct {
+	*Library
+	root      string
+	trackMap  map[string]int // absolute path -> TrackId
+	loadedMap map[string]*Playlist
+}
+
+// An entry read from a playlist file
+type playlistFileEntry struct {
+	Location string
+	Title    string
+	Artist   string
+	Album    string
+	Duration int // msec
+	TrackNum int
+}
+
+var playlistFileExtensions = map[string]bool{
+	".m3u":  true,
+	".m3u8": true,
+	".pls":  true,
+	".xspf": true,
+}
+
+func isPlaylistFile(filePath string) bool {
+	return playlistFileExtensions[strings.ToLower(filepath.Ext(filePath))]
+}
+
+func LoadPlaylistFileSource(root string) (*PlaylistFileSource, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	// playlist files in the order of Playlists, and name -> count.
+	// "Foo.m3u8" and "Foo.xspf" are both "Foo".
+	files := make([]string, 0)
+	nameCount := make(map[string]int)
+	source := &PlaylistFileSource{
+		Library: &Library{
+			Tracks: make(map[string]Track),
+		},
+		root:      root,
+		trackMap:  make(map[string]int),
+		loadedMap: make(map[string]*Playlist),
+	}
+	err = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isPlaylistFile(filePath) {
+			return nil
+		}
+		playlist, err := source.loadPlaylistFile(filePath)
+		if err != nil {
+			logrus.Warnf("Failed to load playlist %s: %s", filePath, err)
+			return nil
+		}
+		source.Playlists = append(source.Playlists, *playlist)
+		files = append(files, filePath)
+		nameCount[playlist.Name] += 1
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range source.Playlists {
+		playlist := &source.Playlists[i]
+		if nameCount[playlist.Name] > 1 {
+			// keep all of them, named with their extensions
+			name := playlist.Name + filepath.Ext(files[i])
+			logrus.Warnf("Several playlist files are named %s, naming %s as %s", playlist.Name, files[i], name)
+			playlist.Name = name
+		}
+	}
+	source.buildIndex()
+	return source, nil
+}
+
+func (s *PlaylistFileSource) playlistName(filePath string) string {
+	name := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	if rel, err := filepath.Rel(s.root, name); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Base(name)
+}
+
+// Finds playlist by name, or by playlist file path (relative to the
+// playlist directory or absolute)
+func (s *PlaylistFileSource) FindPlaylist(name string) (*Playlist, bool) {
+	if playlist, ok := s.Library.FindPlaylist(name); ok {
+		return playlist, true
+	}
+	if !isPlaylistFile(name) {
+		return nil, false
+	}
+	filePath := name
+	if !filepath.IsAbs(filePath) {
+		filePath = filepath.Join(s.root, filePath)
+	}
+	if playlist, ok := s.loadedMap[filePath]; ok {
+		return playlist, true
+	}
+	playlist, err := s.loadPlaylistFile(filePath)
+	if err != nil {
+		logrus.Warnf("Failed to load playlist %s: %s", filePath, err)
+		return nil, false
+	}
+	s.loadedMap[filePath] = playlist
+	return playlist, true
+}
+
+func (s *PlaylistFileSource) loadPlaylistFile(filePath string) (*Playlist, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var entries []playlistFileEntry
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".m3u", ".m3u8":
+		entries, err = parseM3U(data)
+	case ".pls":
+		entries, err = parsePLS(data)
+	case ".xspf":
+		entries, err = parseXSPF(data)
+	default:
+		err = fmt.Errorf("Unknown playlist format: %s", filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	playlist := &Playlist{
+		Name:                 s.playlistName(filePath),
+		PlaylistPersistentId: derivePersistentId("playlist:" + filePath),
+		Visible:              true,
+	}
+	baseDir := filepath.Dir(filePath)
+	for _, entry := range entries {
+		trackPath, ok := resolvePlaylistLocation(baseDir, entry.Location)
+		if !ok {
+			logrus.Debugf("Skipping non-local entry %s (playlist %s)", entry.Location, playlist.Name)
+			continue
+		}
+		trackId, err := s.addTrack(trackPath, &entry)
+		if err != nil {
+			logrus.Warnf("Cannot access %s (playlist %s): %s", trackPath, playlist.Name, err)
+			continue
+		}
+		playlist.PlaylistItems = append(playlist.PlaylistItems, PlaylistItem{TrackId: trackId})
+	}
+	return playlist, nil
+}
+
+// Registers a track (once per file) and returns its TrackId
+func (s *PlaylistFileSource) addTrack(trackPath string, entry *playlistFileEntry) (int, error) {
+	if trackId, ok := s.trackMap[trackPath]; ok {
+		return trackId, nil
+	}
+	stat, err := os.Stat(trackPath)
+	if err != nil {
+		return 0, err
+	}
+	name := entry.Title
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(trackPath), filepath.Ext(trackPath))
+	}
+	trackId := len(s.trackMap) + 1
+	track := Track{
+		TrackId:      trackId,
+		Name:         name,
+		Artist:       entry.Artist,
+		Album:        entry.Album,
+		Size:         int(stat.Size()),
+		TotalTime:    entry.Duration,
+		TrackNumber:  entry.TrackNum,
+		DateModified: stat.ModTime(),
+		DateAdded:    stat.ModTime(),
+		PersistentId: derivePersistentId(trackPath),
+		TrackType:    "File",
+		Location:     fileLocation(trackPath),
+	}
+	s.trackMap[trackPath] = trackId
+	s.Tracks[strconv.Itoa(trackId)] = track
+	if s.persistentMap != nil {
+		s.persistentMap[track.PersistentId] = &track
+	}
+	return trackId, nil
+}
+
+// Resolves playlist entry (relative path, absolute path or file:// URL) into
+// absolute local path
+func resolvePlaylistLocation(baseDir, location string) (string, bool) {
+	location = strings.TrimSpace(location)
+	if location == "" {
+		return "", false
+	}
+	if strings.Contains(location, "://") {
+		u, err := url.Parse(location)
+		if err != nil || u.Scheme != "file" {
+			return "", false
+		}
+		location = u.Path
+	} else if !isWindows() && strings.Contains(location, "\\") && !isFileExists(filepath.Join(baseDir, location)) {
+		// playlists written on Windows
+		location = strings.Replace(location, "\\", "/", -1)
+	}
+	if !filepath.IsAbs(location) {
+		location = filepath.Join(baseDir, location)
+	}
+	return filepath.Clean(location), true
+}
+
+// Converts Latin-1 bytes to UTF-8 unless they are valid UTF-8 already
+func decodePlaylistText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func parseM3U(data []byte) ([]playlistFileEntry, error) {
+	ret := make([]playlistFileEntry, 0)
+	var pending playlistFileEntry
+	scanner := bufio.NewScanner(strings.NewReader(decodePlaylistText(data)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// #EXTINF:123,Artist - Title
+			info := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)
+			if seconds, err := strconv.Atoi(strings.SplitN(strings.TrimSpace(info[0]), " ", 2)[0]); err == nil && seconds > 0 {
+				pending.Duration = seconds * 1000
+			}
+			if len(info) == 2 {
+				title := strings.TrimSpace(info[1])
+				if parts := strings.SplitN(title, " - ", 2); len(parts) == 2 {
+					pending.Artist, pending.Title = parts[0], parts[1]
+				} else {
+					pending.Title = title
+				}
+			}
+		case strings.HasPrefix(line, "#"):
+			// #EXTM3U and other directives
+		default:
+			pending.Location = line
+			ret = append(ret, pending)
+			pending = playlistFileEntry{}
+		}
+	}
+	return ret, scanner.Err()
+}
+
+func parsePLS(data []byte) ([]playlistFileEntry, error) {
+	// [playlist]
+	// File1=path
+	// Title1=title
+	// Length1=seconds
+	entries := make(map[int]*playlistFileEntry)
+	maxIndex := 0
+	scanner := bufio.NewScanner(strings.NewReader(decodePlaylistText(data)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		var field string
+		for _, prefix := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, prefix) {
+				field = prefix
+				break
+			}
+		}
+		if field == "" {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(key, field))
+		if err != nil {
+			continue
+		}
+		entry, ok := entries[index]
+		if !ok {
+			entry = &playlistFileEntry{}
+			entries[index] = entry
+		}
+		if index > maxIndex {
+			maxIndex = index
+		}
+		switch field {
+		case "file":
+			entry.Location = value
+		case "title":
+			entry.Title = value
+		case "length":
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				entry.Duration = seconds * 1000
+			}
+		}
+	}
+	ret := make([]playlistFileEntry, 0, len(entries))
+	for i := 0; i <= maxIndex; i++ {
+		if entry, ok := entries[i]; ok && entry.Location != "" {
+			ret = append(ret, *entry)
+		}
+	}
+	return ret, scanner.Err()
+}
+
+type xspfPlaylist struct {
+	Tracks []struct {
+		Locations []string `xml:"location"`
+		Title     string   `xml:"title"`
+		Creator   string   `xml:"creator"`
+		Album     string   `xml:"album"`
+		Duration  int      `xml:"duration"`
+		TrackNum  int      `xml:"trackNum"`
+	} `xml:"trackList>track"`
+}
+
+func parseXSPF(data []byte) ([]playlistFileEntry, error) {
+	var playlist xspfPlaylist
+	if err := xml.Unmarshal(data, &playlist); err != nil {
+		return nil, err
+	}
+	ret := make([]playlistFileEntry, 0, len(playlist.Tracks))
+	for _, track := range playlist.Tracks {
+		if len(track.Locations) == 0 {
+			continue
+		}
+		location := track.Locations[0]
+		if !strings.Contains(location, "://") {
+			// relative locations are URI references
+			if unescaped, err := url.PathUnescape(location); err == nil {
+				location = unescaped
+			}
+		}
+		ret = append(ret, playlistFileEntry{
+			Location: location,
+			Title:    track.Title,
+			Artist:   track.Creator,
+			Album:    track.Album,
+			Duration: track.Duration,
+			TrackNum: track.TrackNum,
+		})
+	}
+	return ret, nil
+}
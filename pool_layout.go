@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// "pool" layout: each track is stored once in POOL_DIRNAME, named by its
+// persistent ID, and playlists are M3U8 files at the target root. The
+// manifest counts which playlists refer to each track, and a pooled file
+// is deleted only when no playlist refers to it anymore. Playlists not
+// synced in a run keep their references until their playlist file is
+// deleted from the device.
+
+const POOL_DIRNAME = "iwalk-pool"
+const POOL_MANIFEST_FILENAME = "iwalk-pool.json"
+const POOL_MANIFEST_TEMP_FILENAME = "iwalk-pool.temp.json"
+
+type PoolManifest struct {
+	Tracks    map[string]*PoolTrack    `json:"tracks"`
+	Playlists map[string]*PoolPlaylist `json:"playlists"`
+}
+
+type PoolTrack struct {
+	FileName         string    `json:"filename"`
+	ModifiedTime     time.Time `json:"modified_time"`
+	TranscodeProfile string    `json:"transcode_profile,omitempty"`
+	// Size and checksum of the pooled file, like TrackMeta
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	// Persistent IDs of playlists referring to the track
+	Refs []string `json:"refs"`
+}
+
+type PoolPlaylist struct {
+	Name string `json:"name"`
+	// Playlist file, relative to the target
+	File   string   `json:"file"`
+	Tracks []string `json:"tracks"`
+}
+
+type PoolPlanner struct {
+	lib            LibrarySource
+	sink           *Sink
+	options        *SyncOptions
+	manifest       *PoolManifest
+	SkippedTracks  int
+	SyncingTracks  int
+	DeletingTracks int
+	// Bytes written for each pooled track by the sync
+	TrackWrites map[string]int64
+	// Actions writing pooled files, by persistent ID, for their checksums
+	writes map[string]writtenFileAction
+}
+
+func NewPoolPlanner(lib LibrarySource, sink *Sink, options *SyncOptions) (*PoolPlanner, error) {
+	manifest, err := loadPoolManifest(path.Join(sink.Path, POOL_MANIFEST_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	return &PoolPlanner{
+		lib:         lib,
+		sink:        sink,
+		options:     options,
+		manifest:    manifest,
+		TrackWrites: make(map[string]int64),
+		writes:      make(map[string]writtenFileAction),
+	}, nil
+}
+
+func loadPoolManifest(manifestPath string) (*PoolManifest, error) {
+	manifest := &PoolManifest{
+		Tracks:    make(map[string]*PoolTrack),
+		Playlists: make(map[string]*PoolPlaylist),
+	}
+	data, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("Broken %s: %s", manifestPath, err)
+	}
+	return manifest, nil
+}
+
+// Playlist file name at the target root, folders joined by " - "
+func (p *PoolPlanner) playlistFileName(playlist *Playlist, folders []string) string {
+	name := strings.Join(append(append([]string{}, folders...), playlist.Name), " - ")
+	return p.options.Filesystem.FileName(name, p.options.playlistFileExt())
+}
+
+func (p *PoolPlanner) Start(engine *IOEngine, playlists []*Playlist, folderPaths [][]string) error {
+	poolDir := path.Join(p.sink.Path, POOL_DIRNAME)
+	if err := checkContained([]string{p.sink.Path}, poolDir); err != nil {
+		return fmt.Errorf("Refusing to use the pool: %s", err)
+	}
+	if !isFileExists(poolDir) && !*argDryRun {
+		if err := os.MkdirAll(poolDir, 0775); err != nil {
+			return err
+		}
+	}
+	syncing := make(map[string]bool)
+	for _, playlist := range playlists {
+		syncing[playlist.PlaylistPersistentId] = true
+	}
+	// playlist files deleted by hand release their tracks
+	for id, entry := range p.manifest.Playlists {
+		if !syncing[id] && !isFileExists(path.Join(p.sink.Path, entry.File)) {
+			logrus.Infof("-- RELEASE: playlist %s (%s removed)", entry.Name, entry.File)
+			delete(p.manifest.Playlists, id)
+		}
+	}
+	changed := false
+	trackActions := make([]IOAction, 0)
+	playlistActions := make([]IOAction, 0)
+	planned := make(map[string]bool)
+	for i, playlist := range playlists {
+		logrus.Infof("---------- Sync: %s --------------", playlist.Name)
+		tracks, err := p.lib.PlaylistTracks(playlist)
+		if err != nil {
+			return err
+		}
+		entry := &PoolPlaylist{
+			Name: playlist.Name,
+			File: p.playlistFileName(playlist, folderPaths[i]),
+		}
+		var m3u bytes.Buffer
+		m3u.WriteString("#EXTM3U\n")
+		for _, track := range tracks {
+			if len(track.Location) == 0 {
+				logrus.Warnf("No File(iCloud): %s", track.Name)
+				continue
+			}
+			profile, ok := p.options.trackProfile(&track)
+			var fileName string
+			var acts []IOAction
+			if !ok {
+				prev, pooled := p.manifest.Tracks[track.PersistentId]
+				if !pooled || p.options.leftOff[track.PersistentId] {
+					continue
+				}
+				// pooled before the device was known not to play it, keep the file
+				logrus.Warnf("-- KEEP  : %s (%s, synced before)", track.Name, prev.FileName)
+				planned[track.PersistentId] = true
+				fileName, acts = prev.FileName, []IOAction{}
+			} else {
+				fileName, acts = p.poolTrack(&track, profile, planned)
+			}
+			if _, ok := p.TrackWrites[track.PersistentId]; !ok {
+				p.TrackWrites[track.PersistentId] = trackWriteSize(acts)
+			}
+			if len(acts) == 0 {
+				p.SkippedTracks += 1
+			} else {
+				p.SyncingTracks += 1
+				changed = true
+			}
+			trackActions = append(trackActions, acts...)
+			entry.Tracks = append(entry.Tracks, track.PersistentId)
+			seconds := -1
+			if track.TotalTime > 0 {
+				seconds = (track.TotalTime + 500) / 1000
+			}
+			title := track.Name
+			if track.Artist != "" {
+				title = track.Artist + " - " + title
+			}
+			fmt.Fprintf(&m3u, "#EXTINF:%d,%s\n%s/%s\n", seconds, title, POOL_DIRNAME, fileName)
+		}
+		if prev, ok := p.manifest.Playlists[playlist.PlaylistPersistentId]; ok && prev.File != entry.File {
+			if act := NewDelete(path.Join(p.sink.Path, prev.File)); act != nil {
+				playlistActions = append(playlistActions, act)
+			}
+		}
+		p.manifest.Playlists[playlist.PlaylistPersistentId] = entry
+		playlistPath := path.Join(p.sink.Path, entry.File)
+		if current, err := ioutil.ReadFile(playlistPath); err != nil || !bytes.Equal(current, m3u.Bytes()) {
+			logrus.Infof("-- WRITE : %s", entry.File)
+			tempPath := path.Join(p.sink.Path, fmt.Sprintf("%s.tmp", playlist.PlaylistPersistentId))
+			playlistActions = append(playlistActions, NewWriteFileAction(playlistPath, tempPath, m3u.Bytes()))
+			changed = true
+		}
+	}
+	deleteActions := p.releaseTracks()
+	p.DeletingTracks = len(deleteActions)
+	if !changed && p.DeletingTracks == 0 {
+		logrus.Debugf("Nothing changed in the pool")
+		return nil
+	}
+	// written after the files, with their sizes and checksums
+	render := func() ([]byte, error) {
+		for id, act := range p.writes {
+			if track, ok := p.manifest.Tracks[id]; ok {
+				track.Size, track.Checksum = act.WrittenFile()
+			}
+		}
+		return json.Marshal(p.manifest)
+	}
+	manifestAction, err := NewLateWriteFileAction(path.Join(p.sink.Path, POOL_MANIFEST_FILENAME), path.Join(p.sink.Path, POOL_MANIFEST_TEMP_FILENAME), render)
+	if err != nil {
+		return err
+	}
+	// Trash -> Copy -> Playlist files -> Manifest
+	for _, acts := range [][]IOAction{deleteActions, trackActions, playlistActions} {
+		for _, act := range acts {
+			engine.Push(act)
+		}
+	}
+	engine.Push(manifestAction)
+	return nil
+}
+
+// Plans the pooled file of the track, once per run
+func (p *PoolPlanner) poolTrack(track *Track, profile *TranscodeProfile, planned map[string]bool) (string, []IOAction) {
+	extension := filepath.Ext(track.Location)
+	profileName := ""
+	if profile != nil {
+		profileName = profile.Name
+		extension = profile.Extension()
+	}
+	fileName := track.PersistentId + extension
+	if planned[track.PersistentId] {
+		return fileName, []IOAction{}
+	}
+	planned[track.PersistentId] = true
+	poolDir := path.Join(p.sink.Path, POOL_DIRNAME)
+	sinkPath := path.Join(poolDir, fileName)
+	produce := func() IOAction {
+		if profile != nil {
+			if act := NewTranscode(track.LocalPath(), sinkPath, track, profile); act != nil {
+				return act
+			}
+		} else if act := NewCopy(track.LocalPath(), sinkPath, track); act != nil {
+			return act
+		}
+		return nil
+	}
+	acts := make([]IOAction, 0)
+	prev, exists := p.manifest.Tracks[track.PersistentId]
+	switch {
+	case !exists:
+		logrus.Infof("-- COPY  : %s", track.Name)
+		acts = append(acts, produce())
+	case prev.ModifiedTime.Before(track.DateModified) || prev.TranscodeProfile != profileName || prev.FileName != fileName ||
+		p.options.Repair[path.Join(poolDir, prev.FileName)]:
+		if p.options.Repair[path.Join(poolDir, prev.FileName)] {
+			logrus.Infof("-- REPAIR: %s (%s)", track.Name, prev.FileName)
+		} else {
+			logrus.Infof("-- UPDATE: %s", track.Name)
+		}
+		if prevPath := path.Join(poolDir, prev.FileName); isWritable(prevPath) {
+			acts = append(acts, NewDelete(prevPath))
+		}
+		acts = append(acts, produce())
+	case !isFileExists(sinkPath):
+		logrus.Infof("-- COPY**: %s (pooled file missing)", track.Name)
+		acts = append(acts, produce())
+	default:
+		logrus.Debugf("-- NOP   : %s", track.Name)
+	}
+	if len(acts) > 0 || !exists {
+		p.manifest.Tracks[track.PersistentId] = &PoolTrack{
+			FileName:         fileName,
+			ModifiedTime:     track.DateModified,
+			TranscodeProfile: profileName,
+		}
+	}
+	for _, act := range acts {
+		if wf, ok := act.(writtenFileAction); ok {
+			p.writes[track.PersistentId] = wf
+		}
+	}
+	return fileName, acts
+}
+
+// Recounts references, and deletes pooled files no playlist refers to
+func (p *PoolPlanner) releaseTracks() []IOAction {
+	for _, track := range p.manifest.Tracks {
+		track.Refs = []string{}
+	}
+	for playlistId, playlist := range p.manifest.Playlists {
+		for _, trackId := range playlist.Tracks {
+			if track, ok := p.manifest.Tracks[trackId]; ok {
+				track.Refs = append(track.Refs, playlistId)
+			}
+		}
+	}
+	ret := make([]IOAction, 0)
+	for trackId, track := range p.manifest.Tracks {
+		sort.Strings(track.Refs)
+		if len(track.Refs) > 0 {
+			continue
+		}
+		logrus.Infof("-- DELETE: %s (no more playlists)", track.FileName)
+		delete(p.manifest.Tracks, trackId)
+		if act := NewDelete(path.Join(p.sink.Path, POOL_DIRNAME, track.FileName)); act != nil {
+			ret = append(ret, act)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Loads Rhythmbox rhythmdb.xml and playlists.xml into Library, so they can be
+// synced just like iTunes playlists.
+//
+// playlists.xml has no playlist IDs. They are kept in the cache dir, and a
+// playlist which is gone comes back with its ID under the new name if
+// another playlist has the same query (automatic) or mostly the same
+// tracks (static), so renames are followed on the device.
+
+type rhythmDB struct {
+	Entries []rhythmDBEntry `xml:"entry"`
+}
+
+type rhythmDBEntry struct {
+	Type   string          `xml:"type,attr"`
+	Fields []rhythmDBField `xml:",any"`
+}
+
+type rhythmDBField struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+type rhythmboxPlaylists struct {
+	Playlists []rhythmboxPlaylist `xml:"playlist"`
+}
+
+type rhythmboxPlaylist struct {
+	Name          string           `xml:"name,attr"`
+	Type          string           `xml:"type,attr"`
+	SortKey       string           `xml:"sort-key,attr"`
+	SortDirection int              `xml:"sort-direction,attr"`
+	LimitCount    int              `xml:"limit-count,attr"`
+	LimitSize     int64            `xml:"limit-size,attr"` // MiB
+	LimitTime     int              `xml:"limit-time,attr"` // seconds
+	Locations     []string         `xml:"location"`
+	Query         []rhythmboxQuery `xml:"conjunction"`
+}
+
+// Criteria of automatic playlist.
+// <conjunction> holds criteria, <disjunction/> splits them into OR groups and
+// <subquery> nests another <conjunction>.
+type rhythmboxQuery struct {
+	XMLName  xml.Name
+	Prop     string           `xml:"prop,attr"`
+	Value    string           `xml:",chardata"`
+	Children []rhythmboxQuery `xml:",any"`
+}
+
+// Entry fields, keyed by element name in rhythmdb.xml ("title", "play-count", ...)
+type rhythmboxEntry map[string]string
+
+func (e rhythmboxEntry) Int(prop string) int64 {
+	value, err := strconv.ParseFloat(e[prop], 64)
+	if err != nil {
+		return 0
+	}
+	return int64(value)
+}
+
+// Rhythmbox stores dates as GDate julian days (0001-01-01 is day 1)
+func julianDayToTime(day int64) time.Time {
+	if day <= 0 {
+		return time.Time{}
+	}
+	return time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, int(day-1))
+}
+
+func defaultRhythmboxPaths() (string, string) {
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		dataDir = path.Join(os.Getenv("HOME"), ".local/share")
+	}
+	return path.Join(dataDir, "rhythmbox/rhythmdb.xml"), path.Join(dataDir, "rhythmbox/playlists.xml")
+}
+
+func decodeXMLFile(filePath string, v interface{}) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return xml.NewDecoder(f).Decode(v)
+}
+
+func (e rhythmboxEntry) toTrack(trackId int) Track {
+	year := 0
+	if date := e.Int("date"); date > 0 {
+		year = julianDayToTime(date).Year()
+	}
+	return Track{
+		TrackId:      trackId,
+		Name:         e["title"],
+		Artist:       e["artist"],
+		AlbumArtist:  e["album-artist"],
+		Composer:     e["composer"],
+		Album:        e["album"],
+		Genre:        e["genre"],
+		Kind:         e["media-type"],
+		Size:         int(e.Int("file-size")),
+		TotalTime:    int(e.Int("duration")) * 1000,
+		TrackNumber:  int(e.Int("track-number")),
+		DiscNumber:   int(e.Int("disc-number")),
+		Year:         year,
+		DateModified: time.Unix(e.Int("mtime"), 0),
+		DateAdded:    time.Unix(e.Int("first-seen"), 0),
+		BitRate:      int(e.Int("bitrate")),
+		PlayCount:    int(e.Int("play-count")),
+		PlayDateUTC:  time.Unix(e.Int("last-played"), 0),
+		Rating:       int(e.Int("rating")) * 20, // 0-5 stars to iTunes' 0-100
+		PersistentId: derivePersistentId(e["location"]),
+		TrackType:    "File",
+		Location:     e["location"],
+	}
+}
+
+// Static playlists sharing this part of their tracks are the same playlist
+const RHYTHMBOX_RENAME_OVERLAP = 0.5
+
+// Playlists of the last load, persistent ID -> playlist
+type rhythmboxPlaylistIds struct {
+	Playlists map[string]*rhythmboxPlaylistId `json:"playlists"`
+}
+
+type rhythmboxPlaylistId struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// automatic: digest of the query, sort order and limits
+	Query string `json:"query,omitempty"`
+	// static: persistent IDs of the tracks
+	Tracks []string `json:"tracks,omitempty"`
+}
+
+func loadRhythmboxPlaylistIds(idsPath string) *rhythmboxPlaylistIds {
+	ids := &rhythmboxPlaylistIds{Playlists: make(map[string]*rhythmboxPlaylistId)}
+	data, err := ioutil.ReadFile(idsPath)
+	if err != nil {
+		return ids
+	}
+	if err := json.Unmarshal(data, ids); err != nil || ids.Playlists == nil {
+		logrus.Infof("Discarding Rhythmbox playlist IDs: %s", idsPath)
+		ids.Playlists = make(map[string]*rhythmboxPlaylistId)
+	}
+	return ids
+}
+
+func (ids *rhythmboxPlaylistIds) save(idsPath string) error {
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(idsPath), 0755); err != nil {
+		return err
+	}
+	tempPath := idsPath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, idsPath)
+}
+
+// What stays the same when the playlist is renamed
+func (pl *rhythmboxPlaylist) identity(trackIds []string) *rhythmboxPlaylistId {
+	id := &rhythmboxPlaylistId{Name: pl.Name, Type: pl.Type}
+	if pl.Type == "automatic" {
+		query, _ := xml.Marshal(pl.Query)
+		id.Query = derivePersistentId(fmt.Sprintf("%s\x00%s\x00%d\x00%d\x00%d\x00%d", query, pl.SortKey, pl.SortDirection, pl.LimitCount, pl.LimitSize, pl.LimitTime))
+	} else {
+		id.Tracks = trackIds
+	}
+	return id
+}
+
+// Whether other is this playlist under another name
+func (id *rhythmboxPlaylistId) sameAs(other *rhythmboxPlaylistId) bool {
+	if id.Type != other.Type {
+		return false
+	}
+	if id.Type == "automatic" {
+		return id.Query == other.Query
+	}
+	if len(id.Tracks) == 0 || len(other.Tracks) == 0 {
+		return false
+	}
+	tracks := make(map[string]bool)
+	for _, track := range id.Tracks {
+		tracks[track] = true
+	}
+	shared := 0
+	for _, track := range other.Tracks {
+		if tracks[track] {
+			shared += 1
+		}
+	}
+	union := len(id.Tracks) + len(other.Tracks) - shared
+	return float64(shared) >= RHYTHMBOX_RENAME_OVERLAP*float64(union)
+}
+
+// Persistent IDs of the playlists: kept by name, taken over from a vanished
+// playlist with the same identity, or derived from the name
+func (ids *rhythmboxPlaylistIds) assign(identities []*rhythmboxPlaylistId) []string {
+	byName := make(map[string]string)
+	for id, known := range ids.Playlists {
+		byName[known.Name] = id
+	}
+	present := make(map[string]bool)
+	for _, identity := range identities {
+		present[identity.Name] = true
+	}
+	vanished := make([]string, 0)
+	for id, known := range ids.Playlists {
+		if !present[known.Name] {
+			vanished = append(vanished, id)
+		}
+	}
+	sort.Strings(vanished)
+	taken := make(map[string]bool)
+	ret := make([]string, len(identities))
+	for i, identity := range identities {
+		if id, ok := byName[identity.Name]; ok {
+			ret[i] = id
+			taken[id] = true
+		}
+	}
+	for i, identity := range identities {
+		if ret[i] != "" {
+			continue
+		}
+		for _, id := range vanished {
+			if !taken[id] && ids.Playlists[id].sameAs(identity) {
+				logrus.Infof("Rhythmbox: %s was renamed to %s", ids.Playlists[id].Name, identity.Name)
+				ret[i] = id
+				break
+			}
+		}
+		if ret[i] == "" {
+			ret[i] = derivePersistentId("playlist:" + identity.Name)
+			for taken[ret[i]] {
+				ret[i] = derivePersistentId("playlist:" + ret[i])
+			}
+		}
+		taken[ret[i]] = true
+	}
+	ids.Playlists = make(map[string]*rhythmboxPlaylistId)
+	for i, identity := range identities {
+		ids.Playlists[ret[i]] = identity
+	}
+	return ret
+}
+
+// IDs are kept in cacheDir, playlists get new IDs on every load if empty
+func LoadRhythmboxLibrary(dbPath, playlistsPath, cacheDir string) (*Library, error) {
+	var db rhythmDB
+	if err := decodeXMLFile(dbPath, &db); err != nil {
+		return nil, err
+	}
+	library := &Library{
+		Tracks: make(map[string]Track),
+	}
+	entries := make([]rhythmboxEntry, 0, len(db.Entries))
+	locationMap := make(map[string]int)
+	for _, rawEntry := range db.Entries {
+		if rawEntry.Type != "song" {
+			continue
+		}
+		entry := rhythmboxEntry{"type": rawEntry.Type}
+		for _, field := range rawEntry.Fields {
+			entry[field.XMLName.Local] = field.Value
+		}
+		if entry["hidden"] == "1" {
+			continue
+		}
+		trackId := len(entries) + 1
+		entry["track-id"] = strconv.Itoa(trackId)
+		entries = append(entries, entry)
+		locationMap[entry["location"]] = trackId
+		library.Tracks[strconv.Itoa(trackId)] = entry.toTrack(trackId)
+	}
+
+	var playlists rhythmboxPlaylists
+	if err := decodeXMLFile(playlistsPath, &playlists); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		logrus.Warnf("Rhythmbox playlists not found: %s", playlistsPath)
+	}
+	known := make([]rhythmboxPlaylist, 0, len(playlists.Playlists))
+	identities := make([]*rhythmboxPlaylistId, 0, len(playlists.Playlists))
+	for _, pl := range playlists.Playlists {
+		switch pl.Type {
+		case "static", "queue", "automatic":
+		default:
+			logrus.Debugf("Rhythmbox: unknown playlist type %s (%s)", pl.Type, pl.Name)
+			continue
+		}
+		trackIds := make([]string, 0, len(pl.Locations))
+		for _, location := range pl.Locations {
+			trackIds = append(trackIds, derivePersistentId(location))
+		}
+		known = append(known, pl)
+		identities = append(identities, pl.identity(trackIds))
+	}
+	idsPath := ""
+	ids := &rhythmboxPlaylistIds{Playlists: make(map[string]*rhythmboxPlaylistId)}
+	if cacheDir != "" {
+		idsPath = path.Join(cacheDir, fmt.Sprintf("rhythmbox-%s.json", derivePersistentId(playlistsPath)))
+		ids = loadRhythmboxPlaylistIds(idsPath)
+	}
+	playlistIds := ids.assign(identities)
+	if idsPath != "" {
+		if err := ids.save(idsPath); err != nil {
+			logrus.Warnf("Cannot save Rhythmbox playlist IDs, renames won't be followed: %s", err)
+		}
+	}
+	for i, pl := range known {
+		playlist := Playlist{
+			Name:                 pl.Name,
+			PlaylistPersistentId: playlistIds[i],
+			Visible:              true,
+		}
+		if pl.Type == "automatic" {
+			for _, entry := range pl.evaluate(entries, playlistIds[i]) {
+				playlist.PlaylistItems = append(playlist.PlaylistItems, PlaylistItem{TrackId: int(entry.Int("track-id"))})
+			}
+		} else {
+			for _, location := range pl.Locations {
+				if trackId, ok := locationMap[location]; ok {
+					playlist.PlaylistItems = append(playlist.PlaylistItems, PlaylistItem{TrackId: trackId})
+				} else {
+					logrus.Debugf("Rhythmbox: %s is not in rhythmdb (playlist %s)", location, pl.Name)
+				}
+			}
+		}
+		library.Playlists = append(library.Playlists, playlist)
+	}
+	library.buildIndex()
+	return library, nil
+}
+
+// ---------------- automatic playlists ----------------
+
+func (pl *rhythmboxPlaylist) evaluate(entries []rhythmboxEntry, playlistId string) []rhythmboxEntry {
+	matched := make([]rhythmboxEntry, 0)
+	now := time.Now()
+	for _, entry := range entries {
+		if len(pl.Query) == 0 || pl.Query[0].matchConjunction(entry, now) {
+			matched = append(matched, entry)
+		}
+	}
+	pl.sortEntries(matched, playlistId)
+	return pl.limitEntries(matched)
+}
+
+// sort-key to entry property, and whether the property is numeric
+var rhythmboxSortKeys = map[string]struct {
+	prop    string
+	numeric bool
+}{
+	"Track":      {"track-number", true},
+	"Title":      {"title", false},
+	"Artist":     {"artist", false},
+	"Composer":   {"composer", false},
+	"Album":      {"album", false},
+	"Genre":      {"genre", false},
+	"Comment":    {"comment", false},
+	"Duration":   {"duration", true},
+	"Year":       {"date", true},
+	"Quality":    {"bitrate", true},
+	"Rating":     {"rating", true},
+	"PlayCount":  {"play-count", true},
+	"LastPlayed": {"last-played", true},
+	"FirstSeen":  {"first-seen", true},
+	"Location":   {"location", false},
+	"BPM":        {"bpm", true},
+}
+
+// "Random" is shuffled by a digest of the playlist and the track, so the
+// order (and the files on the device) stays the same between syncs, and
+// tracks added later don't move the others
+func (pl *rhythmboxPlaylist) sortEntries(entries []rhythmboxEntry, playlistId string) {
+	if pl.SortKey == "Random" {
+		keys := make(map[string]string, len(entries))
+		for _, entry := range entries {
+			keys[entry["location"]] = derivePersistentId(playlistId + "\x00" + entry["location"])
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return keys[entries[i]["location"]] < keys[entries[j]["location"]]
+		})
+		return
+	}
+	key, ok := rhythmboxSortKeys[pl.SortKey]
+	if !ok {
+		return
+	}
+	descending := pl.SortDirection == 1
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if descending {
+			a, b = b, a
+		}
+		if key.numeric {
+			return a.Int(key.prop) < b.Int(key.prop)
+		}
+		return strings.ToLower(a[key.prop]) < strings.ToLower(b[key.prop])
+	})
+}
+
+func (pl *rhythmboxPlaylist) limitEntries(entries []rhythmboxEntry) []rhythmboxEntry {
+	if pl.LimitCount > 0 && len(entries) > pl.LimitCount {
+		entries = entries[:pl.LimitCount]
+	}
+	var size, duration int64
+	for i, entry := range entries {
+		size += entry.Int("file-size")
+		duration += entry.Int("duration")
+		if (pl.LimitSize > 0 && size > pl.LimitSize*MiB) || (pl.LimitTime > 0 && duration > int64(pl.LimitTime)) {
+			return entries[:i]
+		}
+	}
+	return entries
+}
+
+func (q *rhythmboxQuery) matchConjunction(entry rhythmboxEntry, now time.Time) bool {
+	// criteria are AND-ed, <disjunction/> separates OR groups
+	groupMatched := true
+	for _, child := range q.Children {
+		if child.XMLName.Local == "disjunction" {
+			if groupMatched {
+				return true
+			}
+			groupMatched = true
+			continue
+		}
+		if groupMatched && !child.match(entry, now) {
+			groupMatched = false
+		}
+	}
+	return groupMatched
+}
+
+func (q *rhythmboxQuery) match(entry rhythmboxEntry, now time.Time) bool {
+	op := q.XMLName.Local
+	switch op {
+	case "subquery", "conjunction":
+		if op == "subquery" && len(q.Children) == 1 && q.Children[0].XMLName.Local == "conjunction" {
+			return q.Children[0].matchConjunction(entry, now)
+		}
+		return q.matchConjunction(entry, now)
+	}
+	if q.Prop == "search-match" {
+		text := strings.ToLower(strings.Join([]string{entry["title"], entry["artist"], entry["album"], entry["genre"], entry["album-artist"], entry["composer"]}, " "))
+		for _, word := range strings.Fields(strings.ToLower(q.Value)) {
+			if !strings.Contains(text, word) {
+				return false
+			}
+		}
+		return true
+	}
+	actual := strings.ToLower(entry[q.Prop])
+	expected := strings.ToLower(q.Value)
+	actualNum, actualErr := strconv.ParseFloat(actual, 64)
+	expectedNum, expectedErr := strconv.ParseFloat(expected, 64)
+	numeric := actualErr == nil && expectedErr == nil
+	switch op {
+	case "equals":
+		if numeric {
+			return actualNum == expectedNum
+		}
+		return actual == expected
+	case "not-equal":
+		if numeric {
+			return actualNum != expectedNum
+		}
+		return actual != expected
+	case "like":
+		return strings.Contains(actual, expected)
+	case "not-like":
+		return !strings.Contains(actual, expected)
+	case "prefix":
+		return strings.HasPrefix(actual, expected)
+	case "suffix":
+		return strings.HasSuffix(actual, expected)
+	case "greater":
+		return numeric && actualNum > expectedNum
+	case "less":
+		return numeric && actualNum < expectedNum
+	case "current-time-within":
+		return numeric && actualNum > 0 && float64(now.Unix())-actualNum <= expectedNum
+	case "current-time-not-within":
+		return numeric && float64(now.Unix())-actualNum > expectedNum
+	case "year-equals", "year-greater", "year-less":
+		if !numeric {
+			return false
+		}
+		actualYear := julianDayToTime(int64(actualNum)).Year()
+		expectedYear := julianDayToTime(int64(expectedNum)).Year()
+		switch op {
+		case "year-equals":
+			return actualYear == expectedYear
+		case "year-greater":
+			return actualYear > expectedYear
+		default:
+			return actualYear < expectedYear
+		}
+	default:
+		logrus.Warnf("Rhythmbox: unsupported criteria %s", q.describe())
+		return false
+	}
+}
+
+func (q *rhythmboxQuery) describe() string {
+	return fmt.Sprintf("<%s prop=%q>%s", q.XMLName.Local, q.Prop, q.Value)
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/Sirupsen/logrus"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"time"
 	"strconv"
+	"strings"
 )
 
 const META_JSON_FILENAME = "meta.json"
 const META_JSON_TEMP_FILENAME = "meta.temp.json"
+const PLAYLIST_FILE_TEMP_FILENAME = "playlist.temp.m3u8"
 
 type Sink struct {
-	Path string
+	Path       string
+	Filesystem *FilesystemProfile
+	// Existing sink dirs on the device, relative path -> SinkDir (without tracks)
+	knownDirs map[string]*SinkDir
+	// Sink dirs moving in this run, previous relative path -> new one
+	moves map[string]string
 }
 
 type SinkDir struct {
@@ -23,6 +34,17 @@ type SinkDir struct {
 	Tracks             map[string]*TrackMeta `json:"tracks"`
 	OriginPlaylistID   string                `json:"origin_playlist_id"`
 	OriginPlaylistName string                `json:"origin_playlist_name"`
+	OriginFolderPath   []string              `json:"origin_folder_path,omitempty"`
+	PlaylistFile       string                `json:"playlist_file,omitempty"`
+	FileNameTemplate   string                `json:"filename_template,omitempty"`
+	// Files not matched by adopt, kept on the device and not listed again
+	IgnoredFiles []string `json:"ignored_files,omitempty"`
+	// Moved from another place in this run, or the origin in meta.json is
+	// outdated: meta.json needs rewriting
+	Moved bool `json:"-"`
+	// Moves the directory to its new place after the other actions in it,
+	// nil if it stays
+	Move *MoveDir `json:"-"`
 }
 
 type TrackMeta struct {
@@ -30,15 +52,34 @@ type TrackMeta struct {
 	OriginPersistentID string    `json:"origin_persistent_id"`
 	FileName           string    `json:"filename"`
 	ModifiedTime       time.Time `json:"modified_time"`
+	// Transcode profile the file was made with, empty if copied as is
+	TranscodeProfile string `json:"transcode_profile,omitempty"`
+	// Size and checksum of the file written to the device, empty for files
+	// synced before they were recorded
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	// Found broken by verify, copied again
+	Broken bool `json:"-"`
 }
 
-func NewSink(sinkPath string) (*Sink, error) {
+func NewSink(sinkPath string, filesystem *FilesystemProfile) (*Sink, error) {
 	// TODO: validate sinkPath
 	return &Sink{
-		Path: sinkPath,
+		Path:       sinkPath,
+		Filesystem: filesystem,
+		moves:      make(map[string]string),
 	}, nil
 }
 
+// "Folder/Sub/Playlist", each part valid on the filesystem
+func playlistRelDir(filesystem *FilesystemProfile, folders []string, name string) string {
+	parts := make([]string, 0, len(folders)+1)
+	for _, part := range append(append([]string{}, folders...), name) {
+		parts = append(parts, filesystem.Sanitize(part))
+	}
+	return path.Join(parts...)
+}
+
 // TODO: Should cache result?
 func (s *Sink) OpenSinkDir(name string, createIfAbsent bool) (*SinkDir, error) {
 	dirPath := path.Join(s.Path, name)
@@ -49,11 +90,149 @@ func (s *Sink) OpenSinkDir(name string, createIfAbsent bool) (*SinkDir, error) {
 		} else {
 			return nil, fmt.Errorf("Sink directory %s does not exist!", dirPath)
 		}
+	} else if createIfAbsent && !isFileExists(path.Join(dirPath, META_JSON_FILENAME)) {
+		// created by an interrupted run, or by an earlier plan of this run.
+		// Files copied by hand would be overwritten by the sync.
+		if !hasOnlyTempFiles(dirPath) {
+			return nil, fmt.Errorf("%s has files but no meta.json, take them over by 'iwalk adopt' or move them away", dirPath)
+		}
+		return s.createSinkDir(dirPath)
 	} else {
 		return s.openSinkDirContents(dirPath)
 	}
 }
 
+// Opens sink dir of the playlist at "Folder/Sub/Playlist". If it is not
+// there but the playlist was synced elsewhere (renamed or re-parented),
+// the directory is opened there and moved at the end of the sync, see
+// SinkDir.Move. claimed holds relative paths of other playlists in this run,
+// which are never taken.
+func (s *Sink) OpenPlaylistDir(playlist *Playlist, folders []string, claimed map[string]bool) (*SinkDir, error) {
+	relDir := playlistRelDir(s.Filesystem, folders, playlist.Name)
+	dirPath := path.Join(s.Path, relDir)
+	var sinkDir *SinkDir
+	var err error
+	prevDir, moved := "", false
+	if !isFileExists(dirPath) {
+		prevDir, moved = s.findMovedSinkDir(playlist, relDir, claimed)
+	}
+	if moved {
+		sinkDir, err = s.planSinkDirMove(prevDir, relDir)
+	} else {
+		sinkDir, err = s.OpenSinkDir(relDir, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sinkDir.setOrigin(playlist, folders)
+	return sinkDir, nil
+}
+
+// Records the playlist synced into the directory. meta.json written before
+// playlist IDs or folders were recorded, or by the playlist under another
+// name, is rewritten even if no track changes.
+func (s *SinkDir) setOrigin(playlist *Playlist, folders []string) {
+	if s.OriginPlaylistID != playlist.PlaylistPersistentId || s.OriginPlaylistName != playlist.Name ||
+		strings.Join(s.OriginFolderPath, "/") != strings.Join(folders, "/") {
+		s.Moved = true
+	}
+	s.OriginPlaylistID = playlist.PlaylistPersistentId
+	s.OriginPlaylistName = playlist.Name
+	s.OriginFolderPath = folders
+}
+
+// Relative paths of directories having meta.json
+func (s *Sink) scanSinkDirs() map[string]*SinkDir {
+	if s.knownDirs != nil {
+		return s.knownDirs
+	}
+	s.knownDirs = make(map[string]*SinkDir)
+	filepath.Walk(s.Path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && filePath != s.Path && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || info.Name() != META_JSON_FILENAME {
+			return nil
+		}
+		dirPath := path.Dir(filePath)
+		relDir, err := filepath.Rel(s.Path, dirPath)
+		if err != nil {
+			return nil
+		}
+		sinkDir, err := s.openSinkDirContents(dirPath)
+		if err != nil {
+			logrus.Warnf("Broken %s: %s", filePath, err)
+			return nil
+		}
+		s.knownDirs[relDir] = sinkDir
+		return nil
+	})
+	return s.knownDirs
+}
+
+// Sink dir the playlist was synced to before. Candidates are tried in
+// path order, so the same one is found by every plan of the run.
+func (s *Sink) findMovedSinkDir(playlist *Playlist, relDir string, claimed map[string]bool) (string, bool) {
+	dirs := s.scanSinkDirs()
+	prevDirs := make([]string, 0, len(dirs))
+	for prevDir := range dirs {
+		prevDirs = append(prevDirs, prevDir)
+	}
+	sort.Strings(prevDirs)
+	byName := ""
+	for _, prevDir := range prevDirs {
+		sinkDir := dirs[prevDir]
+		if prevDir == relDir || claimed[prevDir] {
+			continue
+		}
+		if movedTo, ok := s.moves[prevDir]; ok && movedTo != relDir {
+			continue
+		}
+		if sinkDir.OriginPlaylistID != "" {
+			if sinkDir.OriginPlaylistID == playlist.PlaylistPersistentId {
+				return prevDir, true
+			}
+			continue
+		}
+		// directories made before the playlist was recorded are at top level
+		if byName == "" && (sinkDir.OriginPlaylistName == playlist.Name || (sinkDir.OriginPlaylistName == "" && prevDir == playlist.Name)) {
+			byName = prevDir
+		}
+	}
+	return byName, byName != ""
+}
+
+// Opens the sink dir at prevDir, to be moved to relDir by SinkDir.Move
+func (s *Sink) planSinkDirMove(prevDir, relDir string) (*SinkDir, error) {
+	prevPath, dirPath := path.Join(s.Path, prevDir), path.Join(s.Path, relDir)
+	for _, p := range []string{prevPath, dirPath} {
+		if err := checkContained([]string{s.Path}, p); err != nil {
+			return nil, fmt.Errorf("Refusing to move sink dir: %s", err)
+		}
+	}
+	logrus.Infof("Moving sink dir: %s -> %s", prevDir, relDir)
+	sinkDir, err := s.openSinkDirContents(prevPath)
+	if err != nil {
+		return nil, err
+	}
+	s.moves[prevDir] = relDir
+	sinkDir.Move = NewMoveDir(prevPath, dirPath, s.Path)
+	sinkDir.Moved = true
+	return sinkDir, nil
+}
+
+// Cleans up folder directories under root left empty by a move
+func removeEmptyParents(root, dirPath string) {
+	for parent := path.Dir(dirPath); strings.HasPrefix(parent, root+"/"); parent = path.Dir(parent) {
+		if os.Remove(parent) != nil {
+			return // not empty
+		}
+	}
+}
+
 // dirPath should be valid directory path
 func (s *Sink) openSinkDirContents(dirPath string) (*SinkDir, error) {
 	metaPath := path.Join(dirPath, META_JSON_FILENAME)
@@ -74,12 +253,49 @@ func (s *Sink) openSinkDirContents(dirPath string) (*SinkDir, error) {
 	}
 }
 
+// Whether dirPath holds nothing but temp files of interrupted runs, dot
+// files, and sink dirs of other playlists under it
+func hasOnlyTempFiles(dirPath string) bool {
+	err := filepath.Walk(dirPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			// .DS_Store, ._ files of macOS, as scanAdoptFiles skips them
+			if info.IsDir() && p != dirPath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if p != dirPath && isFileExists(path.Join(p, META_JSON_FILENAME)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch info.Name() {
+		case META_JSON_TEMP_FILENAME, PLAYLIST_FILE_TEMP_FILENAME:
+			return nil
+		}
+		if strings.ToLower(filepath.Ext(p)) == ".tmp" {
+			return nil
+		}
+		return fmt.Errorf("%s is not a temp file", p)
+	})
+	return err == nil
+}
+
 func (s *Sink) createSinkDir(dirPath string) (*SinkDir, error) {
+	if err := checkContained([]string{s.Path}, dirPath); err != nil {
+		return nil, fmt.Errorf("Refusing to create sink dir: %s", err)
+	}
 	if *argDryRun {
 		logrus.Infof("DRYRUN: Creating new sink dir: %s", dirPath)
 	} else {
 		logrus.Infof("Creating new sink dir: %s", dirPath)
-		os.MkdirAll(dirPath, 0775)
+		if err := os.MkdirAll(dirPath, 0775); err != nil {
+			return nil, err
+		}
 	}
 	return &SinkDir{
 		CheckedTracks: make(map[string]bool),
@@ -88,32 +304,51 @@ func (s *Sink) createSinkDir(dirPath string) (*SinkDir, error) {
 	}, nil
 }
 
-func (s *SinkDir) copyFromLocal(track *Track, sinkPath string) IOAction {
-	localPath := normalizeLocation(track.Location)
-	return NewCopy(localPath, sinkPath, track)
+// Copies the track, or converts it if profile is given
+func (s *SinkDir) copyFromLocal(track *Track, sinkPath string, profile *TranscodeProfile) IOAction {
+	if profile != nil {
+		if act := NewTranscode(track.LocalPath(), sinkPath, track, profile); act != nil {
+			return act
+		}
+		return nil
+	}
+	if act := NewCopy(track.LocalPath(), sinkPath, track); act != nil {
+		return act
+	}
+	return nil
 }
 
-func (s *SinkDir) SinkTrack(track *Track, fileName string) []IOAction {
+func (s *SinkDir) SinkTrack(track *Track, fileName string, profile *TranscodeProfile) []IOAction {
 	trackId := track.PersistentId
 	meta, previouslyExists := s.Tracks[trackId]
 	sinkPath := path.Join(s.Path, fileName)
+	profileName := ""
+	if profile != nil {
+		profileName = profile.Name
+	}
 	if previouslyExists {
 		defer func() {
 			s.CheckedTracks[trackId] = true
 		}()
 		prevPath := path.Join(s.Path, meta.FileName)
-		if meta.ModifiedTime.Before(track.DateModified) {
+		if meta.TranscodeProfile != profileName {
+			logrus.Infof("-- PROFILE: %s (%q -> %q)", track.Name, meta.TranscodeProfile, profileName)
+		}
+		if meta.Broken {
+			logrus.Infof("-- REPAIR: %s (%s)", track.Name, meta.FileName)
+		}
+		if meta.ModifiedTime.Before(track.DateModified) || meta.TranscodeProfile != profileName || meta.Broken {
 			// has update
 			if isWritable(prevPath) {
 				logrus.Infof("-- UPDATE: %s (%s -> %s)", track.Name, meta.FileName, fileName)
 				return []IOAction{
 					NewDelete(prevPath),
-					s.copyFromLocal(track, sinkPath),
+					s.copyFromLocal(track, sinkPath, profile),
 				}
 			} else {
 				logrus.Warnf("-- UPDATE: %s (could not delete old file %s)", track.Name, meta.FileName)
 				return []IOAction{
-					s.copyFromLocal(track, sinkPath),
+					s.copyFromLocal(track, sinkPath, profile),
 				}
 			}
 		} else {
@@ -127,21 +362,21 @@ func (s *SinkDir) SinkTrack(track *Track, fileName string) []IOAction {
 				return []IOAction{NewRename(prevPath, sinkPath)}
 			} else {
 				logrus.Infof("-- COPY**: %s (Unable to find previous file: %s)", track.Name, meta.FileName)
-				return []IOAction{s.copyFromLocal(track, sinkPath)}
+				return []IOAction{s.copyFromLocal(track, sinkPath, profile)}
 			}
 		}
 	} else {
 		// perform copy
 		logrus.Infof("-- COPY  : %s", track.Name)
-		return []IOAction{s.copyFromLocal(track, sinkPath)}
+		return []IOAction{s.copyFromLocal(track, sinkPath, profile)}
 	}
 }
 
-func (s *SinkDir) TrashUncheckedTracks(lib *Library) []IOAction {
+func (s *SinkDir) TrashUncheckedTracks(lib LibrarySource) []IOAction {
 	ret := make([]IOAction, 0)
 	for trackId, trackMeta := range s.Tracks {
 		if _, ok := s.CheckedTracks[trackId]; !ok {
-			if originTrack, ok := lib.Tracks[trackMeta.OriginID]; ok {
+			if originTrack, ok := lib.FindTrack(trackMeta.OriginPersistentID); ok {
 				logrus.Infof("-- DELETE: %s (%s)", originTrack.Name, trackMeta.FileName)
 			} else {
 				logrus.Infof("-- DELETE: %s", trackMeta.FileName)
@@ -157,23 +392,86 @@ func (s *SinkDir) TrashUncheckedTracks(lib *Library) []IOAction {
 	return ret
 }
 
+// meta.json is written after the files, with their sizes and checksums
 func (s *SinkDir) UpdateMeta(sinkResults []SinkResult) ([]IOAction, error) {
-	s.Tracks = make(map[string]*TrackMeta)
-	for _, result := range sinkResults {
-		trackId := result.Track.PersistentId
-		s.Tracks[trackId] = &TrackMeta{
-			OriginID:           strconv.Itoa(result.Track.TrackId),
-			OriginPersistentID: result.Track.PersistentId,
-			FileName:           result.Filename,
-			ModifiedTime:       result.Track.DateModified,
+	prevTracks := s.Tracks
+	render := func() ([]byte, error) {
+		s.Tracks = make(map[string]*TrackMeta)
+		for _, result := range sinkResults {
+			trackId := result.Track.PersistentId
+			meta := &TrackMeta{
+				OriginID:           strconv.Itoa(result.Track.TrackId),
+				OriginPersistentID: result.Track.PersistentId,
+				FileName:           result.Filename,
+				ModifiedTime:       result.Track.DateModified,
+				TranscodeProfile:   result.TranscodeProfile,
+			}
+			written := false
+			for _, act := range result.Performed {
+				if wf, ok := act.(writtenFileAction); ok {
+					meta.Size, meta.Checksum = wf.WrittenFile()
+					written = true
+				}
+			}
+			if prev, ok := prevTracks[trackId]; ok && !written {
+				// unchanged or renamed
+				meta.Size, meta.Checksum = prev.Size, prev.Checksum
+			}
+			s.Tracks[trackId] = meta
 		}
+		return json.Marshal(s)
 	}
 	metaPath := path.Join(s.Path, META_JSON_FILENAME)
-	data, err := json.Marshal(s)
+	act, err := NewLateWriteFileAction(metaPath, path.Join(s.Path, META_JSON_TEMP_FILENAME), render)
 	if err != nil {
 		return []IOAction{}, err
 	}
-	return ([]IOAction{
-		NewWriteFileAction(metaPath, path.Join(s.Path, META_JSON_TEMP_FILENAME), data),
-	}), nil
+	return ([]IOAction{act}), nil
+}
+
+// Writes M3U8 with the synced files in order, and removes the previous
+// playlist file if its name changed. Empty fileName only removes.
+func (s *SinkDir) WritePlaylistFile(sinkResults []SinkResult, fileName string) []IOAction {
+	ret := make([]IOAction, 0)
+	if s.PlaylistFile != "" && s.PlaylistFile != fileName {
+		prevPath := path.Join(s.Path, s.PlaylistFile)
+		if isWritable(prevPath) {
+			ret = append(ret, NewDelete(prevPath))
+		}
+	}
+	s.PlaylistFile = fileName
+	if fileName == "" {
+		return ret
+	}
+	return append(ret, NewWriteFileAction(path.Join(s.Path, fileName), path.Join(s.Path, PLAYLIST_FILE_TEMP_FILENAME), playlistFileContent(sinkResults)))
+}
+
+// M3U8 listing the results in order
+func playlistFileContent(sinkResults []SinkResult) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	for _, result := range sinkResults {
+		seconds := -1
+		if result.Track.TotalTime > 0 {
+			seconds = (result.Track.TotalTime + 500) / 1000
+		}
+		title := result.Track.Name
+		if result.Track.Artist != "" {
+			title = result.Track.Artist + " - " + title
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%d,%s\n%s\n", seconds, title, result.Filename)
+	}
+	return buf.Bytes()
+}
+
+// Whether the playlist file is missing or lists other files than the results
+func (s *SinkDir) isPlaylistFileStale(sinkResults []SinkResult, fileName string) bool {
+	if s.PlaylistFile != fileName {
+		return true
+	}
+	if fileName == "" {
+		return false
+	}
+	current, err := ioutil.ReadFile(path.Join(s.Path, fileName))
+	return err != nil || !bytes.Equal(current, playlistFileContent(sinkResults))
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Library with the playlist Fav of one song, in the folder parentId
+func newFolderTestLibrary(t *testing.T, dir, parentId string) *Library {
+	src := path.Join(dir, "song.mp3")
+	if err := ioutil.WriteFile(src, []byte("song"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	library := &Library{
+		Tracks: map[string]Track{
+			"1": {TrackId: 1, Name: "Song", PersistentId: "A1", Location: fileLocation(src), DateModified: time.Unix(100, 0)},
+		},
+		Playlists: []Playlist{
+			{Name: "Top", Folder: true, PlaylistPersistentId: "F1"},
+			{Name: "Sub", Folder: true, PlaylistPersistentId: "F2", ParentPersistentId: "F1"},
+			{Name: "Fav", PlaylistPersistentId: "P1", ParentPersistentId: parentId, PlaylistItems: []PlaylistItem{{TrackId: 1}}},
+		},
+	}
+	library.buildIndex()
+	return library
+}
+
+func TestSinkDirMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sinkPath := path.Join(dir, "sink")
+	os.MkdirAll(sinkPath, 0755)
+	if err := startSync(newFolderTestLibrary(t, dir, "F2"), sinkPath, &SyncOptions{Playlists: []string{"Top/Sub/Fav"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// moved out of Sub; nothing happens on a dry run
+	library := newFolderTestLibrary(t, dir, "F1")
+	dryRun := *argDryRun
+	*argDryRun = true
+	err = startSync(library, sinkPath, &SyncOptions{Playlists: []string{"Top/Fav"}})
+	*argDryRun = dryRun
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFileExists(path.Join(sinkPath, "Top/Sub/Fav/1 Song.mp3")) || isFileExists(path.Join(sinkPath, "Top/Fav")) {
+		t.Fatal("moved by a dry run")
+	}
+
+	if err := startSync(library, sinkPath, &SyncOptions{Playlists: []string{"Top/Fav"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !isFileExists(path.Join(sinkPath, "Top/Fav/1 Song.mp3")) || isFileExists(path.Join(sinkPath, "Top/Sub")) {
+		t.Fatal("not moved")
+	}
+	data, err := ioutil.ReadFile(path.Join(sinkPath, "Top/Fav", META_JSON_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sinkDir SinkDir
+	if err := json.Unmarshal(data, &sinkDir); err != nil {
+		t.Fatal(err)
+	}
+	if len(sinkDir.OriginFolderPath) != 1 || sinkDir.OriginFolderPath[0] != "Top" || sinkDir.Tracks["A1"] == nil {
+		t.Fatalf("meta.json: %s", data)
+	}
+}
+
+func TestFindMovedSinkDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// synced before playlist IDs were recorded, under two folders
+	for _, relDir := range []string{"B/Fav", "A/Fav", "C/Other"} {
+		os.MkdirAll(path.Join(dir, relDir), 0755)
+		meta := `{"tracks":{},"origin_playlist_name":"` + path.Base(relDir) + `"}`
+		if err := ioutil.WriteFile(path.Join(dir, relDir, META_JSON_FILENAME), []byte(meta), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	playlist := &Playlist{Name: "Fav", PlaylistPersistentId: "P1"}
+	for i := 0; i < 10; i++ {
+		sink, _ := NewSink(dir, DetectFilesystemProfile(dir))
+		if prevDir, ok := sink.findMovedSinkDir(playlist, "Fav", map[string]bool{"Fav": true}); !ok || prevDir != "A/Fav" {
+			t.Fatalf("found %q", prevDir)
+		}
+	}
+
+	// a directory moving to one playlist is not taken by another
+	sink, _ := NewSink(dir, DetectFilesystemProfile(dir))
+	sinkDir, err := sink.OpenPlaylistDir(playlist, nil, map[string]bool{"Fav": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sinkDir.Move == nil || sinkDir.Path != path.Join(dir, "A/Fav") || !isFileExists(path.Join(dir, "A/Fav")) {
+		t.Fatalf("planned move: %+v", sinkDir)
+	}
+	if prevDir, ok := sink.findMovedSinkDir(playlist, "X/Fav", map[string]bool{}); !ok || prevDir != "B/Fav" {
+		t.Fatalf("found %q", prevDir)
+	}
+}
+
+func TestSinkDirOriginUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sinkPath := path.Join(dir, "sink")
+	os.MkdirAll(sinkPath, 0755)
+	library := newFolderTestLibrary(t, dir, "")
+	if err := startSync(library, sinkPath, &SyncOptions{Playlists: []string{"Fav"}}); err != nil {
+		t.Fatal(err)
+	}
+	// meta.json of an older version, without the playlist ID
+	metaPath := path.Join(sinkPath, "Fav", META_JSON_FILENAME)
+	var sinkDir SinkDir
+	data, _ := ioutil.ReadFile(metaPath)
+	if err := json.Unmarshal(data, &sinkDir); err != nil {
+		t.Fatal(err)
+	}
+	sinkDir.OriginPlaylistID = ""
+	data, _ = json.Marshal(&sinkDir)
+	ioutil.WriteFile(metaPath, data, 0644)
+
+	if err := startSync(library, sinkPath, &SyncOptions{Playlists: []string{"Fav"}}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(metaPath)
+	sinkDir = SinkDir{}
+	if err := json.Unmarshal(data, &sinkDir); err != nil {
+		t.Fatal(err)
+	}
+	if sinkDir.OriginPlaylistID != "P1" {
+		t.Fatalf("playlist ID not recorded: %s", data)
+	}
+}
+
+// Without numbers in file names a reorder renames nothing, only the playlist file changes
+func TestPlaylistFileReorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sinkPath := path.Join(dir, "sink")
+	os.MkdirAll(sinkPath, 0755)
+	library := &Library{
+		Tracks: make(map[string]Track),
+		Playlists: []Playlist{
+			{Name: "Mix", PlaylistPersistentId: "P1", PlaylistItems: []PlaylistItem{{TrackId: 1}, {TrackId: 2}}},
+		},
+	}
+	for i, name := range []string{"A", "B"} {
+		src := path.Join(dir, name+".mp3")
+		ioutil.WriteFile(src, []byte(name), 0644)
+		library.Tracks[string('1'+rune(i))] = Track{TrackId: i + 1, Name: name, PersistentId: "T" + name, Location: fileLocation(src), DateModified: time.Unix(100, 0)}
+	}
+	library.buildIndex()
+	options := func() *SyncOptions {
+		return &SyncOptions{Playlists: []string{"Mix"}, PlaylistFiles: true, DropNumberPrefix: true}
+	}
+	if err := startSync(library, sinkPath, options()); err != nil {
+		t.Fatal(err)
+	}
+	library.Playlists[0].PlaylistItems = []PlaylistItem{{TrackId: 2}, {TrackId: 1}}
+	library.buildIndex()
+	if err := startSync(library, sinkPath, options()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(sinkPath, "Mix/Mix.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "#EXTM3U\n#EXTINF:-1,B\nB.mp3\n#EXTINF:-1,A\nA.mp3\n"; string(data) != expected {
+		t.Fatalf("playlist file not reordered:\n%s", data)
+	}
+}
+
+// A directory with files copied by hand is not taken for a new sink dir
+func TestOpenSinkDirWithoutMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sinkPath := path.Join(dir, "sink")
+	os.MkdirAll(path.Join(sinkPath, "Fav"), 0755)
+	ioutil.WriteFile(path.Join(sinkPath, "Fav", "1 Song.mp3"), []byte("by hand"), 0644)
+	library := newFolderTestLibrary(t, dir, "")
+	if err := startSync(library, sinkPath, &SyncOptions{Playlists: []string{"Fav"}}); err == nil {
+		t.Fatal("took over a directory without meta.json")
+	}
+	if data, _ := ioutil.ReadFile(path.Join(sinkPath, "Fav", "1 Song.mp3")); string(data) != "by hand" {
+		t.Fatalf("overwritten: %s", data)
+	}
+
+	// temp files of an interrupted run
+	os.Remove(path.Join(sinkPath, "Fav", "1 Song.mp3"))
+	ioutil.WriteFile(path.Join(sinkPath, "Fav", "A1.tmp"), []byte("so"), 0644)
+	ioutil.WriteFile(path.Join(sinkPath, "Fav", META_JSON_TEMP_FILENAME), []byte("{"), 0644)
+	// and files macOS leaves
+	ioutil.WriteFile(path.Join(sinkPath, "Fav", ".DS_Store"), []byte("ds"), 0644)
+	ioutil.WriteFile(path.Join(sinkPath, "Fav", "._A1.tmp"), []byte("rsrc"), 0644)
+	os.MkdirAll(path.Join(sinkPath, "Fav", ".fseventsd"), 0755)
+	ioutil.WriteFile(path.Join(sinkPath, "Fav", ".fseventsd", "0001"), []byte("ev"), 0644)
+	if err := startSync(library, sinkPath, &SyncOptions{Playlists: []string{"Fav"}}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(sinkPath, "Fav", "1 Song.mp3")); string(data) != "song" {
+		t.Fatalf("not synced: %s", data)
+	}
+}
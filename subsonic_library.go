@@ -0,0 +1,437 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subsonic (and Navidrome) REST API as a source. Tracks are downloaded into
+// a local cache directory when they are copied (Track.Fetch), so only tracks
+// which sync needs are downloaded, and Copy reads from the cache like any
+// other local file.
+
+const SUBSONIC_API_VERSION = "1.13.0"
+const SUBSONIC_CLIENT_NAME = "iwalk"
+const SUBSONIC_INDEX_FILENAME = "index.json"
+
+type SubsonicClient struct {
+	BaseURL  string
+	User     string
+	Password string
+	// Pre-computed md5(password + salt), used when Password is empty
+	Token      string
+	Salt       string
+	HTTPClient *http.Client
+}
+
+type subsonicError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type subsonicSong struct {
+	Id          string    `json:"id"`
+	Title       string    `json:"title"`
+	Artist      string    `json:"artist"`
+	Album       string    `json:"album"`
+	Genre       string    `json:"genre"`
+	Track       int       `json:"track"`
+	DiscNumber  int       `json:"discNumber"`
+	Year        int       `json:"year"`
+	Size        int64     `json:"size"`
+	Suffix      string    `json:"suffix"`
+	ContentType string    `json:"contentType"`
+	Duration    int       `json:"duration"` // seconds
+	BitRate     int       `json:"bitRate"`
+	PlayCount   int       `json:"playCount"`
+	UserRating  int       `json:"userRating"` // 1-5
+	Created     time.Time `json:"created"`
+	Changed     time.Time `json:"changed"` // not in every server
+}
+
+type subsonicPlaylist struct {
+	Id        string         `json:"id"`
+	Name      string         `json:"name"`
+	SongCount int            `json:"songCount"`
+	Changed   time.Time      `json:"changed"`
+	Entries   []subsonicSong `json:"entry"`
+}
+
+type subsonicResponse struct {
+	Status    string         `json:"status"`
+	Error     *subsonicError `json:"error"`
+	Playlists *struct {
+		Playlists []subsonicPlaylist `json:"playlist"`
+	} `json:"playlists"`
+	Playlist *subsonicPlaylist `json:"playlist"`
+}
+
+func (c *SubsonicClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func newSubsonicSalt() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (c *SubsonicClient) endpoint(method string, params url.Values) string {
+	if params == nil {
+		params = url.Values{}
+	}
+	token, salt := c.Token, c.Salt
+	if c.Password != "" {
+		salt = newSubsonicSalt()
+		digest := md5.Sum([]byte(c.Password + salt))
+		token = hex.EncodeToString(digest[:])
+	}
+	params.Set("u", c.User)
+	params.Set("t", token)
+	params.Set("s", salt)
+	params.Set("v", SUBSONIC_API_VERSION)
+	params.Set("c", SUBSONIC_CLIENT_NAME)
+	params.Set("f", "json")
+	return fmt.Sprintf("%s/rest/%s.view?%s", strings.TrimRight(c.BaseURL, "/"), method, params.Encode())
+}
+
+func (c *SubsonicClient) call(method string, params url.Values) (*subsonicResponse, error) {
+	resp, err := c.httpClient().Get(c.endpoint(method, params))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Subsonic %s: HTTP %s", method, resp.Status)
+	}
+	var body struct {
+		Response subsonicResponse `json:"subsonic-response"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Subsonic %s: %s", method, err)
+	}
+	if body.Response.Status != "ok" {
+		if body.Response.Error != nil {
+			return nil, fmt.Errorf("Subsonic %s: %s (code %d)", method, body.Response.Error.Message, body.Response.Error.Code)
+		}
+		return nil, fmt.Errorf("Subsonic %s: status %s", method, body.Response.Status)
+	}
+	return &body.Response, nil
+}
+
+func (c *SubsonicClient) GetPlaylists() ([]subsonicPlaylist, error) {
+	resp, err := c.call("getPlaylists", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Playlists == nil {
+		return []subsonicPlaylist{}, nil
+	}
+	return resp.Playlists.Playlists, nil
+}
+
+func (c *SubsonicClient) GetPlaylist(id string) (*subsonicPlaylist, error) {
+	resp, err := c.call("getPlaylist", url.Values{"id": {id}})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Playlist == nil {
+		return nil, fmt.Errorf("Subsonic getPlaylist: playlist %s not in response", id)
+	}
+	return resp.Playlist, nil
+}
+
+// Downloads original file of the song into dst
+func (c *SubsonicClient) Download(id string, dst io.Writer) (int64, error) {
+	resp, err := c.httpClient().Get(c.endpoint("download", url.Values{"id": {id}}))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Subsonic download %s: HTTP %s", id, resp.Status)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") ||
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/xml") {
+		// errors are returned as an API response
+		return 0, fmt.Errorf("Subsonic download %s: server returned an error response", id)
+	}
+	return io.Copy(dst, resp.Body)
+}
+
+// ---------------- source ----------------
+
+// Persisted in the cache directory to re-download only what has changed
+type subsonicCacheIndex struct {
+	Playlists map[string]*subsonicPlaylist   `json:"playlists"`
+	Songs     map[string]*subsonicCachedSong `json:"songs"`
+}
+
+type subsonicCachedSong struct {
+	FileName string    `json:"filename"`
+	Size     int64     `json:"size"`
+	Changed  time.Time `json:"changed"`
+}
+
+type SubsonicSource struct {
+	client   *SubsonicClient
+	cacheDir string
+	// index is updated by downloads, which run in parallel with copies
+	mutex sync.Mutex
+	index *subsonicCacheIndex
+	// song ID -> lock held while downloading it
+	downloads map[string]*sync.Mutex
+	playlists []*Playlist
+	remoteMap map[string]subsonicPlaylist // playlist id -> summary from getPlaylists
+	trackMap  map[string]*Track
+}
+
+func (song *subsonicSong) changedTime() time.Time {
+	if !song.Changed.IsZero() {
+		return song.Changed
+	}
+	return song.Created
+}
+
+func NewSubsonicSource(client *SubsonicClient, cacheDir string) (*SubsonicSource, error) {
+	cacheDir = path.Join(cacheDir, "subsonic-"+strings.ToLower(derivePersistentId(client.BaseURL+"\x00"+client.User)))
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	source := &SubsonicSource{
+		client:    client,
+		cacheDir:  cacheDir,
+		index:     &subsonicCacheIndex{},
+		remoteMap: make(map[string]subsonicPlaylist),
+		trackMap:  make(map[string]*Track),
+		downloads: make(map[string]*sync.Mutex),
+	}
+	if data, err := ioutil.ReadFile(path.Join(cacheDir, SUBSONIC_INDEX_FILENAME)); err == nil {
+		if err := json.Unmarshal(data, source.index); err != nil {
+			logrus.Warnf("Broken subsonic cache index, ignoring: %s", err)
+			source.index = &subsonicCacheIndex{}
+		}
+	}
+	if source.index.Playlists == nil {
+		source.index.Playlists = make(map[string]*subsonicPlaylist)
+	}
+	if source.index.Songs == nil {
+		source.index.Songs = make(map[string]*subsonicCachedSong)
+	}
+	remotePlaylists, err := client.GetPlaylists()
+	if err != nil {
+		return nil, err
+	}
+	for _, remote := range remotePlaylists {
+		source.remoteMap[remote.Id] = remote
+		source.playlists = append(source.playlists, &Playlist{
+			Name:                 remote.Name,
+			PlaylistPersistentId: remote.Id,
+			Visible:              true,
+		})
+	}
+	return source, nil
+}
+
+// Callers hold mutex
+func (s *SubsonicSource) saveIndex() error {
+	data, err := json.Marshal(s.index)
+	if err != nil {
+		return err
+	}
+	indexPath := path.Join(s.cacheDir, SUBSONIC_INDEX_FILENAME)
+	if err := ioutil.WriteFile(indexPath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(indexPath+".tmp", indexPath)
+}
+
+func (s *SubsonicSource) ListPlaylists() []*Playlist {
+	return s.playlists
+}
+
+// Finds playlist by name or by its server side ID
+func (s *SubsonicSource) FindPlaylist(name string) (*Playlist, bool) {
+	for _, playlist := range s.playlists {
+		if playlist.Name == name || playlist.PlaylistPersistentId == name {
+			return playlist, true
+		}
+	}
+	return nil, false
+}
+
+func (s *SubsonicSource) FindTrack(persistentId string) (*Track, bool) {
+	track, ok := s.trackMap[persistentId]
+	return track, ok
+}
+
+// Playlist entries, from the cache index if the playlist has not changed
+func (s *SubsonicSource) playlistEntries(id string) ([]subsonicSong, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	remote, known := s.remoteMap[id]
+	if cached, ok := s.index.Playlists[id]; ok && known && !remote.Changed.IsZero() && cached.Changed.Equal(remote.Changed) {
+		logrus.Debugf("Subsonic: playlist %s not changed since %s", remote.Name, remote.Changed)
+		return cached.Entries, nil
+	}
+	playlist, err := s.client.GetPlaylist(id)
+	if err != nil {
+		return nil, err
+	}
+	s.index.Playlists[id] = playlist
+	if err := s.saveIndex(); err != nil {
+		logrus.Warnf("Failed to save subsonic cache index: %s", err)
+	}
+	return playlist.Entries, nil
+}
+
+func (s *SubsonicSource) PlaylistTracks(playlist *Playlist) ([]Track, error) {
+	entries, err := s.playlistEntries(playlist.PlaylistPersistentId)
+	if err != nil {
+		return nil, err
+	}
+	tracks := make([]Track, 0, len(entries))
+	for i := range entries {
+		song := entries[i]
+		track := song.toTrack(s.cachePath(&song))
+		if !s.isCached(&song) {
+			// the cached file is outdated or missing, Location isn't usable yet
+			track.fetch = func() error {
+				return s.materialize(&song)
+			}
+		}
+		s.trackMap[track.PersistentId] = &track
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+func (s *SubsonicSource) cachePath(song *subsonicSong) string {
+	suffix := song.Suffix
+	if suffix == "" {
+		suffix = "bin"
+	}
+	return path.Join(s.cacheDir, fmt.Sprintf("%s.%s", escapeFilename(song.Id), suffix))
+}
+
+// The song is in the cache and has not changed on the server since
+func (s *SubsonicSource) isCached(song *subsonicSong) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	filePath := s.cachePath(song)
+	cached, ok := s.index.Songs[song.Id]
+	if !ok || cached.FileName != path.Base(filePath) || song.changedTime().After(cached.Changed) {
+		return false
+	}
+	stat, err := os.Stat(filePath)
+	return err == nil && stat.Size() == cached.Size && (song.Size == 0 || song.Size == cached.Size)
+}
+
+// Makes sure the song is in the cache. A song in several playlists is
+// downloaded once.
+func (s *SubsonicSource) materialize(song *subsonicSong) error {
+	s.mutex.Lock()
+	download, ok := s.downloads[song.Id]
+	if !ok {
+		download = &sync.Mutex{}
+		s.downloads[song.Id] = download
+	}
+	s.mutex.Unlock()
+	download.Lock()
+	defer download.Unlock()
+	if s.isCached(song) {
+		return nil
+	}
+	filePath := s.cachePath(song)
+	fileName := path.Base(filePath)
+	logrus.Infof("Subsonic: downloading %s - %s", song.Artist, song.Title)
+	tempPath := filePath + ".tmp"
+	out, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	size, err := s.client.Download(song.Id, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Subsonic: failed to download %s: %s", song.Title, err)
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.index.Songs[song.Id] = &subsonicCachedSong{
+		FileName: fileName,
+		Size:     size,
+		Changed:  song.changedTime(),
+	}
+	if err := s.saveIndex(); err != nil {
+		logrus.Warnf("Failed to save subsonic cache index: %s", err)
+	}
+	return nil
+}
+
+// TrackId stays the same wherever the song is in playlists: the song ID if
+// it is a number (Subsonic), or derived from it (Navidrome uses hashes)
+func subsonicTrackId(songId string) int {
+	if id, err := strconv.Atoi(songId); err == nil && id > 0 {
+		return id
+	}
+	h := fnv.New32a()
+	h.Write([]byte(songId))
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+func (song *subsonicSong) toTrack(filePath string) Track {
+	track := Track{
+		TrackId:      subsonicTrackId(song.Id),
+		Name:         song.Title,
+		Artist:       song.Artist,
+		Album:        song.Album,
+		Genre:        song.Genre,
+		Kind:         song.ContentType,
+		Size:         int(song.Size),
+		TotalTime:    song.Duration * 1000,
+		TrackNumber:  song.Track,
+		DiscNumber:   song.DiscNumber,
+		Year:         song.Year,
+		DateModified: song.changedTime(),
+		DateAdded:    song.Created,
+		BitRate:      song.BitRate,
+		PlayCount:    song.PlayCount,
+		Rating:       song.UserRating * 20,
+		PersistentId: derivePersistentId("subsonic:" + song.Id),
+		TrackType:    "File",
+		Location:     fileLocation(filePath),
+	}
+	if stat, err := os.Stat(filePath); err == nil {
+		track.Size = int(stat.Size())
+		if track.DateModified.IsZero() {
+			track.DateModified = stat.ModTime()
+		}
+	}
+	return track
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stand-in Subsonic server with one playlist of two songs
+type fakeSubsonic struct {
+	t        *testing.T
+	password string
+	mutex    sync.Mutex
+	changed  time.Time
+	songs    map[string]string // id -> contents
+	// song id -> download count
+	downloads map[string]int
+}
+
+func newFakeSubsonic(t *testing.T, password string) *fakeSubsonic {
+	return &fakeSubsonic{
+		t:        t,
+		password: password,
+		changed:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		songs: map[string]string{
+			"11": "first song",
+			"ab": "second song",
+		},
+		downloads: make(map[string]int),
+	}
+}
+
+func (f *fakeSubsonic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	q := r.URL.Query()
+	digest := md5.Sum([]byte(f.password + q.Get("s")))
+	if q.Get("u") != "alice" || q.Get("s") == "" || q.Get("t") != hex.EncodeToString(digest[:]) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"subsonic-response": map[string]interface{}{
+				"status": "failed",
+				"error":  map[string]interface{}{"code": 40, "message": "Wrong username or password"},
+			},
+		})
+		return
+	}
+	if q.Get("f") != "json" || q.Get("v") != SUBSONIC_API_VERSION || q.Get("c") != SUBSONIC_CLIENT_NAME {
+		f.t.Errorf("unexpected params: %s", r.URL.RawQuery)
+	}
+	entries := []map[string]interface{}{
+		{"id": "11", "title": "First", "suffix": "mp3", "size": len(f.songs["11"]), "changed": f.changed},
+		{"id": "ab", "title": "Second", "suffix": "flac", "size": len(f.songs["ab"]), "changed": f.changed},
+	}
+	playlist := map[string]interface{}{"id": "pl1", "name": "Mix", "songCount": 2, "changed": f.changed}
+	response := map[string]interface{}{"status": "ok"}
+	switch r.URL.Path {
+	case "/rest/getPlaylists.view":
+		response["playlists"] = map[string]interface{}{"playlist": []interface{}{playlist}}
+	case "/rest/getPlaylist.view":
+		playlist["entry"] = entries
+		response["playlist"] = playlist
+	case "/rest/download.view":
+		f.downloads[q.Get("id")] += 1
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte(f.songs[q.Get("id")]))
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"subsonic-response": response})
+}
+
+func (f *fakeSubsonic) downloadCount(id string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.downloads[id]
+}
+
+func TestSubsonicAuth(t *testing.T) {
+	fake := newFakeSubsonic(t, "secret")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := &SubsonicClient{BaseURL: server.URL + "/", User: "alice", Password: "secret"}
+	playlists, err := client.GetPlaylists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists) != 1 || playlists[0].Name != "Mix" {
+		t.Fatalf("playlists: %+v", playlists)
+	}
+
+	digest := md5.Sum([]byte("secret" + "fixedsalt"))
+	client = &SubsonicClient{BaseURL: server.URL, User: "alice", Token: hex.EncodeToString(digest[:]), Salt: "fixedsalt"}
+	if _, err := client.GetPlaylists(); err != nil {
+		t.Fatalf("pre-computed token: %s", err)
+	}
+
+	client = &SubsonicClient{BaseURL: server.URL, User: "alice", Password: "wrong"}
+	if _, err := client.GetPlaylists(); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+}
+
+func TestSubsonicDownloadsWhenFetched(t *testing.T) {
+	fake := newFakeSubsonic(t, "secret")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	cacheDir, err := ioutil.TempDir("", "iwalk-subsonic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	load := func() (*SubsonicSource, []Track) {
+		source, err := NewSubsonicSource(&SubsonicClient{BaseURL: server.URL, User: "alice", Password: "secret"}, cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		playlist, ok := source.FindPlaylist("Mix")
+		if !ok {
+			t.Fatal("playlist not found")
+		}
+		tracks, err := source.PlaylistTracks(playlist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return source, tracks
+	}
+
+	_, tracks := load()
+	if fake.downloadCount("11")+fake.downloadCount("ab") != 0 {
+		t.Fatal("resolving the playlist downloaded songs")
+	}
+	if tracks[0].TrackId != 11 || tracks[1].TrackId != subsonicTrackId("ab") {
+		t.Fatalf("track IDs: %d, %d", tracks[0].TrackId, tracks[1].TrackId)
+	}
+	if err := tracks[0].Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(tracks[0].LocalPath()); err != nil || string(data) != "first song" {
+		t.Fatalf("cached file: %q %v", data, err)
+	}
+	if fake.downloadCount("11") != 1 || fake.downloadCount("ab") != 0 {
+		t.Fatalf("downloads: %v", fake.downloads)
+	}
+
+	// cached and not changed: no download
+	_, tracks = load()
+	if err := tracks[0].Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.downloadCount("11") != 1 {
+		t.Fatalf("downloaded again: %v", fake.downloads)
+	}
+
+	// changed on the server: downloaded again
+	fake.mutex.Lock()
+	fake.changed = fake.changed.Add(time.Hour)
+	fake.songs["11"] = "first song, remastered"
+	fake.mutex.Unlock()
+	_, tracks = load()
+	if err := tracks[0].Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.downloadCount("11") != 2 {
+		t.Fatalf("not downloaded again: %v", fake.downloads)
+	}
+	if data, _ := ioutil.ReadFile(tracks[0].LocalPath()); string(data) != "first song, remastered" {
+		t.Fatalf("cached file: %q", data)
+	}
+}
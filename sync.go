@@ -3,62 +3,186 @@ package main
 import (
 	"fmt"
 	"github.com/Sirupsen/logrus"
+	"path"
 )
 
 type SyncContext struct {
-	lib           *Library
+	lib           LibrarySource
 	sink          *Sink
 	syncPlaylists []string
+	options       *SyncOptions
+	// Sinks of folders other than the target, by content kind
+	kindSinks map[string]*Sink
 }
 
-func startSync(libPath, targetDir string, playlists []string) error {
-	itunesLib, err := LoadLibrary(libPath)
+type SyncOptions struct {
+	// Playlist names, paths or persistent IDs
+	Playlists []string
+	// Converts matching tracks if not nil
+	Transcode *TranscodeProfile
+	// What the device plays, nil if unknown
+	Capability *WalkmanCapability
+	// Device root, if podcasts and audiobooks go to their own folders
+	DeviceRoot string
+	// Write an M3U8 playlist into each sink dir
+	PlaylistFiles bool
+	// Name files without "0001 " prefix, with PlaylistFiles
+	DropNumberPrefix bool
+	// "playlist"(default): a directory per playlist, "pool": shared track pool
+	Layout string
+	// text/template for file names in sink dirs, and overrides by playlist
+	// name, path or persistent ID
+	FileNameTemplate  string
+	FileNameTemplates map[string]string
+	// Naming rules of the target, detected from the mount if nil
+	Filesystem *FilesystemProfile
+	// Bytes kept free on the device
+	Reserve int64
+	// Playlist names, paths or persistent IDs -> priority, see CapacityConfig
+	Priorities map[string]int
+	// Which tracks are left off first: "priority"(default) or "rating"
+	DropOrder string
+	// Actions performed at once, DEFAULT_CONCURRENCY if 0
+	Concurrency int
+	// Device files found broken by verify, copied again
+	Repair map[string]bool
+	// Persistent IDs of tracks left off to fit the device
+	leftOff map[string]bool
+}
+
+// Transcode profile for the track, nil to copy as is. false if the track
+// can't be synced because the device doesn't play it.
+func (o *SyncOptions) trackProfile(track *Track) (*TranscodeProfile, bool) {
+	transcode, capability := o.Transcode, o.Capability
+	if o.leftOff[track.PersistentId] {
+		return nil, false
+	}
+	if transcode != nil && transcode.Applies(track) {
+		return transcode, true
+	}
+	if capability != nil {
+		if ok, reason := capability.CanPlay(track); !ok {
+			if transcode == nil {
+				logrus.Warnf("-- SKIP  : %s (%s, configure transcode to convert)", track.Name, reason)
+				return nil, false
+			}
+			logrus.Debugf("Converting %s: %s", track.Name, reason)
+			return transcode, true
+		}
+	}
+	return nil, true
+}
+
+// .m3u8, or .m3u for devices which only know that
+func (o *SyncOptions) playlistFileExt() string {
+	if o.Capability != nil && len(o.Capability.PlaylistFormats) > 0 {
+		for _, format := range o.Capability.PlaylistFormats {
+			if format == "m3u8" {
+				return ".m3u8"
+			}
+		}
+		for _, format := range o.Capability.PlaylistFormats {
+			if format == "m3u" {
+				return ".m3u"
+			}
+		}
+		logrus.Warnf("Device does not list m3u playlists, writing m3u8 anyway")
+	}
+	return ".m3u8"
+}
+
+func startSync(source LibrarySource, targetDir string, options *SyncOptions) error {
+	ctx, err := newSyncContext(source, targetDir, options)
 	if err != nil {
 		return err
 	}
-	sink, err := NewSink(targetDir)
+	return ctx.Start()
+}
+
+func newSyncContext(source LibrarySource, targetDir string, options *SyncOptions) (*SyncContext, error) {
+	if options.Filesystem == nil {
+		options.Filesystem = DetectFilesystemProfile(targetDir)
+	}
+	sink, err := NewSink(targetDir, options.Filesystem)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ctx := &SyncContext{
-		lib:           itunesLib,
+	return &SyncContext{
+		lib:           source,
 		sink:          sink,
-		syncPlaylists: playlists,
-	}
-	return ctx.Start()
+		syncPlaylists: options.Playlists,
+		options:       options,
+		kindSinks:     make(map[string]*Sink),
+	}, nil
+}
+
+// Planned actions of a run
+type syncPlan struct {
+	engine      *IOEngine
+	planners    []*Planner
+	poolPlanner *PoolPlanner
 }
 
 func (c *SyncContext) Start() (err error) {
-	engine := NewIOEngine()
+	if err := RecoverJournal(c.sink.Path); err != nil {
+		return err
+	}
 	logrus.Infof("Reading iTunes library and checking walkman state...")
-	planners := make([]*Planner, 0, len(c.syncPlaylists))
-	for _, playlistName := range c.syncPlaylists {
-		sinkDir, err := c.sink.OpenSinkDir(playlistName, true)
-		if err != nil {
-			return err
-		}
-		playlist, ok := c.lib.PlaylistMap[playlistName]
+	playlists := make([]*Playlist, 0, len(c.syncPlaylists))
+	folderPaths := make([][]string, 0, len(c.syncPlaylists))
+	claimed := make(map[string]bool)
+	// collision key -> playlist, directories of two playlists must differ on the device
+	claimedBy := make(map[string]*Playlist)
+	for _, playlistRef := range c.syncPlaylists {
+		playlist, ok := resolvePlaylist(c.lib, playlistRef)
 		if !ok {
-			return fmt.Errorf("Playlist '%s' not found in iTuens library", playlistName)
+			return fmt.Errorf("Playlist '%s' not found in library", playlistRef)
 		}
-		planner := NewPlanner(c.lib, &playlist, sinkDir)
-		planner.Start(engine)
-		planners = append(planners, planner)
+		folders := playlistFolderPath(c.lib, playlist)
+		playlists = append(playlists, playlist)
+		folderPaths = append(folderPaths, folders)
+		relDir := playlistRelDir(c.options.Filesystem, folders, playlist.Name)
+		key := c.options.Filesystem.CollisionKey(relDir)
+		if other, ok := claimedBy[key]; ok && other.PlaylistPersistentId != playlist.PlaylistPersistentId {
+			return fmt.Errorf("Playlists '%s' and '%s' would share the directory %s on %s", other.Name, playlist.Name, relDir, c.options.Filesystem)
+		}
+		claimedBy[key] = playlist
+		claimed[relDir] = true
+	}
+	plan, err := c.plan(playlists, folderPaths, claimed)
+	if err != nil {
+		return err
+	}
+	plan, err = c.fitCapacity(plan, playlists, folderPaths, claimed)
+	if err != nil {
+		return err
 	}
+	engine := plan.engine
 	logrus.Infof("Checking operation...")
-
-	proceed, err := engine.Check(c.sink.Path)
+	engine.Confine(c.sink.Path)
+	for _, sink := range c.kindSinks {
+		engine.Confine(sink.Path)
+	}
+	engine.JournalAt(c.sink.Path)
+	engine.SetFilesystem(c.options.Filesystem)
+	engine.SetConcurrency(c.options.Concurrency)
+	proceed, err := engine.Check(c.sink.Path, c.options.Reserve)
 	if err != nil {
 		return
 	}
 	syncingCount := 0
 	skippingCount := 0
 	deletingCount := 0
-	for _, planner := range planners {
+	for _, planner := range plan.planners {
 		syncingCount += planner.SyncingTracks
 		skippingCount += planner.SkippedTracks
 		deletingCount += planner.DeletingTracks
 	}
+	if plan.poolPlanner != nil {
+		syncingCount += plan.poolPlanner.SyncingTracks
+		skippingCount += plan.poolPlanner.SkippedTracks
+		deletingCount += plan.poolPlanner.DeletingTracks
+	}
 	logrus.Infof("Change: %d Delete: %d Skip: %d\n", syncingCount, deletingCount, skippingCount)
 	if proceed {
 		fmt.Printf("Change: %d Delete: %d Skip: %d\n", syncingCount, deletingCount, skippingCount)
@@ -70,3 +194,80 @@ func (c *SyncContext) Start() (err error) {
 	}
 	return
 }
+
+// Plans actions of all playlists into a new engine
+func (c *SyncContext) plan(playlists []*Playlist, folderPaths [][]string, claimed map[string]bool) (*syncPlan, error) {
+	plan := &syncPlan{
+		engine:   NewIOEngine(),
+		planners: make([]*Planner, 0, len(playlists)),
+	}
+	if c.options.Layout == "pool" {
+		poolPlanner, err := NewPoolPlanner(c.lib, c.sink, c.options)
+		if err != nil {
+			return nil, err
+		}
+		if err := poolPlanner.Start(plan.engine, playlists, folderPaths); err != nil {
+			return nil, err
+		}
+		plan.poolPlanner = poolPlanner
+		return plan, nil
+	}
+	for i, playlist := range playlists {
+		sink, err := c.sinkFor(playlist)
+		if err != nil {
+			return nil, err
+		}
+		sinkDir, err := sink.OpenPlaylistDir(playlist, folderPaths[i], claimed)
+		if err != nil {
+			return nil, err
+		}
+		planner := NewPlanner(c.lib, playlist, sinkDir, c.options)
+		if err := planner.Start(plan.engine); err != nil {
+			return nil, err
+		}
+		plan.planners = append(plan.planners, planner)
+	}
+	return plan, nil
+}
+
+// Bytes written for each track by the plan, by persistent ID
+func (plan *syncPlan) trackWrites() map[string]int64 {
+	ret := make(map[string]int64)
+	for _, planner := range plan.planners {
+		for id, size := range planner.TrackWrites {
+			ret[id] += size
+		}
+	}
+	if plan.poolPlanner != nil {
+		for id, size := range plan.poolPlanner.TrackWrites {
+			ret[id] += size
+		}
+	}
+	return ret
+}
+
+// Target sink, or PODCASTS/AUDIOBOOKS folder of the device for playlists
+// consisting of such tracks
+func (c *SyncContext) sinkFor(playlist *Playlist) (*Sink, error) {
+	if c.options.DeviceRoot == "" || c.options.Capability == nil {
+		return c.sink, nil
+	}
+	tracks, err := c.lib.PlaylistTracks(playlist)
+	if err != nil {
+		return nil, err
+	}
+	kind := playlistContentKind(tracks)
+	if kind == "music" {
+		return c.sink, nil
+	}
+	if sink, ok := c.kindSinks[kind]; ok {
+		return sink, nil
+	}
+	sink, err := NewSink(path.Join(c.options.DeviceRoot, c.options.Capability.Folder(kind)), c.options.Filesystem)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("%s: syncing into %s", playlist.Name, sink.Path)
+	c.kindSinks[kind] = sink
+	return sink, nil
+}
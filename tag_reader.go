@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Minimal tag reader for ID3v1/ID3v2 (MP3), MP4 (AAC/ALAC), FLAC and
+// Ogg (Vorbis/Opus). Only fields iwalk cares about are read.
+
+type AudioTags struct {
+	Format      string `json:"format"` // mp3, aac, alac, flac, vorbis, opus
+	Title       string `json:"title,omitempty"`
+	Artist      string `json:"artist,omitempty"`
+	AlbumArtist string `json:"album_artist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	Composer    string `json:"composer,omitempty"`
+	Genre       string `json:"genre,omitempty"`
+	TrackNumber int    `json:"track_number,omitempty"`
+	DiscNumber  int    `json:"disc_number,omitempty"`
+	Year        int    `json:"year,omitempty"`
+	Duration    int    `json:"duration,omitempty"` // msec
+	SampleRate  int    `json:"sample_rate,omitempty"`
+}
+
+var errNoTags = errors.New("No supported tags found")
+
+// A size in the file is larger than the file, nothing is allocated for it
+var errBrokenTag = errors.New("Tag size exceeds the file")
+
+func ReadAudioTags(filePath string) (*AudioTags, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return readFLACTags(f, stat.Size())
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return readOggTags(f)
+	case bytes.Equal(header[4:8], []byte("ftyp")):
+		return readMP4Tags(f, stat.Size())
+	case bytes.HasPrefix(header, []byte("ID3")):
+		tags, tagSize, err := readID3v2Tags(f, stat.Size())
+		if err == errBrokenTag {
+			logrus.Debugf("Skipping broken ID3v2 tag of %s", filePath)
+			return readID3v1Tags(f)
+		} else if err != nil {
+			return nil, err
+		}
+		// FLAC files may be prefixed by ID3v2
+		magic := make([]byte, 4)
+		if _, err := f.ReadAt(magic, tagSize); err == nil && bytes.Equal(magic, []byte("fLaC")) {
+			if _, err := f.Seek(tagSize, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return readFLACTags(f, stat.Size()-tagSize)
+		}
+		return tags, nil
+	default:
+		return readID3v1Tags(f)
+	}
+}
+
+// Sets field from textual value, shared by ID3, MP4 and Vorbis comments
+func (t *AudioTags) set(field, value string) {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if value == "" {
+		return
+	}
+	switch field {
+	case "title":
+		t.Title = value
+	case "artist":
+		t.Artist = value
+	case "album_artist":
+		t.AlbumArtist = value
+	case "album":
+		t.Album = value
+	case "composer":
+		t.Composer = value
+	case "genre":
+		t.Genre = value
+	case "track":
+		t.TrackNumber = leadingInt(value)
+	case "disc":
+		t.DiscNumber = leadingInt(value)
+	case "year":
+		t.Year = leadingInt(value)
+	case "duration":
+		t.Duration = leadingInt(value)
+	}
+}
+
+// "3/12" -> 3, "2010-01-02" -> 2010
+func leadingInt(value string) int {
+	end := 0
+	for end < len(value) && value[end] >= '0' && value[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(value[:end])
+	return n
+}
+
+// ---------------- ID3 ----------------
+
+var id3Frames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TPE2": "album_artist", "TP2": "album_artist",
+	"TALB": "album", "TAL": "album",
+	"TCOM": "composer", "TCM": "composer",
+	"TCON": "genre", "TCO": "genre",
+	"TRCK": "track", "TRK": "track",
+	"TPOS": "disc", "TPA": "disc",
+	"TYER": "year", "TYE": "year", "TDRC": "year",
+	"TLEN": "duration", "TLE": "duration",
+}
+
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic", "Darkwave",
+	"Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap",
+	"Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal",
+	"Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll",
+	"Hard Rock",
+}
+
+// "(17)", "17" or "(17)Rock" -> "Rock"
+func resolveID3Genre(genre string) string {
+	ref := strings.TrimPrefix(genre, "(")
+	if end := strings.Index(ref, ")"); end >= 0 {
+		if rest := ref[end+1:]; rest != "" {
+			return rest
+		}
+		ref = ref[:end]
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n >= 0 && n < len(id3v1Genres) {
+		return id3v1Genres[n]
+	}
+	return genre
+}
+
+func synchsafe(b []byte) int64 {
+	var n int64
+	for _, c := range b {
+		n = n<<7 | int64(c&0x7f)
+	}
+	return n
+}
+
+func removeUnsync(data []byte) []byte {
+	return bytes.Replace(data, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+func decodeID3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	encoding, data := data[0], data[1:]
+	switch encoding {
+	case 0: // ISO-8859-1
+		runes := make([]rune, 0, len(data))
+		for _, b := range data {
+			if b == 0 {
+				break
+			}
+			runes = append(runes, rune(b))
+		}
+		return string(runes)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		var order binary.ByteOrder = binary.BigEndian
+		if encoding == 1 && len(data) >= 2 {
+			if data[0] == 0xff && data[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			data = data[2:]
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			unit := order.Uint16(data[i:])
+			if unit == 0 {
+				break
+			}
+			units = append(units, unit)
+		}
+		return string(utf16.Decode(units))
+	default: // UTF-8
+		if end := bytes.IndexByte(data, 0); end >= 0 {
+			data = data[:end]
+		}
+		return string(data)
+	}
+}
+
+// Returns tags and whole tag size (including header). fileSize bounds the tag.
+func readID3v2Tags(r io.Reader, fileSize int64) (*AudioTags, int64, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	version, flags := header[3], header[5]
+	size := synchsafe(header[6:10])
+	tagSize := 10 + size
+	if flags&0x10 != 0 {
+		tagSize += 10 // footer
+	}
+	if tagSize > fileSize {
+		return nil, 0, errBrokenTag
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, err
+	}
+	if version < 4 && flags&0x80 != 0 {
+		data = removeUnsync(data)
+	}
+	if flags&0x40 != 0 && len(data) >= 4 {
+		// extended header
+		var extSize int64
+		if version >= 4 {
+			extSize = synchsafe(data[:4])
+		} else {
+			extSize = int64(binary.BigEndian.Uint32(data[:4])) + 4
+		}
+		if extSize > int64(len(data)) {
+			return nil, 0, fmt.Errorf("Broken ID3v2 extended header")
+		}
+		data = data[extSize:]
+	}
+	tags := &AudioTags{Format: "mp3"}
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(data) >= headerLen && data[0] != 0 {
+		id := string(data[:idLen])
+		var frameSize int64
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int64(data[3])<<16 | int64(data[4])<<8 | int64(data[5])
+		case 3:
+			frameSize = int64(binary.BigEndian.Uint32(data[4:8]))
+			frameFlags = binary.BigEndian.Uint16(data[8:10])
+		default:
+			frameSize = synchsafe(data[4:8])
+			frameFlags = binary.BigEndian.Uint16(data[8:10])
+		}
+		if frameSize > int64(len(data)-headerLen) {
+			break
+		}
+		frame := data[headerLen : int64(headerLen)+frameSize]
+		data = data[int64(headerLen)+frameSize:]
+		field, ok := id3Frames[id]
+		if !ok {
+			continue
+		}
+		if version >= 4 {
+			if frameFlags&0x000c != 0 {
+				continue // compressed or encrypted
+			}
+			if frameFlags&0x0002 != 0 {
+				frame = removeUnsync(frame)
+			}
+			if frameFlags&0x0001 != 0 && len(frame) >= 4 {
+				frame = frame[4:] // data length indicator
+			}
+		} else if version == 3 && frameFlags&0x00c0 != 0 {
+			continue // compressed or encrypted
+		}
+		value := decodeID3Text(frame)
+		if field == "genre" {
+			value = resolveID3Genre(value)
+		}
+		tags.set(field, value)
+	}
+	return tags, tagSize, nil
+}
+
+func readID3v1Tags(f *os.File) (*AudioTags, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < 128 {
+		return nil, errNoTags
+	}
+	data := make([]byte, 128)
+	if _, err := f.ReadAt(data, stat.Size()-128); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte("TAG")) {
+		return nil, errNoTags
+	}
+	latin1 := func(b []byte) string {
+		return decodeID3Text(append([]byte{0}, b...))
+	}
+	tags := &AudioTags{Format: "mp3"}
+	tags.set("title", latin1(data[3:33]))
+	tags.set("artist", latin1(data[33:63]))
+	tags.set("album", latin1(data[63:93]))
+	tags.set("year", latin1(data[93:97]))
+	if data[125] == 0 && data[126] != 0 {
+		tags.TrackNumber = int(data[126])
+	}
+	if int(data[127]) < len(id3v1Genres) {
+		tags.Genre = id3v1Genres[data[127]]
+	}
+	return tags, nil
+}
+
+// ---------------- MP4 ----------------
+
+var mp4Items = map[string]string{
+	"\xa9nam": "title",
+	"\xa9ART": "artist",
+	"aART":    "album_artist",
+	"\xa9alb": "album",
+	"\xa9wrt": "composer",
+	"\xa9gen": "genre",
+	"\xa9day": "year",
+}
+
+type mp4Atom struct {
+	Type string
+	Data []byte
+}
+
+// Splits buffer into atoms
+func parseMP4Atoms(data []byte) []mp4Atom {
+	ret := make([]mp4Atom, 0)
+	for len(data) >= 8 {
+		size := int64(binary.BigEndian.Uint32(data[:4]))
+		typ := string(data[4:8])
+		headerLen := int64(8)
+		if size == 1 && len(data) >= 16 {
+			size = int64(binary.BigEndian.Uint64(data[8:16]))
+			headerLen = 16
+		} else if size == 0 {
+			size = int64(len(data))
+		}
+		if size < headerLen || size > int64(len(data)) {
+			break
+		}
+		ret = append(ret, mp4Atom{Type: typ, Data: data[headerLen:size]})
+		data = data[size:]
+	}
+	return ret
+}
+
+func findMP4Atom(data []byte, path ...string) ([]byte, bool) {
+	for _, name := range path {
+		found := false
+		for _, atom := range parseMP4Atoms(data) {
+			if atom.Type == name {
+				data = atom.Data
+				if name == "meta" && len(data) >= 4 {
+					data = data[4:] // full atom: version and flags
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// Reads only 'moov' atom, skipping media data
+func readMP4Tags(f *os.File, fileSize int64) (*AudioTags, error) {
+	var offset int64
+	header := make([]byte, 16)
+	for {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			if err == io.EOF {
+				return nil, errNoTags
+			}
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		typ := string(header[4:8])
+		headerLen := int64(8)
+		if size == 1 {
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		}
+		if size < headerLen {
+			return nil, errNoTags
+		}
+		if size > fileSize-offset {
+			if typ == "moov" {
+				return nil, errBrokenTag
+			}
+			return nil, errNoTags // truncated before moov
+		}
+		if typ == "moov" {
+			moov := make([]byte, size-headerLen)
+			if _, err := f.ReadAt(moov, offset+headerLen); err != nil {
+				return nil, err
+			}
+			return parseMP4Moov(moov), nil
+		}
+		offset += size
+	}
+}
+
+func parseMP4Moov(moov []byte) *AudioTags {
+	tags := &AudioTags{Format: "aac"}
+	if stsd, ok := findMP4Atom(moov, "trak", "mdia", "minf", "stbl", "stsd"); ok && len(stsd) >= 8 {
+		// version/flags(4), entry count(4), then sample entries
+		for _, entry := range parseMP4Atoms(stsd[8:]) {
+			if entry.Type == "alac" {
+				tags.Format = "alac"
+			}
+			// audio sample entry: sample rate is 16.16 fixed point at offset 24
+			if len(entry.Data) >= 28 {
+				tags.SampleRate = int(binary.BigEndian.Uint16(entry.Data[24:26]))
+			}
+		}
+	}
+	if mvhd, ok := findMP4Atom(moov, "mvhd"); ok && len(mvhd) >= 20 {
+		var timescale, duration uint64
+		if mvhd[0] == 1 && len(mvhd) >= 32 {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+			duration = binary.BigEndian.Uint64(mvhd[24:32])
+		} else {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+			duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+		}
+		if timescale > 0 {
+			tags.Duration = int(duration * 1000 / timescale)
+		}
+	}
+	ilst, ok := findMP4Atom(moov, "udta", "meta", "ilst")
+	if !ok {
+		return tags
+	}
+	for _, item := range parseMP4Atoms(ilst) {
+		value, ok := findMP4Atom(item.Data, "data")
+		if !ok || len(value) < 8 {
+			continue
+		}
+		value = value[8:] // type indicator and locale
+		switch item.Type {
+		case "trkn", "disk":
+			if len(value) >= 4 {
+				n := int(binary.BigEndian.Uint16(value[2:4]))
+				if item.Type == "trkn" {
+					tags.TrackNumber = n
+				} else {
+					tags.DiscNumber = n
+				}
+			}
+		case "gnre":
+			if len(value) >= 2 {
+				n := int(binary.BigEndian.Uint16(value[:2])) - 1
+				if n >= 0 && n < len(id3v1Genres) {
+					tags.Genre = id3v1Genres[n]
+				}
+			}
+		default:
+			if field, ok := mp4Items[item.Type]; ok {
+				tags.set(field, string(value))
+			}
+		}
+	}
+	return tags
+}
+
+// ---------------- FLAC / Vorbis ----------------
+
+var vorbisFields = map[string]string{
+	"TITLE":        "title",
+	"ARTIST":       "artist",
+	"ALBUMARTIST":  "album_artist",
+	"ALBUM ARTIST": "album_artist",
+	"ALBUM":        "album",
+	"COMPOSER":     "composer",
+	"GENRE":        "genre",
+	"TRACKNUMBER":  "track",
+	"DISCNUMBER":   "disc",
+	"DATE":         "year",
+	"YEAR":         "year",
+}
+
+func parseVorbisComment(data []byte, tags *AudioTags) {
+	// little endian: vendor length, vendor, count, (length, "KEY=value")...
+	if len(data) < 4 {
+		return
+	}
+	vendorLen := int64(binary.LittleEndian.Uint32(data[:4]))
+	if 4+vendorLen+4 > int64(len(data)) {
+		return
+	}
+	data = data[4+vendorLen:]
+	count := binary.LittleEndian.Uint32(data[:4])
+	data = data[4:]
+	for i := uint32(0); i < count && len(data) >= 4; i++ {
+		length := int64(binary.LittleEndian.Uint32(data[:4]))
+		if 4+length > int64(len(data)) {
+			return
+		}
+		comment := string(data[4 : 4+length])
+		data = data[4+length:]
+		kv := strings.SplitN(comment, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if field, ok := vorbisFields[strings.ToUpper(kv[0])]; ok {
+			tags.set(field, kv[1])
+		}
+	}
+}
+
+// remaining is the size from the magic to the end of the file
+func readFLACTags(r io.Reader, remaining int64) (*AudioTags, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	remaining -= 4
+	tags := &AudioTags{Format: "flac"}
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		remaining -= 4 + length
+		if remaining < 0 {
+			return nil, errBrokenTag
+		}
+		block := make([]byte, length)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, err
+		}
+		switch blockType {
+		case 0: // STREAMINFO
+			if len(block) >= 18 {
+				sampleRate := int64(block[10])<<12 | int64(block[11])<<4 | int64(block[12])>>4
+				totalSamples := int64(block[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(block[14:18]))
+				tags.SampleRate = int(sampleRate)
+				if sampleRate > 0 {
+					tags.Duration = int(totalSamples * 1000 / sampleRate)
+				}
+			}
+		case 4: // VORBIS_COMMENT
+			parseVorbisComment(block, tags)
+		}
+		if last {
+			return tags, nil
+		}
+	}
+}
+
+// Reads first two packets (identification and comment header) and
+// the last granule position for duration
+func readOggTags(f *os.File) (*AudioTags, error) {
+	packets := make([][]byte, 0, 2)
+	var current []byte
+	header := make([]byte, 27)
+	for len(packets) < 2 {
+		if _, err := io.ReadFull(f, header); err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(header, []byte("OggS")) {
+			return nil, fmt.Errorf("Broken Ogg page")
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(f, segments); err != nil {
+			return nil, err
+		}
+		for _, segmentLen := range segments {
+			segment := make([]byte, segmentLen)
+			if _, err := io.ReadFull(f, segment); err != nil {
+				return nil, err
+			}
+			current = append(current, segment...)
+			if segmentLen < 255 {
+				packets = append(packets, current)
+				current = nil
+			}
+		}
+	}
+	ident, comment := packets[0], packets[1]
+	tags := &AudioTags{}
+	var preSkip int64
+	switch {
+	case bytes.HasPrefix(ident, []byte("\x01vorbis")) && bytes.HasPrefix(comment, []byte("\x03vorbis")):
+		tags.Format = "vorbis"
+		if len(ident) >= 16 {
+			tags.SampleRate = int(binary.LittleEndian.Uint32(ident[12:16]))
+		}
+		parseVorbisComment(comment[7:], tags)
+	case bytes.HasPrefix(ident, []byte("OpusHead")) && bytes.HasPrefix(comment, []byte("OpusTags")):
+		tags.Format = "opus"
+		tags.SampleRate = 48000 // granule position is always 48kHz
+		if len(ident) >= 12 {
+			preSkip = int64(binary.LittleEndian.Uint16(ident[10:12]))
+		}
+		parseVorbisComment(comment[8:], tags)
+	default:
+		return nil, errNoTags
+	}
+	if granule, err := lastOggGranule(f); err == nil && tags.SampleRate > 0 {
+		tags.Duration = int((granule - preSkip) * 1000 / int64(tags.SampleRate))
+	}
+	return tags, nil
+}
+
+func lastOggGranule(f *os.File) (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	tailSize := int64(64 * KiB)
+	if stat.Size() < tailSize {
+		tailSize = stat.Size()
+	}
+	tail := make([]byte, tailSize)
+	if _, err := f.ReadAt(tail, stat.Size()-tailSize); err != nil {
+		return 0, err
+	}
+	last := bytes.LastIndex(tail, []byte("OggS"))
+	if last < 0 || last+14 > len(tail) {
+		return 0, errNoTags
+	}
+	return int64(binary.LittleEndian.Uint64(tail[last+6 : last+14])), nil
+}
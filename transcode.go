@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Converts tracks the device can't play (or which are too large) while
+// syncing:
+//
+//	transcode:
+//	  codec: aac
+//	  bitrate: 256
+//	  formats: [alac, flac, wav, aiff]
+//	  max_bitrate: 512
+//
+// The profile name is recorded in meta.json, so changing the profile
+// re-encodes already synced tracks. The default name carries every setting
+// which changes the output ("aac-256-48000hz-max320-flac+mp3").
+
+const DEFAULT_TRANSCODE_BITRATE = 256
+
+// Typical overhead of container, tags and artwork
+const TRANSCODE_OVERHEAD = 256 * KiB
+
+var losslessFormats = []string{"alac", "flac", "wav", "aiff"}
+
+var transcodeCodecs = map[string]struct {
+	ext    string
+	format string
+	args   []string
+}{
+	"aac": {".m4a", "mp4", []string{"-c:a", "aac"}},
+	"mp3": {".mp3", "mp3", []string{"-c:a", "libmp3lame", "-id3v2_version", "3"}},
+}
+
+type TranscodeConfig struct {
+	// Recorded in meta.json (default: derived from the settings below)
+	Profile string `yaml:"profile"`
+	// aac(default) or mp3
+	Codec string `yaml:"codec"`
+	// Target bit rate in kbps (default 256)
+	Bitrate int `yaml:"bitrate"`
+	// Source formats to convert: alac, flac, wav, aiff, aac, mp3, vorbis, opus
+	// (default: lossless ones)
+	Formats []string `yaml:"formats"`
+	// Also convert tracks whose bit rate is above this (kbps), 0 to disable
+	MaxBitrate int `yaml:"max_bitrate"`
+	// Output sampling rate in Hz, 0 to keep the source's
+	SampleRate int `yaml:"sample_rate"`
+	// Encoder command (default: ffmpeg), or "stub" which just copies
+	Encoder string `yaml:"encoder"`
+}
+
+type TranscodeProfile struct {
+	Name       string
+	Codec      string
+	Bitrate    int
+	Formats    map[string]bool
+	MaxBitrate int
+	SampleRate int
+	Encoder    Encoder
+}
+
+// Converts src into dst with the codec of the profile, keeping tags and artwork
+type Encoder interface {
+	Encode(src, dst string, profile *TranscodeProfile) error
+}
+
+func NewTranscodeProfile(conf *TranscodeConfig) (*TranscodeProfile, error) {
+	profile := &TranscodeProfile{
+		Name:       conf.Profile,
+		Codec:      strings.ToLower(conf.Codec),
+		Bitrate:    conf.Bitrate,
+		Formats:    make(map[string]bool),
+		MaxBitrate: conf.MaxBitrate,
+		SampleRate: conf.SampleRate,
+	}
+	if profile.Codec == "" {
+		profile.Codec = "aac"
+	}
+	if _, ok := transcodeCodecs[profile.Codec]; !ok {
+		return nil, fmt.Errorf("Unsupported transcode codec: %s (aac or mp3)", conf.Codec)
+	}
+	if profile.Bitrate <= 0 {
+		profile.Bitrate = DEFAULT_TRANSCODE_BITRATE
+	}
+	formats := conf.Formats
+	if len(formats) == 0 {
+		formats = losslessFormats
+	}
+	for _, format := range formats {
+		profile.Formats[strings.ToLower(format)] = true
+	}
+	if profile.Name == "" {
+		profile.Name = profile.defaultName()
+	}
+	switch conf.Encoder {
+	case "stub":
+		profile.Encoder = stubEncoder{}
+	case "":
+		profile.Encoder = &ffmpegEncoder{command: "ffmpeg"}
+	default:
+		profile.Encoder = &ffmpegEncoder{command: os.ExpandEnv(conf.Encoder)}
+	}
+	if encoder, ok := profile.Encoder.(*ffmpegEncoder); ok {
+		if _, err := exec.LookPath(encoder.command); err != nil {
+			return nil, fmt.Errorf("Encoder not found: %s", encoder.command)
+		}
+	}
+	return profile, nil
+}
+
+// "<codec>-<bitrate>", followed by the sample rate, max bit rate and
+// formats if they are not the defaults, so that the name of an existing
+// default profile doesn't change
+func (p *TranscodeProfile) defaultName() string {
+	name := fmt.Sprintf("%s-%d", p.Codec, p.Bitrate)
+	if p.SampleRate > 0 {
+		name += fmt.Sprintf("-%dhz", p.SampleRate)
+	}
+	if p.MaxBitrate > 0 {
+		name += fmt.Sprintf("-max%d", p.MaxBitrate)
+	}
+	formats := make([]string, 0, len(p.Formats))
+	for format := range p.Formats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	defaults := append([]string{}, losslessFormats...)
+	sort.Strings(defaults)
+	if strings.Join(formats, "+") != strings.Join(defaults, "+") {
+		name += "-" + strings.Join(formats, "+")
+	}
+	return name
+}
+
+// Format of the track file: alac, flac, wav, aiff, aac, mp3, vorbis, opus
+func trackFormat(track *Track) string {
+	kind := strings.ToLower(track.Kind)
+	switch {
+	case strings.Contains(kind, "apple lossless"):
+		return "alac"
+	case strings.Contains(kind, "flac"):
+		return "flac"
+	case strings.Contains(kind, "wav"):
+		return "wav"
+	case strings.Contains(kind, "aiff"):
+		return "aiff"
+	case strings.Contains(kind, "aac"):
+		return "aac"
+	case strings.Contains(kind, "mpeg audio"):
+		return "mp3"
+	case strings.Contains(kind, "opus"):
+		return "opus"
+	case strings.Contains(kind, "vorbis"):
+		return "vorbis"
+	}
+	switch strings.ToLower(filepath.Ext(track.Location)) {
+	case ".flac":
+		return "flac"
+	case ".wav":
+		return "wav"
+	case ".aif", ".aiff":
+		return "aiff"
+	case ".mp3":
+		return "mp3"
+	case ".m4a", ".mp4", ".aac":
+		return "aac"
+	case ".ogg", ".oga":
+		return "vorbis"
+	case ".opus":
+		return "opus"
+	}
+	return ""
+}
+
+// Whether the track should be converted by this profile
+func (p *TranscodeProfile) Applies(track *Track) bool {
+	if p.Formats[trackFormat(track)] {
+		return true
+	}
+	return p.MaxBitrate > 0 && track.BitRate > p.MaxBitrate
+}
+
+// Extension of converted files
+func (p *TranscodeProfile) Extension() string {
+	return transcodeCodecs[p.Codec].ext
+}
+
+// Expected output size, from duration or from source size
+func (p *TranscodeProfile) EstimateSize(track *Track, sourceSize int64) int64 {
+	if track.TotalTime > 0 {
+		// kbps * ms / 8 = bytes
+		return int64(p.Bitrate)*int64(track.TotalTime)/8 + TRANSCODE_OVERHEAD
+	}
+	sourceBitrate := int64(track.BitRate)
+	if sourceBitrate <= 0 {
+		sourceBitrate = 1411 // CD audio
+	}
+	estimated := sourceSize * int64(p.Bitrate) / sourceBitrate
+	if estimated > sourceSize {
+		return sourceSize
+	}
+	return estimated
+}
+
+type ffmpegEncoder struct {
+	command string
+}
+
+func (e *ffmpegEncoder) Encode(src, dst string, profile *TranscodeProfile) error {
+	codec := transcodeCodecs[profile.Codec]
+	args := []string{
+		"-nostdin", "-y", "-loglevel", "error",
+		"-i", src,
+		"-map", "0:a:0", "-map", "0:v?", "-c:v", "copy", "-disposition:v", "attached_pic",
+		"-map_metadata", "0",
+	}
+	args = append(args, codec.args...)
+	args = append(args, "-b:a", fmt.Sprintf("%dk", profile.Bitrate))
+	if profile.SampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(profile.SampleRate))
+	}
+	args = append(args, "-f", codec.format, dst)
+	cmd := exec.Command(e.command, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	logrus.Debugf("Encoding: %s %s", e.command, strings.Join(args, " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed for %s: %s %s", e.command, src, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Copies the input as is, for testing without an encoder
+type stubEncoder struct{}
+
+func (stubEncoder) Encode(src, dst string, profile *TranscodeProfile) error {
+	return copyFileContents(src, dst, nil, nil)
+}
+
+type Transcode struct {
+	from      string
+	to        string
+	tempFile  string
+	track     *Track
+	profile   *TranscodeProfile
+	size      int64
+	estimated int64
+	// of the encoded file, after Perform
+	written  int64
+	checksum string
+	// downloads from, if the source does so on demand
+	fetch func() error
+}
+
+func NewTranscode(from, to string, track *Track, profile *TranscodeProfile) *Transcode {
+	size, err := sourceFileSize(from, track)
+	if err != nil {
+		logrus.Errorf("Cannot access: %s", from)
+		return nil
+	}
+	return &Transcode{
+		from:      from,
+		to:        to,
+		tempFile:  path.Join(path.Dir(to), fmt.Sprintf("%s.tmp", track.PersistentId)),
+		track:     track,
+		profile:   profile,
+		size:      size,
+		estimated: profile.EstimateSize(track, size),
+		fetch:     track.fetch,
+	}
+}
+
+// Partially encoded files can't be told from complete ones, always encode again
+func (t *Transcode) Perform() error {
+	if t.fetch != nil {
+		if err := t.fetch(); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(path.Dir(t.tempFile), 0775); err != nil {
+		return err
+	}
+	if err := os.Remove(t.tempFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := t.profile.Encoder.Encode(t.from, t.tempFile, t.profile); err != nil {
+		os.Remove(t.tempFile)
+		return err
+	}
+	// there is nothing to compare with, but -verify_writes reads it from the device
+	checksum, written, err := hashFile(t.tempFile, *argVerifyWrites)
+	if err != nil {
+		return err
+	}
+	t.checksum, t.written = checksum, written
+	return nil
+}
+
+func (t *Transcode) WrittenFile() (int64, string) {
+	return t.written, t.checksum
+}
+
+func (t *Transcode) Finish() error {
+	return os.Rename(t.tempFile, t.to)
+}
+
+func (t *Transcode) String() string {
+	return fmt.Sprintf("ENCODE %s --> %s (%s)", t.from, t.to, t.profile.Name)
+}
+
+func (t *Transcode) SizeDelta() int64 {
+	return t.estimated
+}
+
+// Reading the source dominates with fast encoders
+func (t *Transcode) ProcessCost() int64 {
+	return t.size
+}
+
+func (t *Transcode) TouchedPaths() []string {
+	return []string{t.tempFile, t.to}
+}
+
+func (t *Transcode) FinishStep() JournalStep {
+	return renameStep(t.tempFile, t.to, true)
+}
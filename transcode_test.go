@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTranscodeProfileName(t *testing.T) {
+	cases := []struct {
+		conf TranscodeConfig
+		name string
+	}{
+		{TranscodeConfig{}, "aac-256"},
+		{TranscodeConfig{Codec: "MP3", Bitrate: 320}, "mp3-320"},
+		{TranscodeConfig{SampleRate: 48000}, "aac-256-48000hz"},
+		{TranscodeConfig{MaxBitrate: 320}, "aac-256-max320"},
+		{TranscodeConfig{Formats: []string{"FLAC", "alac", "wav", "aiff"}}, "aac-256"},
+		{TranscodeConfig{Formats: []string{"mp3", "flac"}, MaxBitrate: 320, SampleRate: 44100}, "aac-256-44100hz-max320-flac+mp3"},
+		{TranscodeConfig{Profile: "mine", SampleRate: 44100}, "mine"},
+	}
+	for _, c := range cases {
+		c.conf.Encoder = "stub"
+		profile, err := NewTranscodeProfile(&c.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profile.Name != c.name {
+			t.Errorf("%+v: %s, expected %s", c.conf, profile.Name, c.name)
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-transcode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := path.Join(dir, "song.flac")
+	data := make([]byte, 100*KiB)
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	profile, err := NewTranscodeProfile(&TranscodeConfig{Encoder: "stub", Bitrate: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track := &Track{Name: "Song", Kind: "FLAC audio file", PersistentId: "A1", Location: fileLocation(src)}
+	if !profile.Applies(track) {
+		t.Fatal("FLAC is not converted")
+	}
+	if profile.Applies(&Track{Kind: "MPEG audio file", BitRate: 320}) {
+		t.Fatal("MP3 is converted")
+	}
+
+	// estimated from duration, or from the source size and bit rate
+	track.TotalTime = 60 * 1000
+	dst := path.Join(dir, "sink", "1 Song.m4a")
+	transcode := NewTranscode(src, dst, track, profile)
+	if expected := int64(128*60*1000/8 + TRANSCODE_OVERHEAD); transcode.SizeDelta() != expected {
+		t.Errorf("SizeDelta %d, expected %d", transcode.SizeDelta(), expected)
+	}
+	if transcode.ProcessCost() != int64(len(data)) {
+		t.Errorf("ProcessCost %d", transcode.ProcessCost())
+	}
+	track.TotalTime, track.BitRate = 0, 1024
+	if estimated := NewTranscode(src, dst, track, profile).SizeDelta(); estimated != int64(len(data))/8 {
+		t.Errorf("SizeDelta %d without duration", estimated)
+	}
+
+	if err := transcode.Perform(); err != nil {
+		t.Fatal(err)
+	}
+	if isFileExists(dst) {
+		t.Fatal("written before Finish")
+	}
+	if err := transcode.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	written, checksum := transcode.WrittenFile()
+	if expected, _, _ := hashFile(src, false); written != int64(len(data)) || checksum != expected {
+		t.Errorf("written %d %s", written, checksum)
+	}
+	if isFileExists(transcode.tempFile) || !isFileExists(dst) {
+		t.Fatal("not finished")
+	}
+}
+
+func TestTranscodeProfileChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-transcode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := path.Join(dir, "song.flac")
+	ioutil.WriteFile(src, []byte("flac"), 0644)
+	os.MkdirAll(path.Join(dir, "sink"), 0755)
+	ioutil.WriteFile(path.Join(dir, "sink", "1 Song.m4a"), []byte("aac"), 0644)
+	track := &Track{Name: "Song", Kind: "FLAC audio file", PersistentId: "A1", Location: fileLocation(src), DateModified: time.Unix(100, 0)}
+	sinkDir := func() *SinkDir {
+		return &SinkDir{
+			Path:          path.Join(dir, "sink"),
+			CheckedTracks: make(map[string]bool),
+			Tracks: map[string]*TrackMeta{
+				"A1": {OriginPersistentID: "A1", FileName: "1 Song.m4a", ModifiedTime: time.Unix(100, 0), TranscodeProfile: "aac-256"},
+			},
+		}
+	}
+
+	profile, _ := NewTranscodeProfile(&TranscodeConfig{Encoder: "stub"})
+	if acts := sinkDir().SinkTrack(track, "1 Song.m4a", profile); len(acts) != 0 {
+		t.Fatalf("same profile: %v", acts)
+	}
+	profile, _ = NewTranscodeProfile(&TranscodeConfig{Encoder: "stub", SampleRate: 44100})
+	acts := sinkDir().SinkTrack(track, "1 Song.m4a", profile)
+	if len(acts) != 2 {
+		t.Fatalf("sample rate changed: %v", acts)
+	}
+	if _, ok := acts[0].(*Delete); !ok {
+		t.Errorf("%s", acts[0])
+	}
+	if _, ok := acts[1].(*Transcode); !ok {
+		t.Errorf("%s", acts[1])
+	}
+	// not converted any more, copied as is
+	acts = sinkDir().SinkTrack(track, "1 Song.flac", nil)
+	if len(acts) != 2 {
+		t.Fatalf("transcode disabled: %v", acts)
+	}
+	if _, ok := acts[1].(*Copy); !ok {
+		t.Errorf("%s", acts[1])
+	}
+}
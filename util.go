@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
-	"io"
+	"hash"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 func isFileExists(path string) bool {
@@ -18,7 +21,7 @@ func isFileExists(path string) bool {
 // CopyFile copies a file from src to dst. If src and dst files exist, and are
 // the same, then return success. Otherise, attempt to create a hard link
 // between the two files. If that fail, copy the file contents from src to dst.
-func CopyFile(src, dst string) (err error) {
+func CopyFile(src, dst string, progress func(int64), hasher hash.Hash) (err error) {
 	sfi, err := os.Stat(src)
 	if err != nil {
 		return
@@ -44,7 +47,7 @@ func CopyFile(src, dst string) (err error) {
 	//if err = os.Link(src, dst); err == nil {
 	//	return
 	//}
-	err = copyFileContents(src, dst)
+	err = copyFileContents(src, dst, progress, hasher)
 	return
 }
 
@@ -52,25 +55,32 @@ func CopyFile(src, dst string) (err error) {
 // by dst. The file will be created if it does not already exist. If the
 // destination file exists, all it's contents will be replaced by the contents
 // of the source file.
-func copyFileContents(src, dst string) (err error) {
-	in, err := os.Open(src)
-	if err != nil {
-		return
-	}
-	defer in.Close()
-	out, err := os.Create(dst)
-	if err != nil {
-		return
-	}
-	defer func() {
-		cerr := out.Close()
-		if err == nil {
-			err = cerr
-		}
-	}()
-	if _, err = io.Copy(out, in); err != nil {
-		return
+func copyFileContents(src, dst string, progress func(int64), hasher hash.Hash) error {
+	return copyFileWithProgress(src, dst, progress, hasher)
+}
+
+type DiskStatus struct {
+	All  uint64 `json:"all"`
+	Used uint64 `json:"used"`
+	Free uint64 `json:"free"`
+}
+
+const (
+	Byte = 1
+	KiB  = 1024 * Byte
+	MiB  = 1024 * KiB
+	GiB  = 1024 * MiB
+)
+
+var sizePattern = regexp.MustCompile(`^(?i)(\d+(?:\.\d+)?)\s*(KB|MB|GB|TB)$`)
+
+// "500MB", "1.5GB"
+func parseSize(value string) (int64, bool) {
+	m := sizePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return 0, false
 	}
-	err = out.Sync()
-	return
+	n, _ := strconv.ParseFloat(m[1], 64)
+	unit := map[string]int64{"KB": KiB, "MB": MiB, "GB": GiB, "TB": GiB * 1024}[strings.ToUpper(m[2])]
+	return int64(n * float64(unit)), true
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Checksums of synced files are kept in meta.json, or in the manifest of
+// the pool layout. "iwalk verify" reads every file back and reports
+// missing, truncated and corrupted ones; with -repair they are copied
+// again by a sync.
+
+const CHECKSUM_ALGORITHM = "sha256"
+
+func newChecksumHash() hash.Hash {
+	return sha256.New()
+}
+
+// "sha256:<hex>"
+func formatChecksum(h hash.Hash) string {
+	return CHECKSUM_ALGORITHM + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Checksum and size of the file, read from the device rather than from
+// caches if fromDevice
+func hashFile(filePath string, fromDevice bool) (string, int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	if fromDevice {
+		if err := dropFileCache(f); err != nil {
+			logrus.Debugf("Cannot bypass cache for %s: %s", filePath, err)
+		}
+	}
+	h := newChecksumHash()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return formatChecksum(h), n, nil
+}
+
+type VerifyProblem struct {
+	// Device file
+	Path string
+	// Playlist the file belongs to
+	Playlist string
+	// missing, truncated or corrupted
+	Kind   string
+	Detail string
+}
+
+type VerifyResult struct {
+	Problems []VerifyProblem
+	Verified int
+	// Tracks synced before checksums were recorded
+	Unverifiable int
+}
+
+// Device files of broken tracks, for SyncOptions.Repair
+func (r *VerifyResult) BrokenPaths() map[string]bool {
+	ret := make(map[string]bool)
+	for _, problem := range r.Problems {
+		ret[problem.Path] = true
+	}
+	return ret
+}
+
+// Checks files of all sink dirs under sinkPaths against their meta.json,
+// and pooled files against the pool manifest
+func verifySinks(sinkPaths []string, filesystem *FilesystemProfile) (*VerifyResult, error) {
+	result := &VerifyResult{}
+	for _, sinkPath := range sinkPaths {
+		if err := verifyPool(result, sinkPath); err != nil {
+			return nil, err
+		}
+		sink, err := NewSink(sinkPath, filesystem)
+		if err != nil {
+			return nil, err
+		}
+		dirs := sink.scanSinkDirs()
+		relDirs := make([]string, 0, len(dirs))
+		for relDir := range dirs {
+			relDirs = append(relDirs, relDir)
+		}
+		sort.Strings(relDirs)
+		for _, relDir := range relDirs {
+			sinkDir := dirs[relDir]
+			logrus.Infof("Verifying %s", relDir)
+			for _, meta := range sinkDir.Tracks {
+				verifyFile(result, path.Join(sinkDir.Path, meta.FileName), sinkDir.OriginPlaylistName, meta.Size, meta.Checksum)
+			}
+		}
+	}
+	sort.Slice(result.Problems, func(i, j int) bool {
+		return result.Problems[i].Path < result.Problems[j].Path
+	})
+	return result, nil
+}
+
+// Pooled files of the target, if it has the pool layout
+func verifyPool(result *VerifyResult, sinkPath string) error {
+	manifestPath := path.Join(sinkPath, POOL_MANIFEST_FILENAME)
+	if !isFileExists(manifestPath) {
+		return nil
+	}
+	manifest, err := loadPoolManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Verifying %s", POOL_DIRNAME)
+	for _, track := range manifest.Tracks {
+		names := make([]string, 0, len(track.Refs))
+		for _, ref := range track.Refs {
+			if playlist, ok := manifest.Playlists[ref]; ok {
+				names = append(names, playlist.Name)
+			}
+		}
+		sort.Strings(names)
+		verifyFile(result, path.Join(sinkPath, POOL_DIRNAME, track.FileName), strings.Join(names, ", "), track.Size, track.Checksum)
+	}
+	return nil
+}
+
+// Checks the file against the size and checksum recorded when it was written
+func verifyFile(result *VerifyResult, filePath, playlist string, size int64, checksum string) {
+	problem := func(kind, format string, args ...interface{}) {
+		result.Problems = append(result.Problems, VerifyProblem{
+			Path:     filePath,
+			Playlist: playlist,
+			Kind:     kind,
+			Detail:   fmt.Sprintf(format, args...),
+		})
+	}
+	st, err := os.Stat(filePath)
+	if err != nil {
+		problem("missing", "%s", err)
+		return
+	}
+	if checksum == "" {
+		result.Unverifiable += 1
+		return
+	}
+	if size > 0 && st.Size() < size {
+		problem("truncated", "%d of %d bytes", st.Size(), size)
+		return
+	}
+	actual, _, err := hashFile(filePath, true)
+	if err != nil {
+		problem("corrupted", "unreadable: %s", err)
+		return
+	}
+	if actual != checksum {
+		problem("corrupted", "checksum %s, expected %s", actual, checksum)
+		return
+	}
+	result.Verified += 1
+}
+
+func printVerifyResult(result *VerifyResult) {
+	for _, problem := range result.Problems {
+		fmt.Printf("%-10s %s (%s): %s\n", problem.Kind, problem.Path, problem.Playlist, problem.Detail)
+	}
+	fmt.Printf("Verified: %d OK, %d broken, %d without checksum\n", result.Verified, len(result.Problems), result.Unverifiable)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Mix of three tracks, each file "song <name>"
+func newVerifyTestLibrary(t *testing.T, dir string) *Library {
+	library := &Library{
+		Tracks:    make(map[string]Track),
+		Playlists: []Playlist{{Name: "Mix", PlaylistPersistentId: "P1", PlaylistItems: []PlaylistItem{{TrackId: 1}, {TrackId: 2}, {TrackId: 3}}}},
+	}
+	for i, name := range []string{"A", "B", "C"} {
+		src := path.Join(dir, name+".mp3")
+		if err := ioutil.WriteFile(src, []byte("song "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		library.Tracks[string('1'+rune(i))] = Track{TrackId: i + 1, Name: name, PersistentId: "T" + name, Location: fileLocation(src), DateModified: time.Unix(100, 0)}
+	}
+	library.buildIndex()
+	return library
+}
+
+func TestVerifyRepair(t *testing.T) {
+	for _, layout := range []string{"playlist", "pool"} {
+		dir, err := ioutil.TempDir("", "iwalk-verify")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		library := newVerifyTestLibrary(t, dir)
+		sinkPath := path.Join(dir, "sink")
+		os.MkdirAll(sinkPath, 0755)
+		options := &SyncOptions{Playlists: []string{"Mix"}, Layout: layout}
+		if err := startSync(library, sinkPath, options); err != nil {
+			t.Fatal(err)
+		}
+		filesystem := DetectFilesystemProfile(sinkPath)
+		result, err := verifySinks([]string{sinkPath}, filesystem)
+		if err != nil {
+			t.Fatalf("%s: %s", layout, err)
+		}
+		if len(result.Problems) != 0 || result.Verified != 3 || result.Unverifiable != 0 {
+			t.Fatalf("%s: %+v", layout, result)
+		}
+
+		files, _ := filepath.Glob(path.Join(sinkPath, "*", "*.mp3"))
+		sort.Strings(files)
+		if len(files) != 3 {
+			t.Fatalf("%s: synced %v", layout, files)
+		}
+		os.Remove(files[0])
+		os.Truncate(files[1], 3)
+		// same size, different bytes
+		ioutil.WriteFile(files[2], []byte("song X"), 0644)
+		expected := map[string]string{files[0]: "missing", files[1]: "truncated", files[2]: "corrupted"}
+
+		result, err = verifySinks([]string{sinkPath}, filesystem)
+		if err != nil {
+			t.Fatalf("%s: %s", layout, err)
+		}
+		if len(result.Problems) != 3 {
+			t.Fatalf("%s: %+v", layout, result.Problems)
+		}
+		for _, problem := range result.Problems {
+			if expected[problem.Path] != problem.Kind || problem.Playlist != "Mix" {
+				t.Errorf("%s: %+v", layout, problem)
+			}
+		}
+
+		// -repair copies them again
+		options.Repair = result.BrokenPaths()
+		if err := startSync(library, sinkPath, options); err != nil {
+			t.Fatal(err)
+		}
+		result, err = verifySinks([]string{sinkPath}, filesystem)
+		if err != nil {
+			t.Fatalf("%s: %s", layout, err)
+		}
+		if len(result.Problems) != 0 || result.Verified != 3 {
+			t.Errorf("%s: after repair %+v", layout, result)
+		}
+	}
+}
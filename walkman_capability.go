@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Reads what the device can play from capability_00.xml or
+// default-capability.xml at the device root. Element names differ between
+// models, so the tree is matched loosely: Format-like elements name a codec
+// by mime type or extension, and their children give bit rates and
+// sampling rates. Anything not found is treated as unknown (allowed).
+
+var WALKMAN_CAPABILITY_FILES = []string{"capability_00.xml", "default-capability.xml"}
+
+// Content kind -> top-level folder, when the capability doesn't say
+var defaultWalkmanFolders = map[string]string{
+	"music":     "MUSIC",
+	"podcast":   "PODCASTS",
+	"audiobook": "AUDIOBOOKS",
+}
+
+var capabilityCodecs = map[string]string{
+	"audio/mpeg":        "mp3",
+	"audio/mp3":         "mp3",
+	"mp3":               "mp3",
+	"audio/mp4":         "aac",
+	"audio/x-m4a":       "aac",
+	"audio/aac":         "aac",
+	"audio/3gpp":        "aac",
+	"m4a":               "aac",
+	"aac":               "aac",
+	"mp4":               "aac",
+	"audio/x-alac":      "alac",
+	"alac":              "alac",
+	"audio/flac":        "flac",
+	"audio/x-flac":      "flac",
+	"flac":              "flac",
+	"audio/wav":         "wav",
+	"audio/x-wav":       "wav",
+	"wav":               "wav",
+	"audio/aiff":        "aiff",
+	"audio/x-aiff":      "aiff",
+	"aif":               "aiff",
+	"aiff":              "aiff",
+	"audio/x-ms-wma":    "wma",
+	"wma":               "wma",
+	"audio/ogg":         "vorbis",
+	"audio/vorbis":      "vorbis",
+	"ogg":               "vorbis",
+	"audio/opus":        "opus",
+	"opus":              "opus",
+	"audio/x-sony-oma":  "atrac",
+	"oma":               "atrac",
+	"audio/x-dsf":       "dsd",
+	"dsf":               "dsd",
+	"audio/x-mpegurl":   "m3u",
+	"audio/mpegurl":     "m3u",
+	"m3u":               "m3u",
+	"m3u8":              "m3u8",
+	"application/x-pla": "pla",
+	"pla":               "pla",
+}
+
+var playlistFormatNames = map[string]bool{"m3u": true, "m3u8": true, "pla": true}
+
+type CodecCapability struct {
+	MaxBitrate  int   // kbps, 0 if unknown
+	SampleRates []int // Hz, empty if unknown
+}
+
+type WalkmanCapability struct {
+	Path            string
+	Codecs          map[string]*CodecCapability
+	PlaylistFormats []string
+	Artwork         bool
+	// Content kind (music, podcast, audiobook) -> top-level folder
+	Folders map[string]string
+}
+
+type capabilityNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr       `xml:",any,attr"`
+	Text    string           `xml:",chardata"`
+	Nodes   []capabilityNode `xml:",any"`
+}
+
+// Looks for the capability file at devicePath or its parent (for targets like /media/WALKMAN/MUSIC)
+func FindWalkmanCapability(devicePath string) (*WalkmanCapability, bool) {
+	for _, dir := range []string{devicePath, path.Dir(devicePath)} {
+		for _, name := range WALKMAN_CAPABILITY_FILES {
+			capPath := path.Join(dir, name)
+			if !isFileExists(capPath) {
+				continue
+			}
+			capability, err := LoadWalkmanCapability(capPath)
+			if err != nil {
+				logrus.Warnf("Failed to read %s: %s", capPath, err)
+				continue
+			}
+			return capability, true
+		}
+	}
+	return nil, false
+}
+
+func LoadWalkmanCapability(capPath string) (*WalkmanCapability, error) {
+	f, err := os.Open(capPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var root capabilityNode
+	decoder := xml.NewDecoder(f)
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil // capability files are ASCII in practice
+	}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, err
+	}
+	capability := &WalkmanCapability{
+		Path:    capPath,
+		Codecs:  make(map[string]*CodecCapability),
+		Folders: make(map[string]string),
+	}
+	capability.walk(&root, "")
+	for kind, folder := range defaultWalkmanFolders {
+		if _, ok := capability.Folders[kind]; !ok {
+			capability.Folders[kind] = folder
+		}
+	}
+	sort.Strings(capability.PlaylistFormats)
+	return capability, nil
+}
+
+func (n *capabilityNode) attr(names ...string) (string, bool) {
+	for _, name := range names {
+		for _, a := range n.Attrs {
+			if strings.EqualFold(a.Name.Local, name) {
+				return a.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Codecs named by the element, from mime type, extension or name attributes
+func (n *capabilityNode) codecs() []string {
+	values := []string{n.Text}
+	for _, a := range n.Attrs {
+		values = append(values, a.Value)
+	}
+	ret := make([]string, 0)
+	for _, value := range values {
+		for _, word := range strings.FieldsFunc(strings.ToLower(value), func(r rune) bool { return r == ',' || r == ' ' || r == ';' }) {
+			if codec, ok := capabilityCodecs[strings.TrimPrefix(word, ".")]; ok {
+				ret = append(ret, codec)
+			}
+		}
+	}
+	return ret
+}
+
+func (n *capabilityNode) isDenied() bool {
+	value, ok := n.attr("supported", "enable", "enabled", "support")
+	if !ok {
+		return false
+	}
+	value = strings.ToLower(value)
+	return value == "false" || value == "no" || value == "0"
+}
+
+func (c *WalkmanCapability) walk(n *capabilityNode, codec string) {
+	name := strings.ToLower(n.XMLName.Local)
+	switch {
+	case strings.Contains(name, "format") || strings.Contains(name, "codec") || strings.Contains(name, "mime"):
+		if n.isDenied() {
+			break
+		}
+		// audio/x-mpegurl is served for m3u8 too, the extension tells
+		if ext, ok := n.attr("fileExtension", "extension"); ok && playlistFormatNames[strings.TrimPrefix(strings.ToLower(ext), ".")] {
+			c.addPlaylistFormat(strings.TrimPrefix(strings.ToLower(ext), "."))
+			break
+		}
+		for _, found := range n.codecs() {
+			if playlistFormatNames[found] {
+				c.addPlaylistFormat(found)
+			} else {
+				if _, exists := c.Codecs[found]; !exists {
+					c.Codecs[found] = &CodecCapability{}
+				}
+				codec = found
+				break // first one, later values are aliases
+			}
+		}
+	case strings.Contains(name, "artwork") || strings.Contains(name, "albumart") || strings.Contains(name, "coverart") || strings.Contains(name, "jacket"):
+		c.Artwork = c.Artwork || !n.isDenied()
+	case strings.Contains(name, "folder") || strings.Contains(name, "directory"):
+		c.addFolder(n)
+	case codec != "" && strings.Contains(name, "bitrate"):
+		for _, value := range capabilityNumbers(n) {
+			if value >= 100000 || (value >= 8000 && int(value)%1000 == 0) {
+				value /= 1000 // bps, lossless maxima like 9216 are kbps
+			}
+			kbps := int(value)
+			if kbps > c.Codecs[codec].MaxBitrate {
+				c.Codecs[codec].MaxBitrate = kbps
+			}
+		}
+	case codec != "" && (strings.Contains(name, "sampl") || strings.Contains(name, "frequency")):
+		for _, value := range capabilityNumbers(n) {
+			if value < 1000 {
+				value *= 1000 // kHz
+			}
+			c.Codecs[codec].addSampleRate(int(value + 0.5))
+		}
+	}
+	for i := range n.Nodes {
+		c.walk(&n.Nodes[i], codec)
+	}
+}
+
+func (c *WalkmanCapability) addPlaylistFormat(format string) {
+	for _, f := range c.PlaylistFormats {
+		if f == format {
+			return
+		}
+	}
+	c.PlaylistFormats = append(c.PlaylistFormats, format)
+}
+
+func (c *WalkmanCapability) addFolder(n *capabilityNode) {
+	folder, ok := n.attr("name", "path", "folder")
+	if !ok {
+		folder = strings.TrimSpace(n.Text)
+	}
+	folder = strings.Trim(folder, "/\\")
+	if folder == "" || strings.ContainsAny(folder, "/\\") {
+		return
+	}
+	kind, _ := n.attr("type", "kind", "content", "contenttype", "class")
+	kind = strings.ToLower(kind + " " + folder)
+	switch {
+	case strings.Contains(kind, "podcast"):
+		c.Folders["podcast"] = folder
+	case strings.Contains(kind, "audiobook") || strings.Contains(kind, "audio_book"):
+		c.Folders["audiobook"] = folder
+	case strings.Contains(kind, "music"):
+		c.Folders["music"] = folder
+	}
+}
+
+func (cc *CodecCapability) addSampleRate(rate int) {
+	for _, r := range cc.SampleRates {
+		if r == rate {
+			return
+		}
+	}
+	cc.SampleRates = append(cc.SampleRates, rate)
+	sort.Ints(cc.SampleRates)
+}
+
+var capabilityNumberPattern = regexp.MustCompile(`\d+(\.\d+)?`)
+
+// Numbers in max/value-like attributes, or in the text ("44100,48000")
+func capabilityNumbers(n *capabilityNode) []float64 {
+	sources := make([]string, 0)
+	if value, ok := n.attr("max", "maximum", "maxvalue", "max_value", "value", "values"); ok {
+		sources = append(sources, value)
+	} else {
+		sources = append(sources, n.Text)
+	}
+	ret := make([]float64, 0)
+	for _, source := range sources {
+		for _, m := range capabilityNumberPattern.FindAllString(source, -1) {
+			f, err := strconv.ParseFloat(m, 64)
+			if err == nil {
+				ret = append(ret, f)
+			}
+		}
+	}
+	return ret
+}
+
+// Whether the device plays the track as is. Unknown codecs lists allow anything.
+func (c *WalkmanCapability) CanPlay(track *Track) (bool, string) {
+	if len(c.Codecs) == 0 {
+		return true, ""
+	}
+	format := trackFormat(track)
+	codec, ok := c.Codecs[format]
+	if !ok {
+		return false, fmt.Sprintf("format %s not supported", format)
+	}
+	return codec.accepts(track.BitRate, track.SampleRate)
+}
+
+// Whether the device plays output of the transcode profile
+func (c *WalkmanCapability) CanPlayProfile(profile *TranscodeProfile) bool {
+	if len(c.Codecs) == 0 {
+		return true
+	}
+	codec, ok := c.Codecs[profile.Codec]
+	if !ok {
+		return false
+	}
+	ok, _ = codec.accepts(profile.Bitrate, profile.SampleRate)
+	return ok
+}
+
+// Zero values mean unknown
+func (cc *CodecCapability) accepts(bitrate, sampleRate int) (bool, string) {
+	if cc.MaxBitrate > 0 && bitrate > cc.MaxBitrate {
+		return false, fmt.Sprintf("bit rate %dkbps > %dkbps", bitrate, cc.MaxBitrate)
+	}
+	if len(cc.SampleRates) > 0 && sampleRate > 0 {
+		for _, rate := range cc.SampleRates {
+			if rate == sampleRate {
+				return true, ""
+			}
+		}
+		return false, fmt.Sprintf("sample rate %dHz not supported", sampleRate)
+	}
+	return true, ""
+}
+
+// Top-level folder for the content kind, default "MUSIC"
+func (c *WalkmanCapability) Folder(kind string) string {
+	if folder, ok := c.Folders[kind]; ok {
+		return folder
+	}
+	return defaultWalkmanFolders["music"]
+}
+
+func (c *WalkmanCapability) String() string {
+	codecs := make([]string, 0, len(c.Codecs))
+	for name, codec := range c.Codecs {
+		desc := name
+		if codec.MaxBitrate > 0 {
+			desc += fmt.Sprintf("(<=%dkbps)", codec.MaxBitrate)
+		}
+		if len(codec.SampleRates) > 0 {
+			desc += fmt.Sprintf("%v", codec.SampleRates)
+		}
+		codecs = append(codecs, desc)
+	}
+	sort.Strings(codecs)
+	return fmt.Sprintf("codecs: %s, playlists: %s, artwork: %t, folders: %v",
+		strings.Join(codecs, " "), strings.Join(c.PlaylistFormats, " "), c.Artwork, c.Folders)
+}
+
+// Content kind of the track: music, podcast or audiobook
+func trackContentKind(track *Track) string {
+	kind, genre := strings.ToLower(track.Kind), strings.ToLower(track.Genre)
+	switch {
+	case track.Podcast:
+		return "podcast"
+	case strings.Contains(kind, "audiobook") || strings.Contains(kind, "audible"),
+		genre == "audiobook" || genre == "audiobooks",
+		strings.ToLower(path.Ext(track.Location)) == ".m4b":
+		return "audiobook"
+	}
+	return "music"
+}
+
+// Content kind of a playlist: podcast or audiobook only if all tracks are
+func playlistContentKind(tracks []Track) string {
+	if len(tracks) == 0 {
+		return "music"
+	}
+	kind := trackContentKind(&tracks[0])
+	for i := range tracks[1:] {
+		if trackContentKind(&tracks[i+1]) != kind {
+			return "music"
+		}
+	}
+	return kind
+}
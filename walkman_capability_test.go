@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLoadWalkmanCapability(t *testing.T) {
+	cases := []struct {
+		file     string
+		expected string
+	}{
+		{
+			"testdata/default-capability.xml",
+			"codecs: aac(<=320kbps)[44100 48000] mp3(<=320kbps)[32000 44100 48000], playlists: m3u8, artwork: true, " +
+				"folders: map[audiobook:AUDIOBOOKS music:MUSIC podcast:PODCASTS]",
+		},
+		{
+			"testdata/capability_00.xml",
+			"codecs: aac(<=320kbps)[44100 48000] alac flac(<=9216kbps)[44100 48000 88200 96000 176400 192000] mp3(<=320kbps), " +
+				"playlists: m3u, artwork: true, folders: map[audiobook:Audible music:MUSIC podcast:PODCASTS]",
+		},
+	}
+	for _, c := range cases {
+		capability, err := LoadWalkmanCapability(c.file)
+		if err != nil {
+			t.Fatalf("%s: %s", c.file, err)
+		}
+		if capability.String() != c.expected {
+			t.Errorf("%s:\n%s\nexpected\n%s", c.file, capability, c.expected)
+		}
+	}
+
+	capability, _ := LoadWalkmanCapability("testdata/default-capability.xml")
+	plays := []struct {
+		track Track
+		ok    bool
+	}{
+		{Track{Kind: "MPEG audio file", BitRate: 320, SampleRate: 44100}, true},
+		{Track{Kind: "AAC audio file", BitRate: 256, SampleRate: 96000}, false},
+		{Track{Kind: "AAC audio file", BitRate: 512, SampleRate: 44100}, false},
+		{Track{Kind: "FLAC audio file"}, false},
+		{Track{Location: "file:///Music/a.wma"}, false},
+	}
+	for _, play := range plays {
+		if ok, reason := capability.CanPlay(&play.track); ok != play.ok {
+			t.Errorf("%+v: %t (%s)", play.track, ok, reason)
+		}
+	}
+	if !capability.CanPlayProfile(&TranscodeProfile{Codec: "aac", Bitrate: 256}) ||
+		capability.CanPlayProfile(&TranscodeProfile{Codec: "aac", Bitrate: 256, SampleRate: 96000}) {
+		t.Error("CanPlayProfile")
+	}
+}
+
+func TestFindWalkmanCapability(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-capability")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "MUSIC"), 0755)
+	if _, ok := FindWalkmanCapability(path.Join(dir, "MUSIC")); ok {
+		t.Fatal("found in an empty dir")
+	}
+	data, _ := ioutil.ReadFile("testdata/capability_00.xml")
+	ioutil.WriteFile(path.Join(dir, "capability_00.xml"), data, 0644)
+	capability, ok := FindWalkmanCapability(path.Join(dir, "MUSIC"))
+	if !ok || capability.Path != path.Join(dir, "capability_00.xml") {
+		t.Fatalf("not found from MUSIC: %+v", capability)
+	}
+}
+
+// Tracks synced before the capability file was read stay on the device
+func TestCapabilityKeepsSyncedTracks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iwalk-capability")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sinkPath := path.Join(dir, "sink")
+	os.MkdirAll(sinkPath, 0755)
+	library := &Library{
+		Tracks: make(map[string]Track),
+		Playlists: []Playlist{
+			{Name: "Mix", PlaylistPersistentId: "P1", PlaylistItems: []PlaylistItem{{TrackId: 1}, {TrackId: 2}}},
+		},
+	}
+	for i, file := range []string{"a.flac", "b.mp3"} {
+		src := path.Join(dir, file)
+		ioutil.WriteFile(src, []byte(file), 0644)
+		library.Tracks[string('1'+rune(i))] = Track{TrackId: i + 1, Name: file[:1], PersistentId: "T" + file, Location: fileLocation(src), DateModified: time.Unix(100, 0)}
+	}
+	library.buildIndex()
+	if err := startSync(library, sinkPath, &SyncOptions{Playlists: []string{"Mix"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	capability, _ := LoadWalkmanCapability("testdata/default-capability.xml")
+	// a new FLAC track is not copied
+	src := path.Join(dir, "c.flac")
+	ioutil.WriteFile(src, []byte("c"), 0644)
+	library.Tracks["3"] = Track{TrackId: 3, Name: "c", PersistentId: "Tc.flac", Location: fileLocation(src), DateModified: time.Unix(100, 0)}
+	library.Playlists[0].PlaylistItems = append(library.Playlists[0].PlaylistItems, PlaylistItem{TrackId: 3})
+	library.buildIndex()
+	if err := startSync(library, sinkPath, &SyncOptions{Playlists: []string{"Mix"}, Capability: capability}); err != nil {
+		t.Fatal(err)
+	}
+	if !isFileExists(path.Join(sinkPath, "Mix/1 a.flac")) || !isFileExists(path.Join(sinkPath, "Mix/2 b.mp3")) {
+		t.Fatal("synced FLAC deleted")
+	}
+	if isFileExists(path.Join(sinkPath, "Mix/3 c.flac")) {
+		t.Fatal("new FLAC copied")
+	}
+	data, _ := ioutil.ReadFile(path.Join(sinkPath, "Mix", META_JSON_FILENAME))
+	var sinkDir SinkDir
+	if err := json.Unmarshal(data, &sinkDir); err != nil {
+		t.Fatal(err)
+	}
+	if meta := sinkDir.Tracks["Ta.flac"]; meta == nil || meta.FileName != "1 a.flac" || len(sinkDir.Tracks) != 2 {
+		t.Fatalf("meta.json: %s", data)
+	}
+}